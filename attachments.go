@@ -0,0 +1,194 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/lib/pq"
+)
+
+const maxAttachmentsPerMessage = 10
+
+// messageSelect is the shared column list for building Message payloads.
+const messageSelect = `
+            SELECT m.id, m.channel_id, m.user_id, COALESCE(m.author_name, u.username), m.content, m.created_at,
+                   COALESCE(m.author_avatar_url, u.avatar_url), COALESCE(m.webhook_id, 0), u.is_bot,
+                   CASE WHEN m.author_name IS NULL THEN COALESCE(u.nickname, '') ELSE '' END
+            FROM messages m JOIN users u ON m.user_id = u.id`
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanMessage(row rowScanner) (Message, error) {
+	var msg Message
+	var avatarURL sql.NullString
+	if err := row.Scan(&msg.ID, &msg.ChannelID, &msg.UserID, &msg.Username, &msg.Content, &msg.CreatedAt, &avatarURL, &msg.WebhookID, &msg.Bot, &msg.Nickname); err != nil {
+		return msg, err
+	}
+	if avatarURL.Valid {
+		msg.AvatarURL = avatarURL.String
+	}
+	// Webhook avatar overrides point at external hosts.
+	if proxied := proxyURL(msg.AvatarURL); proxied != "" {
+		msg.AvatarURL = proxied
+	}
+	msg.Attachments = []Attachment{}
+	msg.Embeds = []Embed{}
+	return msg, nil
+}
+
+// getMessageByID loads a single message with its attachments and embeds.
+func getMessageByID(db *sql.DB, id int64) (Message, error) {
+	msg, err := scanMessage(db.QueryRow(messageSelect+` WHERE m.id = $1`, id))
+	if err != nil {
+		return msg, err
+	}
+	messages := []Message{msg}
+	if err := hydrateMessages(db, messages); err != nil {
+		return msg, err
+	}
+	return messages[0], nil
+}
+
+// hydrateMessages loads everything a Message payload carries besides the
+// messages row itself.
+func hydrateMessages(db *sql.DB, messages []Message) error {
+	if err := renderMessageContent(db, messages); err != nil {
+		return err
+	}
+	if err := loadAttachments(db, messages); err != nil {
+		return err
+	}
+	return loadEmbeds(db, messages)
+}
+
+// loadAttachments fills in Attachments for every message in the slice.
+func loadAttachments(db *sql.DB, messages []Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	ids := make([]int64, len(messages))
+	index := make(map[int64]int, len(messages))
+	for i, msg := range messages {
+		ids[i] = msg.ID
+		index[msg.ID] = i
+		if messages[i].Attachments == nil {
+			messages[i].Attachments = []Attachment{}
+		}
+	}
+	rows, err := db.Query(`
+		SELECT ma.message_id, up.id, up.orig_filename, up.stored_filename, up.filetype, up.filesize, up.width, up.height,
+		       up.scan_status
+		FROM message_attachments ma JOIN uploads up ON ma.upload_id = up.id
+		WHERE ma.message_id = ANY($1)
+		ORDER BY ma.message_id, ma.position`, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var uploadIDs []int64
+	for rows.Next() {
+		var messageID int64
+		var a Attachment
+		var storedFilename string
+		var filetype sql.NullString
+		var filesize, width, height sql.NullInt64
+		if err := rows.Scan(&messageID, &a.ID, &a.Filename, &storedFilename, &filetype, &filesize, &width, &height,
+			&a.ScanStatus); err != nil {
+			return err
+		}
+		a.Filetype = filetype.String
+		a.Filesize = filesize.Int64
+		a.Width = int(width.Int64)
+		a.Height = int(height.Int64)
+		a.URL = signedUploadURL(storedFilename)
+		i := index[messageID]
+		messages[i].Attachments = append(messages[i].Attachments, a)
+		uploadIDs = append(uploadIDs, a.ID)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	variants, err := loadUploadVariants(db, uploadIDs)
+	if err != nil {
+		return err
+	}
+	for i := range messages {
+		for j := range messages[i].Attachments {
+			messages[i].Attachments[j].Variants = variants[messages[i].Attachments[j].ID]
+		}
+	}
+	return nil
+}
+
+// attachUploads links the given uploads to a message inside tx. Every upload
+// must exist, belong to userID and not already be attached elsewhere.
+func attachUploads(tx *sql.Tx, userID, messageID int64, uploadIDs []int64) error {
+	if len(uploadIDs) > maxAttachmentsPerMessage {
+		return &httpError{http.StatusBadRequest, fmt.Sprintf("Too many attachments (max %d)", maxAttachmentsPerMessage)}
+	}
+	seen := make(map[int64]bool, len(uploadIDs))
+	for position, uploadID := range uploadIDs {
+		if seen[uploadID] {
+			return &httpError{http.StatusBadRequest, "Duplicate attachment"}
+		}
+		seen[uploadID] = true
+
+		var ownerID int64
+		var attached bool
+		var scanStatus string
+		err := tx.QueryRow(`
+			SELECT up.user_id, EXISTS (SELECT 1 FROM message_attachments ma WHERE ma.upload_id = up.id), up.scan_status
+			FROM uploads up WHERE up.id = $1 FOR UPDATE`, uploadID).Scan(&ownerID, &attached, &scanStatus)
+		if err == sql.ErrNoRows {
+			return &httpError{http.StatusBadRequest, fmt.Sprintf("Attachment %d not found", uploadID)}
+		}
+		if err != nil {
+			return err
+		}
+		if ownerID != userID {
+			return &httpError{http.StatusForbidden, fmt.Sprintf("Attachment %d does not belong to you", uploadID)}
+		}
+		if attached {
+			return &httpError{http.StatusConflict, fmt.Sprintf("Attachment %d is already attached to a message", uploadID)}
+		}
+		// Pending files may be attached; they show as scanning until a verdict.
+		if scanStatus == scanInfected {
+			return &httpError{http.StatusUnprocessableEntity, fmt.Sprintf("Attachment %d failed malware scan", uploadID)}
+		}
+		if _, err := tx.Exec(
+			`INSERT INTO message_attachments (message_id, upload_id, position) VALUES ($1, $2, $3)`,
+			messageID, uploadID, position,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// broadcastMessage wraps msg in a WebSocketMessage and sends it through the hub.
+func broadcastMessage(hub *Hub, event string, msg Message) {
+	broadcastEvent(hub, event, msg)
+}
+
+// sendToUser sends an event to every connection of one user and reports
+// whether any of them took it. Users who are not connected miss it.
+func sendToUser(hub *Hub, userID int64, event string, payload interface{}) bool {
+	payloadBytes, _ := json.Marshal(payload)
+	wrappedMsg, _ := json.Marshal(WebSocketMessage{Event: event, Payload: json.RawMessage(payloadBytes)})
+	delivered := make(chan bool, 1)
+	hub.direct <- directMessage{userID: userID, data: wrappedMsg, delivered: delivered}
+	return <-delivered
+}
+
+// broadcastEvent sends an event with an arbitrary payload to every client.
+func broadcastEvent(hub *Hub, event string, payload interface{}) {
+	payloadBytes, _ := json.Marshal(payload)
+	wrappedMsg, _ := json.Marshal(WebSocketMessage{Event: event, Payload: json.RawMessage(payloadBytes)})
+	hub.broadcast <- wrappedMsg
+}
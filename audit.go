@@ -0,0 +1,118 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The audit log records security-relevant events: logins, lockouts,
+// changes to two-factor authentication and single sign-on links. It is
+// append-only and read by admins through GET /api/admin/audit-log.
+
+const (
+	auditLoginSucceeded = "login.succeeded"
+	auditLoginFailed    = "login.failed"
+	auditLoginLocked    = "login.locked"
+	auditLoginUnlocked  = "login.unlocked"
+
+	auditMFAEnabled          = "mfa.enabled"
+	auditMFADisabled         = "mfa.disabled"
+	auditMFAReset            = "mfa.reset"
+	auditMFARecoveryCodeUsed = "mfa.recovery_code_used"
+	auditMFACodesRegenerated = "mfa.recovery_codes_regenerated"
+
+	auditOIDCLinked      = "oidc.linked"
+	auditOIDCUnlinked    = "oidc.unlinked"
+	auditOIDCProvisioned = "oidc.provisioned"
+)
+
+// AuditEvent is one audit log entry. UserID is the account the event is
+// about, when it exists; ActorID is who caused it, when that was someone
+// else, such as the admin who unlocked an account.
+type AuditEvent struct {
+	ID        int64     `json:"id"`
+	Event     string    `json:"event"`
+	UserID    int64     `json:"user_id,omitempty"`
+	Username  string    `json:"username,omitempty"`
+	ActorID   int64     `json:"actor_id,omitempty"`
+	IP        string    `json:"ip,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	Detail    string    `json:"detail,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// recordAudit appends an event about username. r is the request that caused
+// it, for the client's address; actor is nil unless someone acted on another
+// account.
+func recordAudit(db *sql.DB, r *http.Request, event, username string, actor *User, detail string) {
+	var actorID sql.NullInt64
+	if actor != nil {
+		actorID = sql.NullInt64{Int64: actor.ID, Valid: true}
+	}
+	_, err := db.Exec(`
+		INSERT INTO audit_log (event, user_id, username, actor_id, ip, user_agent, detail)
+		VALUES ($1, (SELECT id FROM users WHERE username = $2), NULLIF($2, ''), $3, NULLIF($4, ''), NULLIF($5, ''), NULLIF($6, ''))`,
+		event, username, actorID, clientIP(r), truncateRunes(r.UserAgent(), 256), detail)
+	if err != nil {
+		log.Printf("Failed to record %s for '%s': %v", event, username, err)
+	}
+}
+
+// clientIP returns the address a request came from. Behind a reverse proxy
+// (config.TrustProxyHeaders) that is the last address in X-Forwarded-For,
+// the one the proxy itself appended.
+func clientIP(r *http.Request) string {
+	if config.TrustProxyHeaders {
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			hops := strings.Split(fwd, ",")
+			if ip := net.ParseIP(strings.TrimSpace(hops[len(hops)-1])); ip != nil {
+				return ip.String()
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// auditLogHandler lists audit events, newest first. Filters: event, user_id.
+func auditLogHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isAdmin(userFromContext(r.Context())) {
+			http.Error(w, "Admin access required", http.StatusForbidden)
+			return
+		}
+		q := r.URL.Query()
+		limit, offset := pageParams(q)
+		userID, _ := strconv.ParseInt(q.Get("user_id"), 10, 64)
+		rows, err := db.Query(`
+			SELECT id, event, COALESCE(user_id, 0), COALESCE(username, ''), COALESCE(actor_id, 0),
+				COALESCE(ip, ''), COALESCE(user_agent, ''), COALESCE(detail, ''), created_at
+			FROM audit_log
+			WHERE ($1 = '' OR event = $1) AND ($2 = 0 OR user_id = $2)
+			ORDER BY id DESC LIMIT $3 OFFSET $4`, q.Get("event"), userID, limit, offset)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+		events := []AuditEvent{}
+		for rows.Next() {
+			var e AuditEvent
+			if err := rows.Scan(&e.ID, &e.Event, &e.UserID, &e.Username, &e.ActorID,
+				&e.IP, &e.UserAgent, &e.Detail, &e.CreatedAt); err == nil {
+				events = append(events, e)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(events)
+	}
+}
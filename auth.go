@@ -0,0 +1,138 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+)
+
+// Password checks go through a chain of authenticators, configured with
+// config.AuthBackends (PRISMA_AUTH_BACKENDS=ldap,local). The first one that
+// accepts the password wins. The bootstrap admin created by
+// ensureInitialAdmin always uses the local password and no other backend, so
+// the server stays manageable when the directory is down or misconfigured.
+//
+// Every account belongs to the backend that created it (users.auth_source):
+// a directory login never takes over a local account of the same name, and
+// local passwords only work for local accounts. Self-registration is off
+// while the directory is in the chain, so nobody can claim a directory
+// user's name before their first login.
+
+// errAuthFailed means an authenticator does not accept the credentials.
+// Other errors mean it could not tell, and are logged.
+var errAuthFailed = errors.New("authentication failed")
+
+const (
+	authSourceLocal = "local"
+	authSourceLDAP  = "ldap"
+	authSourceOIDC  = "oidc"
+)
+
+// externalUsernamePattern is what a directory may name a user.
+var externalUsernamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,32}$`)
+
+type authenticator interface {
+	name() string
+	authenticate(db *sql.DB, username, password string) (*User, error)
+}
+
+var authChain = newAuthChain()
+
+func newAuthChain() []authenticator {
+	var chain []authenticator
+	for _, name := range config.AuthBackends {
+		switch name {
+		case authSourceLocal:
+			chain = append(chain, localAuthenticator{})
+		case authSourceLDAP:
+			chain = append(chain, ldapAuthenticator{})
+		default:
+			log.Printf("Ignoring unknown authentication backend %q", name)
+		}
+	}
+	return chain
+}
+
+// localAuthenticator checks passwords stored in the users table.
+type localAuthenticator struct{}
+
+func (localAuthenticator) name() string { return authSourceLocal }
+
+func (localAuthenticator) authenticate(db *sql.DB, username, password string) (*User, error) {
+	user, ok := scanUser(db.QueryRow(
+		`SELECT id, username, role, avatar_url, is_bot, COALESCE(nickname, '') FROM users WHERE username=$1 AND password=$2 AND NOT is_bot AND auth_source=$3`,
+		username, password, authSourceLocal,
+	))
+	if !ok {
+		return nil, errAuthFailed
+	}
+	return user, nil
+}
+
+// isBootstrapAdmin matches case-insensitively, as directories do, so
+// "ADMIN" cannot reach the directory in place of the bootstrap admin.
+func isBootstrapAdmin(db *sql.DB, username string) bool {
+	var bootstrap bool
+	db.QueryRow(`SELECT EXISTS (SELECT 1 FROM users WHERE LOWER(username) = LOWER($1) AND bootstrap)`, username).Scan(&bootstrap)
+	return bootstrap
+}
+
+// registrationOpen reports whether people may create local accounts
+// themselves.
+func registrationOpen() bool {
+	return config.PasswordLogin && !containsString(config.AuthBackends, authSourceLDAP)
+}
+
+// syncExternalUser returns the user a directory has authenticated, creating
+// them on first login with a random password nobody knows. Names are matched
+// case-insensitively, and an existing account is only used if the same
+// backend created it and it is not the bootstrap admin. When managed is set
+// the directory decides the role on every login.
+func syncExternalUser(db *sql.DB, backend, username string, role Role, managed bool) (*User, error) {
+	if !externalUsernamePattern.MatchString(username) {
+		return nil, fmt.Errorf("unusable username %q", username)
+	}
+	const lookup = `SELECT id, auth_source, bootstrap FROM users WHERE LOWER(username) = LOWER($1) ORDER BY id LIMIT 1`
+	var userID int64
+	var source string
+	var bootstrap bool
+	err := db.QueryRow(lookup, username).Scan(&userID, &source, &bootstrap)
+	if err == sql.ErrNoRows {
+		password, err := generateToken()
+		if err != nil {
+			return nil, err
+		}
+		err = db.QueryRow(`
+			INSERT INTO users (username, password, role, auth_source) VALUES ($1, $2, $3, $4)
+			ON CONFLICT (username) DO NOTHING RETURNING id`, username, password, string(role), backend).Scan(&userID)
+		switch {
+		case err == nil:
+			log.Printf("Created user '%s' on first %s login", username, backend)
+			queueEvent(db, eventMemberJoined, User{ID: userID, Username: username, Role: role})
+			source = backend
+		case err == sql.ErrNoRows:
+			// A concurrent first login created the row; use theirs.
+			err = db.QueryRow(lookup, username).Scan(&userID, &source, &bootstrap)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if bootstrap {
+		return nil, fmt.Errorf("refusing %s login as the bootstrap admin", backend)
+	}
+	if source != backend {
+		return nil, fmt.Errorf("'%s' is a %s account, not a %s one", username, source, backend)
+	}
+	if managed {
+		db.Exec(`UPDATE users SET role = $1 WHERE id = $2 AND role <> $1`, string(role), userID)
+	}
+	user, ok := scanUser(db.QueryRow(`
+		SELECT id, username, role, avatar_url, is_bot, COALESCE(nickname, '') FROM users WHERE id = $1`, userID))
+	if !ok || user.Bot {
+		return nil, errAuthFailed
+	}
+	return user, nil
+}
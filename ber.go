@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// The subset of ASN.1 BER that LDAP needs (RFC 4511 section 5.1): definite
+// lengths, single-byte tags, and the LDAP search filter syntax of RFC 4515.
+
+const (
+	berBoolean     = 0x01
+	berInteger     = 0x02
+	berOctetString = 0x04
+	berEnumerated  = 0x0a
+	berSequence    = 0x30
+	berSet         = 0x31
+
+	berConstructed = 0x20
+	// berMaxLength bounds a single element read from the network.
+	berMaxLength = 16 << 20
+)
+
+// berPacket is a decoded element. Constructed elements have Children.
+type berPacket struct {
+	Tag      byte
+	Data     []byte
+	Children []berPacket
+}
+
+func berLength(n int) []byte {
+	if n < 0x80 {
+		return []byte{byte(n)}
+	}
+	var b []byte
+	for ; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	return append([]byte{0x80 | byte(len(b))}, b...)
+}
+
+// berTLV encodes one element with the given tag and content.
+func berTLV(tag byte, content []byte) []byte {
+	out := append([]byte{tag}, berLength(len(content))...)
+	return append(out, content...)
+}
+
+func berSeq(tag byte, elements ...[]byte) []byte {
+	var content []byte
+	for _, e := range elements {
+		content = append(content, e...)
+	}
+	return berTLV(tag, content)
+}
+
+func berInt(tag byte, v int64) []byte {
+	var b []byte
+	for {
+		b = append([]byte{byte(v)}, b...)
+		if (v >= -128 && v < 128) || len(b) == 8 {
+			break
+		}
+		v >>= 8
+	}
+	return berTLV(tag, b)
+}
+
+func berString(tag byte, s string) []byte {
+	return berTLV(tag, []byte(s))
+}
+
+func berBool(v bool) []byte {
+	if v {
+		return berTLV(berBoolean, []byte{0xff})
+	}
+	return berTLV(berBoolean, []byte{0x00})
+}
+
+// readBER reads one element, decoding constructed elements recursively.
+func readBER(r *bufio.Reader) (berPacket, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return berPacket{}, err
+	}
+	if tag&0x1f == 0x1f {
+		return berPacket{}, errors.New("ber: multi-byte tags are not supported")
+	}
+	first, err := r.ReadByte()
+	if err != nil {
+		return berPacket{}, err
+	}
+	length := int(first)
+	if first&0x80 != 0 {
+		n := int(first & 0x7f)
+		if n == 0 || n > 4 {
+			return berPacket{}, errors.New("ber: unsupported length")
+		}
+		length = 0
+		for i := 0; i < n; i++ {
+			b, err := r.ReadByte()
+			if err != nil {
+				return berPacket{}, err
+			}
+			length = length<<8 | int(b)
+		}
+	}
+	if length > berMaxLength {
+		return berPacket{}, errors.New("ber: element too large")
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return berPacket{}, err
+	}
+	return parseBER(tag, data)
+}
+
+func parseBER(tag byte, data []byte) (berPacket, error) {
+	p := berPacket{Tag: tag, Data: data}
+	if tag&berConstructed == 0 {
+		return p, nil
+	}
+	r := bufio.NewReader(bytes.NewReader(data))
+	for {
+		child, err := readBER(r)
+		if err == io.EOF {
+			return p, nil
+		}
+		if err != nil {
+			return p, err
+		}
+		p.Children = append(p.Children, child)
+	}
+}
+
+// int decodes an INTEGER or ENUMERATED.
+func (p berPacket) int() int64 {
+	var v int64
+	for i, b := range p.Data {
+		if i == 0 && b&0x80 != 0 {
+			v = -1
+		}
+		v = v<<8 | int64(b)
+	}
+	return v
+}
+
+// --- Search filters ---
+
+// Context-specific filter tags from RFC 4511 section 4.5.1.
+const (
+	filterAnd            = 0xa0
+	filterOr             = 0xa1
+	filterNot            = 0xa2
+	filterEquality       = 0xa3
+	filterSubstrings     = 0xa4
+	filterGreaterOrEqual = 0xa5
+	filterLessOrEqual    = 0xa6
+	filterPresent        = 0x87
+	filterApprox         = 0xa8
+)
+
+// encodeFilter compiles a string filter such as "(&(objectClass=person)(uid=bob))".
+func encodeFilter(s string) ([]byte, error) {
+	f, rest, err := parseFilter(strings.TrimSpace(s))
+	if err != nil {
+		return nil, err
+	}
+	if rest != "" {
+		return nil, fmt.Errorf("filter: unexpected %q", rest)
+	}
+	return f, nil
+}
+
+func parseFilter(s string) ([]byte, string, error) {
+	if !strings.HasPrefix(s, "(") {
+		return nil, "", fmt.Errorf("filter: expected ( at %q", s)
+	}
+	s = s[1:]
+	var out []byte
+	switch {
+	case strings.HasPrefix(s, "&"), strings.HasPrefix(s, "|"):
+		tag := byte(filterAnd)
+		if s[0] == '|' {
+			tag = filterOr
+		}
+		s = s[1:]
+		var parts [][]byte
+		for strings.HasPrefix(s, "(") {
+			f, rest, err := parseFilter(s)
+			if err != nil {
+				return nil, "", err
+			}
+			parts, s = append(parts, f), rest
+		}
+		out = berSeq(tag, parts...)
+	case strings.HasPrefix(s, "!"):
+		f, rest, err := parseFilter(s[1:])
+		if err != nil {
+			return nil, "", err
+		}
+		out, s = berSeq(filterNot, f), rest
+	default:
+		end := strings.IndexByte(s, ')')
+		if end < 0 {
+			return nil, "", errors.New("filter: missing )")
+		}
+		item, err := encodeFilterItem(s[:end])
+		if err != nil {
+			return nil, "", err
+		}
+		out, s = item, s[end:]
+	}
+	if !strings.HasPrefix(s, ")") {
+		return nil, "", errors.New("filter: missing )")
+	}
+	return out, s[1:], nil
+}
+
+func encodeFilterItem(item string) ([]byte, error) {
+	eq := strings.IndexByte(item, '=')
+	if eq <= 0 {
+		return nil, fmt.Errorf("filter: bad item %q", item)
+	}
+	attr, value := item[:eq], item[eq+1:]
+	tag := byte(filterEquality)
+	switch attr[len(attr)-1] {
+	case '>':
+		tag, attr = filterGreaterOrEqual, attr[:len(attr)-1]
+	case '<':
+		tag, attr = filterLessOrEqual, attr[:len(attr)-1]
+	case '~':
+		tag, attr = filterApprox, attr[:len(attr)-1]
+	}
+	if tag == filterEquality && value == "*" {
+		return berString(filterPresent, attr), nil
+	}
+	if tag == filterEquality && strings.Contains(value, "*") {
+		parts := strings.Split(value, "*")
+		var subs [][]byte
+		for i, part := range parts {
+			if part == "" {
+				continue
+			}
+			v, err := unescapeFilterValue(part)
+			if err != nil {
+				return nil, err
+			}
+			subTag := byte(0x81) // any
+			if i == 0 {
+				subTag = 0x80 // initial
+			} else if i == len(parts)-1 {
+				subTag = 0x82 // final
+			}
+			subs = append(subs, berString(subTag, v))
+		}
+		return berSeq(filterSubstrings, berString(berOctetString, attr), berSeq(berSequence, subs...)), nil
+	}
+	v, err := unescapeFilterValue(value)
+	if err != nil {
+		return nil, err
+	}
+	return berSeq(tag, berString(berOctetString, attr), berString(berOctetString, v)), nil
+}
+
+// unescapeFilterValue decodes \XX escapes.
+func unescapeFilterValue(s string) (string, error) {
+	if !strings.Contains(s, `\`) {
+		return s, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+3 > len(s) {
+			return "", fmt.Errorf("filter: bad escape in %q", s)
+		}
+		v, err := hex.DecodeString(s[i+1 : i+3])
+		if err != nil {
+			return "", fmt.Errorf("filter: bad escape in %q", s)
+		}
+		b.Write(v)
+		i += 2
+	}
+	return b.String(), nil
+}
+
+// escapeFilterValue makes a string safe to put in a filter (RFC 4515).
+func escapeFilterValue(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '*', '(', ')', '\\', 0:
+			fmt.Fprintf(&b, `\%02x`, c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// escapeDNValue makes a string safe to use as an attribute value in a DN
+// (RFC 4514).
+func escapeDNValue(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case strings.IndexByte(`,+"\<>;=`, c) >= 0:
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c == 0:
+			b.WriteString(`\00`)
+		case (c == ' ' || c == '#') && i == 0, c == ' ' && i == len(s)-1:
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
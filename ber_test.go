@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func mustHex(s string) []byte {
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func TestBERInt(t *testing.T) {
+	tests := []struct {
+		v    int64
+		want string
+	}{
+		{0, "02 01 00"},
+		{127, "02 01 7f"},
+		{128, "02 02 00 80"},
+		{256, "02 02 01 00"},
+		{-1, "02 01 ff"},
+		{-128, "02 01 80"},
+		{-129, "02 02 ff 7f"},
+	}
+	for _, tt := range tests {
+		got := berInt(berInteger, tt.v)
+		if !bytes.Equal(got, mustHex(tt.want)) {
+			t.Errorf("berInt(%d) = % x, want %s", tt.v, got, tt.want)
+		}
+		p, err := readBER(bufio.NewReader(bytes.NewReader(got)))
+		if err != nil || p.int() != tt.v {
+			t.Errorf("readBER(berInt(%d)) = %d, %v", tt.v, p.int(), err)
+		}
+	}
+}
+
+func TestReadBER(t *testing.T) {
+	long := strings.Repeat("x", 300)
+	tests := []struct {
+		name    string
+		in      []byte
+		want    berPacket
+		wantErr string
+	}{
+		{
+			name: "primitive",
+			in:   mustHex("04 03 62 6f 62"),
+			want: berPacket{Tag: berOctetString, Data: []byte("bob")},
+		},
+		{
+			name: "long form length",
+			in:   append(mustHex("04 82 01 2c"), long...),
+			want: berPacket{Tag: berOctetString, Data: []byte(long)},
+		},
+		{
+			name: "constructed",
+			in:   mustHex("30 06 02 01 05 01 01 ff"),
+			want: berPacket{Tag: berSequence, Data: mustHex("02 01 05 01 01 ff"), Children: []berPacket{
+				{Tag: berInteger, Data: []byte{5}},
+				{Tag: berBoolean, Data: []byte{0xff}},
+			}},
+		},
+		{name: "multi-byte tag", in: mustHex("1f 01 00"), wantErr: "multi-byte tags"},
+		{name: "indefinite length", in: mustHex("30 80 00 00"), wantErr: "unsupported length"},
+		{name: "five length bytes", in: mustHex("04 85 00 00 00 00 01 00"), wantErr: "unsupported length"},
+		{name: "too large", in: mustHex("04 84 7f ff ff ff"), wantErr: "too large"},
+		{name: "truncated", in: mustHex("04 05 61 62"), wantErr: "EOF"},
+		{name: "truncated child", in: mustHex("30 03 04 05 61"), wantErr: "EOF"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readBER(bufio.NewReader(bytes.NewReader(tt.in)))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("readBER error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readBER: %v", err)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("readBER = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncodeFilter(t *testing.T) {
+	tests := []struct {
+		filter  string
+		want    string
+		wantErr bool
+	}{
+		{filter: "(uid=bob)", want: "a3 0a 04 03 756964 04 03 626f62"},
+		{filter: " (uid=bob) ", want: "a3 0a 04 03 756964 04 03 626f62"},
+		{filter: "(objectClass=*)", want: "87 0b 6f626a656374436c617373"},
+		{filter: "(cn=ab*c*d)", want: "a4 10 04 02 636e 30 0a 80 02 6162 81 01 63 82 01 64"},
+		{filter: "(cn=*c)", want: "a4 09 04 02 636e 30 03 82 01 63"},
+		{filter: `(cn=a\2ab)`, want: "a3 09 04 02 636e 04 03 612a62"},
+		{filter: "(age>=5)", want: "a5 08 04 03 616765 04 01 35"},
+		{filter: "(age<=5)", want: "a6 08 04 03 616765 04 01 35"},
+		{filter: "(cn~=x)", want: "a8 07 04 02 636e 04 01 78"},
+		{filter: "(&(a=1)(!(b=2)))", want: "a0 12 a3 06 04 01 61 04 01 31 a2 08 a3 06 04 01 62 04 01 32"},
+		{filter: "(|(a=1)(b=2))", want: "a1 10 a3 06 04 01 61 04 01 31 a3 06 04 01 62 04 01 32"},
+		{filter: "uid=bob", wantErr: true},
+		{filter: "(uid=bob", wantErr: true},
+		{filter: "(uid=bob))", wantErr: true},
+		{filter: "(=bob)", wantErr: true},
+		{filter: "(uid)", wantErr: true},
+		{filter: `(cn=\zz)`, wantErr: true},
+		{filter: `(cn=a\2)`, wantErr: true},
+		{filter: "(&(a=1)", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := encodeFilter(tt.filter)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("encodeFilter(%q) = % x, want an error", tt.filter, got)
+			}
+			continue
+		}
+		if err != nil || !bytes.Equal(got, mustHex(tt.want)) {
+			t.Errorf("encodeFilter(%q) = % x, %v; want %s", tt.filter, got, err, tt.want)
+		}
+	}
+}
+
+func TestEscapeFilterValue(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"bob", "bob"},
+		{"*", `\2a`},
+		{"a*b(c)", `a\2ab\28c\29`},
+		{`back\slash`, `back\5cslash`},
+		{"nul\x00", `nul\00`},
+		{"ünïcode", "ünïcode"},
+	}
+	for _, tt := range tests {
+		if got := escapeFilterValue(tt.in); got != tt.want {
+			t.Errorf("escapeFilterValue(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+
+	// An escaped value is one equality match, however it tries to break out.
+	hostile := "*)(uid=*))(|(uid=*"
+	got, err := encodeFilter(fmt.Sprintf("(uid=%s)", escapeFilterValue(hostile)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := berSeq(filterEquality, berString(berOctetString, "uid"), berString(berOctetString, hostile))
+	if !bytes.Equal(got, want) {
+		t.Errorf("escaped filter = % x, want % x", got, want)
+	}
+}
+
+func TestEscapeDNValue(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"bob", "bob"},
+		{"Smith, John", `Smith\, John`},
+		{`a+b"c\d<e>f;g=h`, `a\+b\"c\\d\<e\>f\;g\=h`},
+		{" lead", `\ lead`},
+		{"trail ", `trail\ `},
+		{"#hash", `\#hash`},
+		{"mid#dle", "mid#dle"},
+		{"in ner", "in ner"},
+		{"nul\x00", `nul\00`},
+	}
+	for _, tt := range tests {
+		if got := escapeDNValue(tt.in); got != tt.want {
+			t.Errorf("escapeDNValue(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
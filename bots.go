@@ -0,0 +1,248 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// Bot accounts are users with is_bot set, owned by the person who created
+// them. They cannot log in with a password; instead they authenticate every
+// request with a long-lived token,
+//
+//	Authorization: Bot <token>
+//
+// which also works for /api/ws. Only a SHA-256 hash of the token is stored,
+// so a lost token has to be regenerated. Bots are held to their own rate
+// limits (config.BotRateLimit, config.BotMessageRateLimit).
+
+var botNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{2,32}$`)
+
+const maxBotDescription = 512
+
+func getUserByBotToken(db *sql.DB, token string) (*User, bool) {
+	return scanUser(db.QueryRow(`
+		SELECT u.id, u.username, u.role, u.avatar_url, u.is_bot, COALESCE(u.nickname, '')
+		FROM bots b JOIN users u ON b.user_id = u.id
+		WHERE b.token_hash = $1`, hashToken(token)))
+}
+
+const botSelect = `
+	SELECT u.id, u.username, COALESCE(u.avatar_url, ''), COALESCE(b.description, ''), b.owner_id, b.created_at
+	FROM bots b JOIN users u ON b.user_id = u.id`
+
+func scanBot(row rowScanner) (Bot, error) {
+	var b Bot
+	err := row.Scan(&b.ID, &b.Username, &b.AvatarURL, &b.Description, &b.OwnerID, &b.CreatedAt)
+	return b, err
+}
+
+// botForOwner loads a bot that user owns, or any bot for admins.
+func botForOwner(db *sql.DB, user *User, botID int64) (Bot, error) {
+	b, err := scanBot(db.QueryRow(botSelect+` WHERE b.user_id = $1`, botID))
+	if err == nil && b.OwnerID != user.ID && !isAdmin(user) {
+		return b, sql.ErrNoRows
+	}
+	return b, err
+}
+
+// --- Handlers ---
+
+// listBotsHandler lists the caller's bots; admins see every bot.
+func listBotsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := userFromContext(r.Context())
+		if user == nil {
+			http.Error(w, "User not found", http.StatusUnauthorized)
+			return
+		}
+		rows, err := db.Query(botSelect+` WHERE b.owner_id = $1 OR $2 ORDER BY u.username`, user.ID, isAdmin(user))
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+		bots := []Bot{}
+		for rows.Next() {
+			if b, err := scanBot(rows); err == nil {
+				bots = append(bots, b)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(bots)
+	}
+}
+
+// createBotHandler creates a bot owned by the caller and returns it with its
+// token. Bots cannot create bots.
+func createBotHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := userFromContext(r.Context())
+		if user == nil || user.Bot {
+			http.Error(w, "Only people can create bots", http.StatusForbidden)
+			return
+		}
+		var req struct {
+			Username    string `json:"username"`
+			Description string `json:"description"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if !botNamePattern.MatchString(req.Username) {
+			http.Error(w, "Bot names must be 2-32 letters, digits, '.', '_' or '-'", http.StatusBadRequest)
+			return
+		}
+		if !isAdmin(user) {
+			var owned int
+			db.QueryRow(`SELECT COUNT(*) FROM bots WHERE owner_id = $1`, user.ID).Scan(&owned)
+			if owned >= config.MaxBotsPerUser {
+				http.Error(w, "Bot limit reached", http.StatusForbidden)
+				return
+			}
+		}
+		token, err := generateToken()
+		if err != nil {
+			http.Error(w, "Failed to create bot", http.StatusInternalServerError)
+			return
+		}
+		// The password column is required but never checked for bots.
+		password, err := generateToken()
+		if err != nil {
+			http.Error(w, "Failed to create bot", http.StatusInternalServerError)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Failed to create bot", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+		var botID int64
+		err = tx.QueryRow(`
+			INSERT INTO users (username, password, role, is_bot) VALUES ($1, $2, $3, TRUE)
+			ON CONFLICT (username) DO NOTHING RETURNING id`, req.Username, password, string(RoleGuest)).Scan(&botID)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Username is already taken", http.StatusConflict)
+			return
+		} else if err != nil {
+			log.Printf("DB Error creating bot user: %v", err)
+			http.Error(w, "Failed to create bot", http.StatusInternalServerError)
+			return
+		}
+		_, err = tx.Exec(`INSERT INTO bots (user_id, owner_id, token_hash, description) VALUES ($1, $2, $3, NULLIF($4, ''))`,
+			botID, user.ID, hashToken(token), truncateRunes(req.Description, maxBotDescription))
+		if err != nil {
+			log.Printf("DB Error creating bot: %v", err)
+			http.Error(w, "Failed to create bot", http.StatusInternalServerError)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Failed to create bot", http.StatusInternalServerError)
+			return
+		}
+
+		bot, err := scanBot(db.QueryRow(botSelect+` WHERE b.user_id = $1`, botID))
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		bot.Token = token
+		log.Printf("User %d created bot %s", user.ID, bot.Username)
+		queueEvent(db, eventMemberJoined, User{ID: bot.ID, Username: bot.Username, Role: RoleGuest, Bot: true})
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(bot)
+	}
+}
+
+// regenerateBotTokenHandler replaces a bot's token. The old token stops
+// working immediately.
+func regenerateBotTokenHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := userFromContext(r.Context())
+		if user == nil {
+			http.Error(w, "User not found", http.StatusUnauthorized)
+			return
+		}
+		botID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid bot ID", http.StatusBadRequest)
+			return
+		}
+		bot, err := botForOwner(db, user, botID)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Bot not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		token, err := generateToken()
+		if err != nil {
+			http.Error(w, "Failed to regenerate token", http.StatusInternalServerError)
+			return
+		}
+		if _, err := db.Exec(`UPDATE bots SET token_hash = $1 WHERE user_id = $2`, hashToken(token), botID); err != nil {
+			http.Error(w, "Failed to regenerate token", http.StatusInternalServerError)
+			return
+		}
+		bot.Token = token
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(bot)
+	}
+}
+
+// deleteBotHandler revokes a bot. The user row is kept, without a token, so
+// the bot's messages keep their author.
+func deleteBotHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := userFromContext(r.Context())
+		if user == nil {
+			http.Error(w, "User not found", http.StatusUnauthorized)
+			return
+		}
+		botID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid bot ID", http.StatusBadRequest)
+			return
+		}
+		if _, err := botForOwner(db, user, botID); err == sql.ErrNoRows {
+			http.Error(w, "Bot not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if _, err := db.Exec(`DELETE FROM bots WHERE user_id = $1`, botID); err != nil {
+			http.Error(w, "Failed to delete bot", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// botMessageLimiter enforces config.BotMessageRateLimit on messages posted by
+// bots. It returns false after answering the request when the bot is over
+// its limit.
+func botMessageLimiter() func(w http.ResponseWriter, user *User) bool {
+	limiter := newRateLimiter(config.BotMessageRateLimit)
+	return func(w http.ResponseWriter, user *User) bool {
+		if !user.Bot {
+			return true
+		}
+		if ok, retryAfter := limiter.allow(user.ID); !ok {
+			writeRateLimited(w, retryAfter)
+			return false
+		}
+		return true
+	}
+}
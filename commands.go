@@ -0,0 +1,832 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// Slash commands. A message whose content starts with "/name" is run as a
+// command instead of being posted; "//" at the start posts a literal slash.
+// Commands are either built in (see builtinCommands) or registered by a bot
+// or for an outgoing webhook, in which case the invocation is sent to them
+// as a command_invoked WebSocket event or a command.invoked delivery, and
+// they answer by posting messages of their own.
+//
+// Each command declares typed options, parsed in order from the rest of the
+// line. Clients get the full list with GET /api/commands and suggestions
+// for option values from GET /api/commands/autocomplete.
+
+const (
+	optString   = "string"   // a single word
+	optText     = "text"     // the rest of the line; must be the last option
+	optInteger  = "integer"  // a whole number
+	optDuration = "duration" // 90s, 10m, 2h30m, 3d
+	optUser     = "user"     // @username
+	optChannel  = "channel"  // #channel-name
+)
+
+var commandOptionTypes = []string{optString, optText, optInteger, optDuration, optUser, optChannel}
+
+const (
+	commandSourceBuiltin = "builtin"
+	commandSourceBot     = "bot"
+	commandSourceWebhook = "webhook"
+
+	eventCommandInvoked = "command.invoked"
+
+	maxCommandOptions  = 10
+	maxTopicLength     = 1024
+	maxNicknameLength  = 32
+	maxReminderDelay   = 365 * 24 * time.Hour
+	defaultMuteLength  = time.Hour
+	autocompleteLimit  = 25
+	reminderPollPeriod = 5 * time.Second
+)
+
+var (
+	commandNamePattern    = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+	commandLinePattern    = regexp.MustCompile(`^/([a-z0-9_-]{1,32})(?:\s+|$)`)
+	commandDurationSuffix = regexp.MustCompile(`^(\d+)d(.*)$`)
+	nicknamePattern       = regexp.MustCompile(`^[\p{L}\p{M}\p{N}_.'-]+(?: [\p{L}\p{M}\p{N}_.'-]+)*$`)
+)
+
+// CommandOption describes one argument of a slash command.
+type CommandOption struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description,omitempty"`
+	Type        string   `json:"type"`
+	Required    bool     `json:"required,omitempty"`
+	Choices     []string `json:"choices,omitempty"`
+	// Autocomplete means clients can ask /api/commands/autocomplete for
+	// suggestions. It is set for user and channel options and for options
+	// with choices.
+	Autocomplete bool `json:"autocomplete,omitempty"`
+}
+
+// SlashCommand is a command as served to clients.
+type SlashCommand struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	Options     []CommandOption `json:"options"`
+	Source      string          `json:"source"`
+	AdminOnly   bool            `json:"admin_only,omitempty"`
+	BotID       int64           `json:"bot_id,omitempty"`
+	WebhookID   int64           `json:"webhook_id,omitempty"`
+}
+
+// commandArg is a parsed option value. Value is a string, an int64, the
+// number of seconds for durations, a *User or a channel ID.
+type commandArg struct {
+	Raw   string      `json:"raw"`
+	Value interface{} `json:"value"`
+}
+
+type commandArgs map[string]commandArg
+
+func (a commandArgs) text(name string) string {
+	s, _ := a[name].Value.(string)
+	return s
+}
+
+// commandContext is what a built-in command runs with.
+type commandContext struct {
+	db        *sql.DB
+	hub       *Hub
+	user      *User
+	channelID int64
+}
+
+// commandResult is the outcome of a command. Post is posted to the channel
+// as the invoking user; Reply is shown only to them.
+type commandResult struct {
+	Post  string
+	Reply string
+}
+
+type builtinCommand struct {
+	SlashCommand
+	run func(c *commandContext, args commandArgs) (commandResult, error)
+}
+
+// commandInvocation is sent to bots and webhooks that own a command.
+type commandInvocation struct {
+	Command   string                 `json:"command"`
+	Args      map[string]interface{} `json:"args"`
+	Raw       string                 `json:"raw"`
+	User      User                   `json:"user"`
+	ChannelID int64                  `json:"channel_id"`
+	InvokedAt time.Time              `json:"invoked_at"`
+}
+
+var builtinCommands = []builtinCommand{
+	{
+		SlashCommand: SlashCommand{Name: "me", Description: "Describe an action",
+			Options: []CommandOption{{Name: "action", Type: optText, Required: true}}},
+		run: func(c *commandContext, args commandArgs) (commandResult, error) {
+			return commandResult{Post: "_" + args.text("action") + "_"}, nil
+		},
+	},
+	{
+		SlashCommand: SlashCommand{Name: "shrug", Description: `Append ¯\_(ツ)_/¯ to your message`,
+			Options: []CommandOption{{Name: "message", Type: optText}}},
+		run: func(c *commandContext, args commandArgs) (commandResult, error) {
+			return commandResult{Post: strings.TrimSpace(args.text("message") + ` ¯\\\_(ツ)\_/¯`)}, nil
+		},
+	},
+	{
+		SlashCommand: SlashCommand{Name: "topic", Description: "Show or set the channel topic",
+			Options: []CommandOption{{Name: "topic", Type: optText}}},
+		run: runTopicCommand,
+	},
+	{
+		SlashCommand: SlashCommand{Name: "nick", Description: "Set your display name, or clear it",
+			Options: []CommandOption{{Name: "nickname", Type: optText}}},
+		run: runNickCommand,
+	},
+	{
+		SlashCommand: SlashCommand{Name: "remind", Description: "Remind yourself of something later",
+			Options: []CommandOption{
+				{Name: "in", Description: "e.g. 30m, 2h, 1d", Type: optDuration, Required: true},
+				{Name: "message", Type: optText, Required: true},
+			}},
+		run: runRemindCommand,
+	},
+	{
+		SlashCommand: SlashCommand{Name: "mute", Description: "Stop a user from posting for a while; 0 lifts a mute", AdminOnly: true,
+			Options: []CommandOption{
+				{Name: "user", Type: optUser, Required: true, Autocomplete: true},
+				{Name: "duration", Description: "defaults to 1h", Type: optDuration},
+				{Name: "reason", Type: optText},
+			}},
+		run: runMuteCommand,
+	},
+}
+
+func findBuiltinCommand(name string) *builtinCommand {
+	for i := range builtinCommands {
+		if builtinCommands[i].Name == name {
+			return &builtinCommands[i]
+		}
+	}
+	return nil
+}
+
+// parseCommandLine splits "/name rest". Content that does not look like a
+// command, such as a path, is not one.
+func parseCommandLine(content string) (name, rest string, ok bool) {
+	m := commandLinePattern.FindStringSubmatch(content)
+	if m == nil {
+		return "", "", false
+	}
+	return m[1], content[len(m[0]):], true
+}
+
+// parseCommandDuration accepts Go durations plus a leading whole number of
+// days, as in "1d" or "2d12h".
+func parseCommandDuration(s string) (time.Duration, error) {
+	var days time.Duration
+	if m := commandDurationSuffix.FindStringSubmatch(s); m != nil {
+		n, _ := strconv.Atoi(m[1])
+		days = time.Duration(n) * 24 * time.Hour
+		if s = m[2]; s == "" {
+			return days, nil
+		}
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return days + d, nil
+}
+
+// parseCommandArgs parses rest according to options. An optional option
+// whose word does not parse is skipped so the word can fill the next one,
+// which lets "/mute @bob spamming" leave out the duration.
+func parseCommandArgs(db *sql.DB, options []CommandOption, rest string) (commandArgs, error) {
+	args := commandArgs{}
+	for i, opt := range options {
+		rest = strings.TrimSpace(rest)
+		if rest == "" {
+			if opt.Required {
+				return nil, &httpError{http.StatusBadRequest, fmt.Sprintf("Missing argument: %s", opt.Name)}
+			}
+			continue
+		}
+		word, remainder := rest, ""
+		if opt.Type != optText {
+			if j := strings.IndexFunc(rest, isSpace); j >= 0 {
+				word, remainder = rest[:j], rest[j:]
+			}
+		}
+		value, err := parseCommandValue(db, opt, word)
+		if err != nil {
+			if !opt.Required && i < len(options)-1 {
+				continue
+			}
+			return nil, &httpError{http.StatusBadRequest, fmt.Sprintf("Invalid %s: %v", opt.Name, err)}
+		}
+		args[opt.Name] = commandArg{Raw: word, Value: value}
+		rest = remainder
+	}
+	if strings.TrimSpace(rest) != "" {
+		return nil, &httpError{http.StatusBadRequest, "Too many arguments"}
+	}
+	return args, nil
+}
+
+func isSpace(r rune) bool {
+	return r == ' ' || r == '\t' || r == '\n'
+}
+
+func parseCommandValue(db *sql.DB, opt CommandOption, word string) (interface{}, error) {
+	switch opt.Type {
+	case optInteger:
+		return strconv.ParseInt(word, 10, 64)
+	case optDuration:
+		d, err := parseCommandDuration(word)
+		return int64(d / time.Second), err
+	case optUser:
+		user, ok := scanUser(db.QueryRow(`
+			SELECT id, username, role, avatar_url, is_bot, COALESCE(nickname, '') FROM users WHERE username = $1`,
+			strings.TrimPrefix(word, "@")))
+		if !ok {
+			return nil, fmt.Errorf("no user %s", word)
+		}
+		return user, nil
+	case optChannel:
+		var id int64
+		err := db.QueryRow(`SELECT id FROM channels WHERE name = $1 ORDER BY id LIMIT 1`, strings.TrimPrefix(word, "#")).Scan(&id)
+		if err != nil {
+			return nil, fmt.Errorf("no channel %s", word)
+		}
+		return id, nil
+	}
+	if len(opt.Choices) > 0 {
+		for _, c := range opt.Choices {
+			if strings.EqualFold(c, word) {
+				return c, nil
+			}
+		}
+		return nil, fmt.Errorf("expected one of %s", strings.Join(opt.Choices, ", "))
+	}
+	return word, nil
+}
+
+// runCommand runs a command line for user in channelID.
+func runCommand(db *sql.DB, hub *Hub, user *User, channelID int64, name, rest string) (commandResult, error) {
+	var exists bool
+	if err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM channels WHERE id = $1)`, channelID).Scan(&exists); err != nil {
+		return commandResult{}, err
+	}
+	if !exists {
+		return commandResult{}, &httpError{http.StatusBadRequest, "Unknown channel"}
+	}
+	if builtin := findBuiltinCommand(name); builtin != nil {
+		if builtin.AdminOnly && !isAdmin(user) {
+			return commandResult{}, &httpError{http.StatusForbidden, "Admin access required"}
+		}
+		args, err := parseCommandArgs(db, builtin.Options, rest)
+		if err != nil {
+			return commandResult{}, err
+		}
+		return builtin.run(&commandContext{db: db, hub: hub, user: user, channelID: channelID}, args)
+	}
+
+	cmd, err := scanSlashCommand(db.QueryRow(slashCommandSelect+` WHERE name = $1`, name))
+	if err == sql.ErrNoRows {
+		return commandResult{}, &httpError{http.StatusBadRequest, fmt.Sprintf("Unknown command /%s; start with // to post it as text", name)}
+	} else if err != nil {
+		return commandResult{}, err
+	}
+	args, err := parseCommandArgs(db, cmd.Options, rest)
+	if err != nil {
+		return commandResult{}, err
+	}
+	inv := commandInvocation{
+		Command:   cmd.Name,
+		Args:      make(map[string]interface{}, len(args)),
+		Raw:       strings.TrimSpace(rest),
+		User:      *user,
+		ChannelID: channelID,
+		InvokedAt: time.Now(),
+	}
+	for k, v := range args {
+		inv.Args[k] = v.Value
+	}
+	if cmd.BotID != 0 {
+		if !sendToUser(hub, cmd.BotID, "command_invoked", inv) {
+			return commandResult{}, &httpError{http.StatusServiceUnavailable, fmt.Sprintf("/%s is unavailable right now: its bot is offline", cmd.Name)}
+		}
+		return commandResult{Reply: fmt.Sprintf("Sent /%s to its bot", cmd.Name)}, nil
+	}
+	ok, err := queueDelivery(db, cmd.WebhookID, eventCommandInvoked, inv)
+	if err != nil {
+		return commandResult{}, err
+	}
+	if !ok {
+		return commandResult{}, &httpError{http.StatusServiceUnavailable, fmt.Sprintf("/%s is unavailable right now", cmd.Name)}
+	}
+	return commandResult{Reply: fmt.Sprintf("Sent /%s", cmd.Name)}, nil
+}
+
+// --- Built-in commands ---
+
+func runTopicCommand(c *commandContext, args commandArgs) (commandResult, error) {
+	topic := truncateRunes(args.text("topic"), maxTopicLength)
+	var channel Channel
+	var err error
+	if topic == "" {
+		err = c.db.QueryRow(`SELECT id, name, category_id, position, COALESCE(topic, '') FROM channels WHERE id = $1`,
+			c.channelID).Scan(&channel.ID, &channel.Name, &channel.CategoryID, &channel.Position, &channel.Topic)
+	} else {
+		err = c.db.QueryRow(`UPDATE channels SET topic = $1 WHERE id = $2 RETURNING id, name, category_id, position, topic`,
+			topic, c.channelID).Scan(&channel.ID, &channel.Name, &channel.CategoryID, &channel.Position, &channel.Topic)
+	}
+	if err == sql.ErrNoRows {
+		return commandResult{}, &httpError{http.StatusNotFound, "Channel not found"}
+	} else if err != nil {
+		return commandResult{}, err
+	}
+	if topic == "" {
+		if channel.Topic == "" {
+			return commandResult{Reply: "This channel has no topic"}, nil
+		}
+		return commandResult{Reply: "Topic: " + channel.Topic}, nil
+	}
+	broadcastEvent(c.hub, "channel_updated", channel)
+	queueEvent(c.db, eventChannelUpdated, channel)
+	return commandResult{Reply: "Topic updated"}, nil
+}
+
+// runNickCommand sets a nickname. Nicknames are words of letters, digits
+// and a little punctuation, and may not pass for anyone else's username or
+// nickname.
+func runNickCommand(c *commandContext, args commandArgs) (commandResult, error) {
+	nickname := strings.TrimSpace(args.text("nickname"))
+	if len([]rune(nickname)) > maxNicknameLength {
+		return commandResult{}, &httpError{http.StatusBadRequest, fmt.Sprintf("Nicknames are at most %d characters", maxNicknameLength)}
+	}
+	if nickname != "" && !nicknamePattern.MatchString(nickname) {
+		return commandResult{}, &httpError{http.StatusBadRequest, "Nicknames may only contain letters, digits, single spaces and _ . ' -"}
+	}
+	if nickname != "" {
+		var taken bool
+		err := c.db.QueryRow(`
+			SELECT EXISTS (SELECT 1 FROM users WHERE id <> $2 AND (LOWER(username) = LOWER($1) OR LOWER(nickname) = LOWER($1)))`,
+			nickname, c.user.ID).Scan(&taken)
+		if err != nil {
+			return commandResult{}, err
+		}
+		if taken {
+			return commandResult{}, &httpError{http.StatusConflict, "That name is already in use"}
+		}
+	}
+	if _, err := c.db.Exec(`UPDATE users SET nickname = NULLIF($1, '') WHERE id = $2`, nickname, c.user.ID); err != nil {
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+			return commandResult{}, &httpError{http.StatusConflict, "That name is already in use"}
+		}
+		return commandResult{}, err
+	}
+	updated := *c.user
+	updated.Nickname = nickname
+	broadcastEvent(c.hub, "user_updated", updated)
+	if nickname == "" {
+		return commandResult{Reply: "Nickname cleared"}, nil
+	}
+	return commandResult{Reply: "You are now known as " + nickname}, nil
+}
+
+func runRemindCommand(c *commandContext, args commandArgs) (commandResult, error) {
+	delay := time.Duration(args["in"].Value.(int64)) * time.Second
+	if delay <= 0 || delay > maxReminderDelay {
+		return commandResult{}, &httpError{http.StatusBadRequest, "Reminders can be set up to a year ahead"}
+	}
+	_, err := c.db.Exec(`INSERT INTO reminders (user_id, channel_id, content, remind_at) VALUES ($1, $2, $3, $4)`,
+		c.user.ID, c.channelID, args.text("message"), time.Now().Add(delay))
+	if err != nil {
+		return commandResult{}, err
+	}
+	return commandResult{Reply: fmt.Sprintf("I'll remind you in %s", args["in"].Raw)}, nil
+}
+
+func runMuteCommand(c *commandContext, args commandArgs) (commandResult, error) {
+	target := args["user"].Value.(*User)
+	if isAdmin(target) {
+		return commandResult{}, &httpError{http.StatusBadRequest, "Admins cannot be muted"}
+	}
+	length := defaultMuteLength
+	if arg, ok := args["duration"]; ok {
+		length = time.Duration(arg.Value.(int64)) * time.Second
+	}
+	if length == 0 {
+		if _, err := c.db.Exec(`UPDATE users SET muted_until = NULL WHERE id = $1`, target.ID); err != nil {
+			return commandResult{}, err
+		}
+		log.Printf("User %d unmuted %s", c.user.ID, target.Username)
+		return commandResult{Reply: target.Username + " can post again"}, nil
+	}
+	until := time.Now().Add(length)
+	if _, err := c.db.Exec(`UPDATE users SET muted_until = $1 WHERE id = $2`, until, target.ID); err != nil {
+		return commandResult{}, err
+	}
+	log.Printf("User %d muted %s until %s: %s", c.user.ID, target.Username, until.Format(time.RFC3339), args.text("reason"))
+	return commandResult{Reply: fmt.Sprintf("%s is muted for %s", target.Username, length)}, nil
+}
+
+// checkMuted returns an error if the user is muted.
+func checkMuted(db *sql.DB, userID int64) error {
+	var until sql.NullTime
+	db.QueryRow(`SELECT muted_until FROM users WHERE id = $1`, userID).Scan(&until)
+	if until.Valid && until.Time.After(time.Now()) {
+		return &httpError{http.StatusForbidden, "You are muted until " + until.Time.UTC().Format(time.RFC3339)}
+	}
+	return nil
+}
+
+// Reminder is a pending /remind.
+type Reminder struct {
+	ID        int64     `json:"id"`
+	ChannelID int64     `json:"channel_id,omitempty"`
+	Content   string    `json:"content"`
+	RemindAt  time.Time `json:"remind_at"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// runReminders sends due reminders to their users as reminder events. A
+// reminder stays queued until one of its user's connections takes it, so
+// people who are offline when it falls due get it when they come back.
+func runReminders(db *sql.DB, hub *Hub) {
+	ticker := time.NewTicker(reminderPollPeriod)
+	defer ticker.Stop()
+	for range ticker.C {
+		if online := hub.onlineUserIDs(); len(online) > 0 {
+			deliverReminders(db, hub, online)
+		}
+	}
+}
+
+func deliverReminders(db *sql.DB, hub *Hub, userIDs []int64) {
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Failed to load due reminders: %v", err)
+		return
+	}
+	defer tx.Rollback()
+	rows, err := tx.Query(`
+		SELECT id, user_id, COALESCE(channel_id, 0), content, remind_at, created_at FROM reminders
+		WHERE remind_at <= NOW() AND user_id = ANY($1)
+		ORDER BY remind_at LIMIT 100 FOR UPDATE SKIP LOCKED`, pq.Array(userIDs))
+	if err != nil {
+		log.Printf("Failed to load due reminders: %v", err)
+		return
+	}
+	var due []Reminder
+	var owners []int64
+	for rows.Next() {
+		var rem Reminder
+		var userID int64
+		if err := rows.Scan(&rem.ID, &userID, &rem.ChannelID, &rem.Content, &rem.RemindAt, &rem.CreatedAt); err == nil {
+			due, owners = append(due, rem), append(owners, userID)
+		}
+	}
+	rows.Close()
+	var sent []int64
+	for i, rem := range due {
+		if sendToUser(hub, owners[i], "reminder", rem) {
+			sent = append(sent, rem.ID)
+		}
+	}
+	if len(sent) == 0 {
+		return
+	}
+	if _, err := tx.Exec(`DELETE FROM reminders WHERE id = ANY($1)`, pq.Array(sent)); err != nil {
+		log.Printf("Failed to clear sent reminders: %v", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Failed to clear sent reminders: %v", err)
+	}
+}
+
+// --- Registered commands ---
+
+const slashCommandSelect = `
+	SELECT name, description, options, COALESCE(bot_id, 0), COALESCE(webhook_id, 0) FROM slash_commands`
+
+func scanSlashCommand(row rowScanner) (SlashCommand, error) {
+	var cmd SlashCommand
+	var options []byte
+	if err := row.Scan(&cmd.Name, &cmd.Description, &options, &cmd.BotID, &cmd.WebhookID); err != nil {
+		return cmd, err
+	}
+	cmd.Source = commandSourceWebhook
+	if cmd.BotID != 0 {
+		cmd.Source = commandSourceBot
+	}
+	err := json.Unmarshal(options, &cmd.Options)
+	return cmd, err
+}
+
+// listSlashCommands returns built-in and registered commands by name.
+func listSlashCommands(db *sql.DB) ([]SlashCommand, error) {
+	commands := []SlashCommand{}
+	for _, b := range builtinCommands {
+		cmd := b.SlashCommand
+		cmd.Source = commandSourceBuiltin
+		commands = append(commands, cmd)
+	}
+	rows, err := db.Query(slashCommandSelect)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if cmd, err := scanSlashCommand(rows); err == nil {
+			commands = append(commands, cmd)
+		}
+	}
+	sort.Slice(commands, func(i, j int) bool { return commands[i].Name < commands[j].Name })
+	return commands, rows.Err()
+}
+
+func broadcastCommandsUpdate(db *sql.DB, hub *Hub) {
+	commands, err := listSlashCommands(db)
+	if err != nil {
+		log.Printf("Failed to load commands for broadcast: %v", err)
+		return
+	}
+	broadcastEvent(hub, "commands_update", commands)
+}
+
+// validateCommandOptions checks a registration and fills in Autocomplete.
+func validateCommandOptions(options []CommandOption) error {
+	if len(options) > maxCommandOptions {
+		return &httpError{http.StatusBadRequest, fmt.Sprintf("At most %d options", maxCommandOptions)}
+	}
+	seen := map[string]bool{}
+	for i := range options {
+		opt := &options[i]
+		if !commandNamePattern.MatchString(opt.Name) || seen[opt.Name] {
+			return &httpError{http.StatusBadRequest, fmt.Sprintf("Invalid or duplicate option name %q", opt.Name)}
+		}
+		seen[opt.Name] = true
+		if !containsString(commandOptionTypes, opt.Type) {
+			return &httpError{http.StatusBadRequest, fmt.Sprintf("Unknown option type %q", opt.Type)}
+		}
+		if opt.Type == optText && i != len(options)-1 {
+			return &httpError{http.StatusBadRequest, "A text option must come last"}
+		}
+		if len(opt.Choices) > 0 && opt.Type != optString {
+			return &httpError{http.StatusBadRequest, "Only string options can have choices"}
+		}
+		opt.Description = truncateRunes(opt.Description, 100)
+		opt.Autocomplete = opt.Type == optUser || opt.Type == optChannel || len(opt.Choices) > 0
+	}
+	return nil
+}
+
+// --- Handlers ---
+
+func listCommandsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		commands, err := listSlashCommands(db)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(commands)
+	}
+}
+
+// registerCommandHandler registers or replaces a command. Bots register
+// commands for themselves; admins register commands for an outgoing webhook
+// by passing webhook_id.
+func registerCommandHandler(db *sql.DB, hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := userFromContext(r.Context())
+		if user == nil {
+			http.Error(w, "User not found", http.StatusUnauthorized)
+			return
+		}
+		var req struct {
+			Name        string          `json:"name"`
+			Description string          `json:"description"`
+			Options     []CommandOption `json:"options"`
+			WebhookID   int64           `json:"webhook_id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		var botID, webhookID sql.NullInt64
+		switch {
+		case user.Bot:
+			botID = sql.NullInt64{Int64: user.ID, Valid: true}
+		case isAdmin(user) && req.WebhookID != 0:
+			webhookID = sql.NullInt64{Int64: req.WebhookID, Valid: true}
+		default:
+			http.Error(w, "Commands are registered by bots, or by admins for an outgoing webhook", http.StatusForbidden)
+			return
+		}
+		req.Name = strings.ToLower(req.Name)
+		if !commandNamePattern.MatchString(req.Name) {
+			http.Error(w, "Command names must be 1-32 lowercase letters, digits, '_' or '-'", http.StatusBadRequest)
+			return
+		}
+		if findBuiltinCommand(req.Name) != nil {
+			http.Error(w, "That command is built in", http.StatusConflict)
+			return
+		}
+		if req.Options == nil {
+			req.Options = []CommandOption{}
+		}
+		if err := validateCommandOptions(req.Options); err != nil {
+			writeError(w, err, "Failed to register command")
+			return
+		}
+		options, _ := json.Marshal(req.Options)
+
+		// Re-registering replaces a command only for the same owner.
+		cmd, err := scanSlashCommand(db.QueryRow(`
+			INSERT INTO slash_commands (name, description, options, bot_id, webhook_id, created_by)
+			VALUES ($1, $2, $3, $4, $5, $6)
+			ON CONFLICT (name) DO UPDATE SET description = EXCLUDED.description, options = EXCLUDED.options
+			WHERE slash_commands.bot_id IS NOT DISTINCT FROM EXCLUDED.bot_id
+			  AND slash_commands.webhook_id IS NOT DISTINCT FROM EXCLUDED.webhook_id
+			RETURNING name, description, options, COALESCE(bot_id, 0), COALESCE(webhook_id, 0)`,
+			req.Name, truncateRunes(req.Description, 100), options, botID, webhookID, user.ID))
+		if err == sql.ErrNoRows {
+			http.Error(w, "Another bot or webhook owns that command", http.StatusConflict)
+			return
+		} else if err != nil {
+			if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23503" {
+				http.Error(w, "Webhook not found", http.StatusBadRequest)
+				return
+			}
+			log.Printf("DB Error registering command: %v", err)
+			http.Error(w, "Failed to register command", http.StatusInternalServerError)
+			return
+		}
+		broadcastCommandsUpdate(db, hub)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(cmd)
+	}
+}
+
+// deleteCommandHandler removes a registered command. Allowed for the bot
+// that owns it, that bot's owner and admins.
+func deleteCommandHandler(db *sql.DB, hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := userFromContext(r.Context())
+		if user == nil {
+			http.Error(w, "User not found", http.StatusUnauthorized)
+			return
+		}
+		res, err := db.Exec(`
+			DELETE FROM slash_commands c WHERE c.name = $1 AND ($2 OR c.bot_id = $3
+				OR EXISTS (SELECT 1 FROM bots b WHERE b.user_id = c.bot_id AND b.owner_id = $3))`,
+			mux.Vars(r)["name"], isAdmin(user), user.ID)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "Command not found", http.StatusNotFound)
+			return
+		}
+		broadcastCommandsUpdate(db, hub)
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// commandAutocompleteHandler suggests values for one option of a command.
+// Query parameters: command, option and the partial value in query.
+func commandAutocompleteHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		var options []CommandOption
+		if builtin := findBuiltinCommand(q.Get("command")); builtin != nil {
+			options = builtin.Options
+		} else if cmd, err := scanSlashCommand(db.QueryRow(slashCommandSelect+` WHERE name = $1`, q.Get("command"))); err == nil {
+			options = cmd.Options
+		} else {
+			http.Error(w, "Command not found", http.StatusNotFound)
+			return
+		}
+		var opt *CommandOption
+		for i := range options {
+			if options[i].Name == q.Get("option") {
+				opt = &options[i]
+			}
+		}
+		if opt == nil {
+			http.Error(w, "Option not found", http.StatusNotFound)
+			return
+		}
+
+		query := strings.TrimLeft(q.Get("query"), "@#")
+		suggestions := []string{}
+		var rows *sql.Rows
+		var err error
+		switch {
+		case len(opt.Choices) > 0:
+			for _, c := range opt.Choices {
+				if strings.HasPrefix(strings.ToLower(c), strings.ToLower(query)) {
+					suggestions = append(suggestions, c)
+				}
+			}
+		case opt.Type == optUser:
+			rows, err = db.Query(`SELECT username FROM users WHERE username ILIKE $1 || '%' ORDER BY username LIMIT $2`,
+				likeEscape(query), autocompleteLimit)
+		case opt.Type == optChannel:
+			rows, err = db.Query(`SELECT DISTINCT name FROM channels WHERE name ILIKE $1 || '%' ORDER BY name LIMIT $2`,
+				likeEscape(query), autocompleteLimit)
+		}
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if rows != nil {
+			defer rows.Close()
+			for rows.Next() {
+				var s string
+				if rows.Scan(&s) == nil {
+					suggestions = append(suggestions, s)
+				}
+			}
+		}
+		if len(suggestions) > autocompleteLimit {
+			suggestions = suggestions[:autocompleteLimit]
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(suggestions)
+	}
+}
+
+func likeEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+func listRemindersHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := userFromContext(r.Context())
+		if user == nil {
+			http.Error(w, "User not found", http.StatusUnauthorized)
+			return
+		}
+		rows, err := db.Query(`
+			SELECT id, COALESCE(channel_id, 0), content, remind_at, created_at FROM reminders
+			WHERE user_id = $1 ORDER BY remind_at`, user.ID)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+		reminders := []Reminder{}
+		for rows.Next() {
+			var rem Reminder
+			if err := rows.Scan(&rem.ID, &rem.ChannelID, &rem.Content, &rem.RemindAt, &rem.CreatedAt); err == nil {
+				reminders = append(reminders, rem)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(reminders)
+	}
+}
+
+func deleteReminderHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := userFromContext(r.Context())
+		if user == nil {
+			http.Error(w, "User not found", http.StatusUnauthorized)
+			return
+		}
+		id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid reminder ID", http.StatusBadRequest)
+			return
+		}
+		res, err := db.Exec(`DELETE FROM reminders WHERE id = $1 AND user_id = $2`, id, user.ID)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "Reminder not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"crypto/rand"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds server settings that can be overridden through PRISMA_*
+// environment variables. It is loaded once at startup.
+type Config struct {
+	// Upload type policy. Empty allow lists accept anything not denied.
+	UploadAllowedTypes      []string
+	UploadDeniedTypes       []string
+	UploadAllowedExtensions []string
+	UploadDeniedExtensions  []string
+
+	// SigningKey authenticates server-generated URLs such as signed downloads.
+	SigningKey   []byte
+	SignedURLTTL time.Duration
+
+	// StorageBackend is "fs" (files under UploadDir) or "s3".
+	StorageBackend string
+	UploadDir      string
+	S3             S3Config
+	// S3RedirectDownloads sends authorized downloads straight to a presigned
+	// bucket URL instead of proxying the bytes through this server.
+	S3RedirectDownloads bool
+
+	// Resumable uploads that see no activity for ResumableUploadExpiry are
+	// garbage-collected along with their stored chunks.
+	MaxResumableUploadSize int64
+	ResumableUploadExpiry  time.Duration
+
+	// Storage quotas in bytes; 0 means unlimited. RoleQuotas applies unless
+	// the user has a personal quota, and roles not listed use DefaultQuota.
+	RoleQuotas         map[Role]int64
+	DefaultQuota       int64
+	GlobalStorageLimit int64
+
+	// Garbage collection of unattached uploads and unreferenced blobs. An
+	// interval of 0 disables the scheduled job; GCDryRun makes it report only.
+	GCInterval    time.Duration
+	GCUploadGrace time.Duration
+	GCBlobGrace   time.Duration
+	GCDryRun      bool
+
+	// ImageMetadata is "strip", "reencode" or "keep"; see metadata.go.
+	ImageMetadata string
+
+	// Scanner is "none" or "clamd". ClamdAddress is host:port or
+	// unix:/path/to/socket; ScanTimeout bounds a single scan.
+	Scanner      string
+	ClamdAddress string
+	ScanTimeout  time.Duration
+
+	// Link previews for URLs in messages. Fetches are limited to
+	// UnfurlMaxBytes and UnfurlTimeout; results are cached for UnfurlCacheTTL.
+	UnfurlLinks    bool
+	UnfurlTimeout  time.Duration
+	UnfurlMaxBytes int64
+	UnfurlCacheTTL time.Duration
+
+	// ImageProxy serves external images in embeds through /api/proxy.
+	ImageProxy    bool
+	ProxyTimeout  time.Duration
+	ProxyMaxBytes int64
+	ProxyCacheTTL time.Duration
+
+	// EmojiMaxBytes caps the size of an image registered as custom emoji.
+	EmojiMaxBytes int64
+
+	// WebhookRateLimit caps how often each incoming webhook may post,
+	// written "<count>/<duration>"; a count of 0 disables the limit.
+	WebhookRateLimit rateLimit
+
+	// Outgoing webhook delivery. Failed attempts are retried with exponential
+	// backoff from OutgoingBackoffBase up to OutgoingBackoffMax, at most
+	// OutgoingMaxAttempts times; a webhook is disabled after
+	// OutgoingDisableAfter consecutive failed attempts. Private and loopback
+	// targets are refused unless OutgoingAllowPrivate is set.
+	OutgoingTimeout      time.Duration
+	OutgoingMaxAttempts  int
+	OutgoingBackoffBase  time.Duration
+	OutgoingBackoffMax   time.Duration
+	OutgoingDisableAfter int
+	OutgoingPollInterval time.Duration
+	OutgoingLogRetention time.Duration
+	OutgoingAllowPrivate bool
+
+	// Bot accounts. BotRateLimit applies to every API request a bot makes,
+	// BotMessageRateLimit additionally to posting messages. Limits are
+	// written "<count>/<duration>"; a count of 0 disables the limit.
+	BotRateLimit        rateLimit
+	BotMessageRateLimit rateLimit
+	MaxBotsPerUser      int
+
+	// Personal access tokens. Tokens expire after TokenDefaultLifetime unless
+	// created with an earlier or later expiry, which may be at most
+	// TokenMaxLifetime away. Tokens with the admin scope are held to the
+	// shorter AdminTokenMaxLifetime.
+	TokenDefaultLifetime  time.Duration
+	TokenMaxLifetime      time.Duration
+	AdminTokenMaxLifetime time.Duration
+	MaxTokensPerUser      int
+
+	// Login throttling; see logins.go. Thresholds of 0 disable lockout.
+	// TrustProxyHeaders takes client addresses from X-Forwarded-For, which
+	// is only safe behind a reverse proxy that sets it.
+	LoginDelayAfter         int
+	LoginDelayBase          time.Duration
+	LoginDelayMax           time.Duration
+	LoginLockoutThreshold   int
+	LoginIPLockoutThreshold int
+	LoginLockoutDuration    time.Duration
+	LoginFailureWindow      time.Duration
+	TrustProxyHeaders       bool
+
+	// Two-factor authentication. MFAIssuer names the service in
+	// authenticator apps; RequireAdminMFA makes admins enroll before they
+	// can do anything else.
+	MFAIssuer       string
+	MFAChallengeTTL time.Duration
+	RequireAdminMFA bool
+
+	// OpenID Connect single sign-on, enabled when OIDCIssuer and
+	// OIDCClientID are set; see oidc.go. OIDCAdminGroups and
+	// OIDCAllowedGroups are matched case-insensitively against the
+	// OIDCGroupsClaim claim. PasswordLogin false turns off /api/login and
+	// /api/register, leaving single sign-on as the only way in.
+	OIDCIssuer         string
+	OIDCClientID       string
+	OIDCClientSecret   string
+	OIDCRedirectURL    string
+	OIDCPostLoginURL   string
+	OIDCScopes         []string
+	OIDCUsernameClaim  string
+	OIDCGroupsClaim    string
+	OIDCAdminGroups    []string
+	OIDCAllowedGroups  []string
+	OIDCLinkByUsername bool
+	OIDCTimeout        time.Duration
+	PasswordLogin      bool
+
+	// Password logins are checked by each of AuthBackends in turn ("local",
+	// "ldap"); see auth.go. With "ldap" in the list self-registration is
+	// off. The LDAP backend binds as
+	// fmt.Sprintf(LDAPUserDNTemplate, username) when that is set, and
+	// otherwise searches LDAPBaseDN for LDAPUserFilter as LDAPBindDN first;
+	// see ldap.go. Members of LDAPAdminGroups, listed in
+	// LDAPGroupAttribute, are made admins and everyone else guests.
+	AuthBackends           []string
+	LDAPURL                string
+	LDAPStartTLS           bool
+	LDAPInsecureSkipVerify bool
+	LDAPCAFile             string
+	LDAPUserDNTemplate     string
+	LDAPBindDN             string
+	LDAPBindPassword       string
+	LDAPBaseDN             string
+	LDAPUserFilter         string
+	LDAPUsernameAttribute  string
+	LDAPGroupAttribute     string
+	LDAPAdminGroups        []string
+	LDAPTimeout            time.Duration
+}
+
+var config = loadConfig()
+
+func loadConfig() Config {
+	return Config{
+		UploadAllowedTypes: envList("PRISMA_UPLOAD_ALLOWED_TYPES", nil),
+		UploadDeniedTypes: envList("PRISMA_UPLOAD_DENIED_TYPES", []string{
+			"application/x-msdownload",
+			"application/x-executable",
+			"application/x-mach-binary",
+		}),
+		UploadAllowedExtensions: envList("PRISMA_UPLOAD_ALLOWED_EXTENSIONS", nil),
+		UploadDeniedExtensions: envList("PRISMA_UPLOAD_DENIED_EXTENSIONS", []string{
+			".exe", ".dll", ".bat", ".cmd", ".com", ".scr", ".msi", ".ps1", ".vbs", ".jar",
+		}),
+		SigningKey:   envSigningKey("PRISMA_SIGNING_KEY"),
+		SignedURLTTL: envDuration("PRISMA_SIGNED_URL_TTL", 24*time.Hour),
+
+		StorageBackend: envString("PRISMA_STORAGE", "fs"),
+		UploadDir:      envString("PRISMA_UPLOAD_DIR", "uploads"),
+		S3: S3Config{
+			Endpoint:  envString("PRISMA_S3_ENDPOINT", ""),
+			Region:    envString("PRISMA_S3_REGION", "us-east-1"),
+			Bucket:    envString("PRISMA_S3_BUCKET", ""),
+			AccessKey: envString("PRISMA_S3_ACCESS_KEY", ""),
+			SecretKey: envString("PRISMA_S3_SECRET_KEY", ""),
+			PathStyle: envBool("PRISMA_S3_PATH_STYLE", true),
+		},
+		S3RedirectDownloads: envBool("PRISMA_S3_REDIRECT_DOWNLOADS", false),
+
+		MaxResumableUploadSize: envByteSize("PRISMA_MAX_RESUMABLE_UPLOAD_SIZE", 2<<30),
+		ResumableUploadExpiry:  envDuration("PRISMA_RESUMABLE_UPLOAD_EXPIRY", 24*time.Hour),
+
+		RoleQuotas:         envRoleSizes("PRISMA_ROLE_QUOTAS", map[Role]int64{RoleAdmin: 0, RoleGuest: 1 << 30}),
+		DefaultQuota:       envByteSize("PRISMA_DEFAULT_QUOTA", 1<<30),
+		GlobalStorageLimit: envByteSize("PRISMA_GLOBAL_STORAGE_LIMIT", 0),
+
+		GCInterval:    envDuration("PRISMA_GC_INTERVAL", 6*time.Hour),
+		GCUploadGrace: envDuration("PRISMA_GC_UPLOAD_GRACE", 7*24*time.Hour),
+		GCBlobGrace:   envDuration("PRISMA_GC_BLOB_GRACE", 24*time.Hour),
+		GCDryRun:      envBool("PRISMA_GC_DRY_RUN", false),
+
+		ImageMetadata: envChoice("PRISMA_IMAGE_METADATA", imageMetadataStrip, imageMetadataReencode, imageMetadataKeep),
+
+		Scanner:      envChoice("PRISMA_SCANNER", "none", "clamd"),
+		ClamdAddress: envString("PRISMA_CLAMD_ADDRESS", "127.0.0.1:3310"),
+		ScanTimeout:  envDuration("PRISMA_SCAN_TIMEOUT", 2*time.Minute),
+
+		UnfurlLinks:    envBool("PRISMA_UNFURL_LINKS", true),
+		UnfurlTimeout:  envDuration("PRISMA_UNFURL_TIMEOUT", 10*time.Second),
+		UnfurlMaxBytes: envByteSize("PRISMA_UNFURL_MAX_BYTES", 1<<20),
+		UnfurlCacheTTL: envDuration("PRISMA_UNFURL_CACHE_TTL", 24*time.Hour),
+
+		ImageProxy:    envBool("PRISMA_IMAGE_PROXY", true),
+		ProxyTimeout:  envDuration("PRISMA_PROXY_TIMEOUT", 15*time.Second),
+		ProxyMaxBytes: envByteSize("PRISMA_PROXY_MAX_BYTES", 10<<20),
+		ProxyCacheTTL: envDuration("PRISMA_PROXY_CACHE_TTL", 24*time.Hour),
+
+		EmojiMaxBytes: envByteSize("PRISMA_EMOJI_MAX_BYTES", 256<<10),
+
+		WebhookRateLimit: envRateLimit("PRISMA_WEBHOOK_RATE_LIMIT", rateLimit{Count: 30, Per: time.Minute}),
+
+		OutgoingTimeout:      envDuration("PRISMA_OUTGOING_TIMEOUT", 10*time.Second),
+		OutgoingMaxAttempts:  envInt("PRISMA_OUTGOING_MAX_ATTEMPTS", 8),
+		OutgoingBackoffBase:  envDuration("PRISMA_OUTGOING_BACKOFF_BASE", 30*time.Second),
+		OutgoingBackoffMax:   envDuration("PRISMA_OUTGOING_BACKOFF_MAX", time.Hour),
+		OutgoingDisableAfter: envInt("PRISMA_OUTGOING_DISABLE_AFTER", 20),
+		OutgoingPollInterval: envDuration("PRISMA_OUTGOING_POLL_INTERVAL", 2*time.Second),
+		OutgoingLogRetention: envDuration("PRISMA_OUTGOING_LOG_RETENTION", 7*24*time.Hour),
+		OutgoingAllowPrivate: envBool("PRISMA_OUTGOING_ALLOW_PRIVATE", false),
+
+		BotRateLimit:        envRateLimit("PRISMA_BOT_RATE_LIMIT", rateLimit{Count: 50, Per: 10 * time.Second}),
+		BotMessageRateLimit: envRateLimit("PRISMA_BOT_MESSAGE_RATE_LIMIT", rateLimit{Count: 5, Per: 5 * time.Second}),
+		MaxBotsPerUser:      envInt("PRISMA_MAX_BOTS_PER_USER", 10),
+
+		TokenDefaultLifetime:  envDuration("PRISMA_TOKEN_DEFAULT_LIFETIME", 30*24*time.Hour),
+		TokenMaxLifetime:      envDuration("PRISMA_TOKEN_MAX_LIFETIME", 365*24*time.Hour),
+		AdminTokenMaxLifetime: envDuration("PRISMA_ADMIN_TOKEN_MAX_LIFETIME", 7*24*time.Hour),
+		MaxTokensPerUser:      envInt("PRISMA_MAX_TOKENS_PER_USER", 50),
+
+		LoginDelayAfter:         envInt("PRISMA_LOGIN_DELAY_AFTER", 3),
+		LoginDelayBase:          envDuration("PRISMA_LOGIN_DELAY_BASE", time.Second),
+		LoginDelayMax:           envDuration("PRISMA_LOGIN_DELAY_MAX", 30*time.Second),
+		LoginLockoutThreshold:   envInt("PRISMA_LOGIN_LOCKOUT_THRESHOLD", 10),
+		LoginIPLockoutThreshold: envInt("PRISMA_LOGIN_IP_LOCKOUT_THRESHOLD", 50),
+		LoginLockoutDuration:    envDuration("PRISMA_LOGIN_LOCKOUT_DURATION", 15*time.Minute),
+		LoginFailureWindow:      envDuration("PRISMA_LOGIN_FAILURE_WINDOW", time.Hour),
+		TrustProxyHeaders:       envBool("PRISMA_TRUST_PROXY_HEADERS", false),
+
+		MFAIssuer:       envString("PRISMA_MFA_ISSUER", "Prisma"),
+		MFAChallengeTTL: envDuration("PRISMA_MFA_CHALLENGE_TTL", 5*time.Minute),
+		RequireAdminMFA: envBool("PRISMA_REQUIRE_ADMIN_MFA", false),
+
+		OIDCIssuer:         envString("PRISMA_OIDC_ISSUER", ""),
+		OIDCClientID:       envString("PRISMA_OIDC_CLIENT_ID", ""),
+		OIDCClientSecret:   envString("PRISMA_OIDC_CLIENT_SECRET", ""),
+		OIDCRedirectURL:    envString("PRISMA_OIDC_REDIRECT_URL", "http://localhost:8081/api/oidc/callback"),
+		OIDCPostLoginURL:   envString("PRISMA_OIDC_POST_LOGIN_URL", "/"),
+		OIDCScopes:         envList("PRISMA_OIDC_SCOPES", []string{"openid", "profile", "groups"}),
+		OIDCUsernameClaim:  envString("PRISMA_OIDC_USERNAME_CLAIM", "preferred_username"),
+		OIDCGroupsClaim:    envString("PRISMA_OIDC_GROUPS_CLAIM", "groups"),
+		OIDCAdminGroups:    envList("PRISMA_OIDC_ADMIN_GROUPS", nil),
+		OIDCAllowedGroups:  envList("PRISMA_OIDC_ALLOWED_GROUPS", nil),
+		OIDCLinkByUsername: envBool("PRISMA_OIDC_LINK_BY_USERNAME", false),
+		OIDCTimeout:        envDuration("PRISMA_OIDC_TIMEOUT", 10*time.Second),
+		PasswordLogin:      envBool("PRISMA_PASSWORD_LOGIN", true),
+
+		AuthBackends:           envList("PRISMA_AUTH_BACKENDS", []string{"local"}),
+		LDAPURL:                envString("PRISMA_LDAP_URL", "ldap://localhost:389"),
+		LDAPStartTLS:           envBool("PRISMA_LDAP_STARTTLS", false),
+		LDAPInsecureSkipVerify: envBool("PRISMA_LDAP_INSECURE_SKIP_VERIFY", false),
+		LDAPCAFile:             envString("PRISMA_LDAP_CA_FILE", ""),
+		LDAPUserDNTemplate:     envString("PRISMA_LDAP_USER_DN_TEMPLATE", ""),
+		LDAPBindDN:             envString("PRISMA_LDAP_BIND_DN", ""),
+		LDAPBindPassword:       envString("PRISMA_LDAP_BIND_PASSWORD", ""),
+		LDAPBaseDN:             envString("PRISMA_LDAP_BASE_DN", ""),
+		LDAPUserFilter:         envString("PRISMA_LDAP_USER_FILTER", "(uid=%s)"),
+		LDAPUsernameAttribute:  envString("PRISMA_LDAP_USERNAME_ATTRIBUTE", "uid"),
+		LDAPGroupAttribute:     envString("PRISMA_LDAP_GROUP_ATTRIBUTE", "memberOf"),
+		LDAPAdminGroups:        envList("PRISMA_LDAP_ADMIN_GROUPS", nil),
+		LDAPTimeout:            envDuration("PRISMA_LDAP_TIMEOUT", 10*time.Second),
+	}
+}
+
+func envString(key, def string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
+	}
+	return def
+}
+
+func envBool(key string, def bool) bool {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Printf("Ignoring invalid %s=%q: %v", key, v, err)
+		return def
+	}
+	return b
+}
+
+// envChoice reads one of a fixed set of values, the first being the default.
+func envChoice(key string, choices ...string) string {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return choices[0]
+	}
+	v = strings.ToLower(strings.TrimSpace(v))
+	if !containsString(choices, v) {
+		log.Printf("Ignoring invalid %s=%q: expected one of %s", key, v, strings.Join(choices, ", "))
+		return choices[0]
+	}
+	return v
+}
+
+// envList reads a comma-separated list. Entries are trimmed and lowercased.
+func envList(key string, def []string) []string {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return def
+	}
+	list := []string{}
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.ToLower(strings.TrimSpace(item)); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func envByteSize(key string, def int64) int64 {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return def
+	}
+	n, err := parseByteSize(v)
+	if err != nil {
+		log.Printf("Ignoring invalid %s=%q: %v", key, v, err)
+		return def
+	}
+	return n
+}
+
+// envRoleSizes reads "role=size" pairs such as "guest=1GB,admin=0".
+func envRoleSizes(key string, def map[Role]int64) map[Role]int64 {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return def
+	}
+	sizes := make(map[Role]int64)
+	for _, item := range strings.Split(v, ",") {
+		role, size, found := strings.Cut(strings.TrimSpace(item), "=")
+		if !found {
+			continue
+		}
+		n, err := parseByteSize(size)
+		if err != nil {
+			log.Printf("Ignoring invalid %s entry %q: %v", key, item, err)
+			continue
+		}
+		sizes[Role(strings.TrimSpace(role))] = n
+	}
+	return sizes
+}
+
+// parseByteSize accepts plain byte counts or KB/MB/GB/TB suffixes (powers of 1024).
+func parseByteSize(v string) (int64, error) {
+	v = strings.ToUpper(strings.TrimSpace(v))
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix string
+		size   int64
+	}{{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(v, unit.suffix) {
+			v, multiplier = strings.TrimSpace(strings.TrimSuffix(v, unit.suffix)), unit.size
+			break
+		}
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return n * multiplier, nil
+}
+
+func envInt(key string, def int) int {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Printf("Ignoring invalid %s=%q: %v", key, v, err)
+		return def
+	}
+	return n
+}
+
+func envRateLimit(key string, def rateLimit) rateLimit {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return def
+	}
+	l, err := parseRateLimit(v)
+	if err != nil {
+		log.Printf("Ignoring invalid %s=%q: %v", key, v, err)
+		return def
+	}
+	return l
+}
+
+func envDuration(key string, def time.Duration) time.Duration {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Printf("Ignoring invalid %s=%q: %v", key, v, err)
+		return def
+	}
+	return d
+}
+
+// envSigningKey reads a secret key, generating a random one when unset. A
+// generated key does not survive restarts, so previously issued URLs expire.
+func envSigningKey(key string) []byte {
+	if v := os.Getenv(key); v != "" {
+		return []byte(v)
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatalf("Failed to generate %s: %v", key, err)
+	}
+	log.Printf("%s is not set; using a random key for this run", key)
+	return b
+}
@@ -2,8 +2,10 @@ package main
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
 	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"log"
 	"os"
@@ -71,10 +73,241 @@ func ensureTables(db *sql.DB) {
         filetype TEXT,
         filesize INTEGER,
         uploaded_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+    )`)
+	db.Exec(`CREATE TABLE IF NOT EXISTS blobs (
+        hash TEXT PRIMARY KEY,
+        blob_key TEXT NOT NULL,
+        size BIGINT NOT NULL,
+        content_type TEXT,
+        refcount INTEGER NOT NULL DEFAULT 0,
+        created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+    )`)
+	db.Exec(`CREATE TABLE IF NOT EXISTS message_attachments (
+        message_id INTEGER NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+        upload_id INTEGER NOT NULL UNIQUE REFERENCES uploads(id) ON DELETE CASCADE,
+        position INTEGER NOT NULL DEFAULT 0,
+        PRIMARY KEY (message_id, upload_id)
+    )`)
+	db.Exec(`CREATE TABLE IF NOT EXISTS message_embeds (
+        message_id INTEGER NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+        position INTEGER NOT NULL,
+        embed JSONB NOT NULL,
+        PRIMARY KEY (message_id, position)
+    )`)
+	db.Exec(`CREATE TABLE IF NOT EXISTS link_previews (
+        url TEXT PRIMARY KEY,
+        embed JSONB,
+        fetched_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+    )`)
+	db.Exec(`CREATE TABLE IF NOT EXISTS proxy_cache (
+        url_hash TEXT PRIMARY KEY,
+        url TEXT NOT NULL,
+        blob_key TEXT NOT NULL,
+        content_type TEXT NOT NULL,
+        size BIGINT NOT NULL,
+        fetched_at TIMESTAMPTZ NOT NULL
+    )`)
+	db.Exec(`CREATE TABLE IF NOT EXISTS custom_emoji (
+        id SERIAL PRIMARY KEY,
+        name TEXT UNIQUE NOT NULL,
+        upload_id INTEGER UNIQUE NOT NULL REFERENCES uploads(id) ON DELETE CASCADE,
+        animated BOOLEAN NOT NULL DEFAULT FALSE,
+        created_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+        created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+    )`)
+	db.Exec(`CREATE TABLE IF NOT EXISTS webhooks (
+        id SERIAL PRIMARY KEY,
+        channel_id INTEGER NOT NULL REFERENCES channels(id) ON DELETE CASCADE,
+        name TEXT NOT NULL,
+        avatar_url TEXT,
+        token_hash TEXT UNIQUE NOT NULL,
+        created_by INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+        created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+    )`)
+	db.Exec(`CREATE TABLE IF NOT EXISTS outgoing_webhooks (
+        id SERIAL PRIMARY KEY,
+        name TEXT NOT NULL,
+        url TEXT NOT NULL,
+        secret TEXT NOT NULL,
+        events TEXT[] NOT NULL,
+        enabled BOOLEAN NOT NULL DEFAULT TRUE,
+        consecutive_failures INTEGER NOT NULL DEFAULT 0,
+        disabled_reason TEXT,
+        created_by INTEGER NOT NULL REFERENCES users(id),
+        created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+    )`)
+	db.Exec(`CREATE TABLE IF NOT EXISTS webhook_deliveries (
+        id BIGSERIAL PRIMARY KEY,
+        webhook_id INTEGER NOT NULL REFERENCES outgoing_webhooks(id) ON DELETE CASCADE,
+        event TEXT NOT NULL,
+        payload JSONB NOT NULL,
+        status TEXT NOT NULL DEFAULT 'pending',
+        attempts INTEGER NOT NULL DEFAULT 0,
+        response_status INTEGER,
+        response_body TEXT,
+        last_error TEXT,
+        duration_ms BIGINT,
+        created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+        last_attempt_at TIMESTAMPTZ,
+        next_attempt_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+        delivered_at TIMESTAMPTZ
+    )`)
+	db.Exec(`CREATE INDEX IF NOT EXISTS webhook_deliveries_due ON webhook_deliveries (next_attempt_at) WHERE status = 'pending'`)
+	db.Exec(`CREATE INDEX IF NOT EXISTS webhook_deliveries_log ON webhook_deliveries (webhook_id, id DESC)`)
+	db.Exec(`CREATE TABLE IF NOT EXISTS bots (
+        user_id INTEGER PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+        owner_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+        token_hash TEXT UNIQUE NOT NULL,
+        description TEXT,
+        created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+    )`)
+	db.Exec(`CREATE TABLE IF NOT EXISTS slash_commands (
+        id SERIAL PRIMARY KEY,
+        name TEXT UNIQUE NOT NULL,
+        description TEXT NOT NULL DEFAULT '',
+        options JSONB NOT NULL DEFAULT '[]',
+        bot_id INTEGER REFERENCES bots(user_id) ON DELETE CASCADE,
+        webhook_id INTEGER REFERENCES outgoing_webhooks(id) ON DELETE CASCADE,
+        created_by INTEGER NOT NULL REFERENCES users(id),
+        created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+    )`)
+	db.Exec(`CREATE TABLE IF NOT EXISTS reminders (
+        id SERIAL PRIMARY KEY,
+        user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+        channel_id INTEGER REFERENCES channels(id) ON DELETE SET NULL,
+        content TEXT NOT NULL,
+        remind_at TIMESTAMPTZ NOT NULL,
+        created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+    )`)
+	db.Exec(`CREATE TABLE IF NOT EXISTS personal_access_tokens (
+        id SERIAL PRIMARY KEY,
+        user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+        name TEXT NOT NULL,
+        token_hash TEXT UNIQUE NOT NULL,
+        scopes TEXT[] NOT NULL,
+        expires_at TIMESTAMPTZ NOT NULL,
+        last_used_at TIMESTAMPTZ,
+        created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+    )`)
+	db.Exec(`CREATE TABLE IF NOT EXISTS login_throttle (
+        key TEXT PRIMARY KEY,
+        failures INTEGER NOT NULL DEFAULT 0,
+        last_failure_at TIMESTAMPTZ NOT NULL,
+        locked_until TIMESTAMPTZ
+    )`)
+	db.Exec(`CREATE TABLE IF NOT EXISTS audit_log (
+        id BIGSERIAL PRIMARY KEY,
+        event TEXT NOT NULL,
+        user_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+        username TEXT,
+        actor_id INTEGER REFERENCES users(id) ON DELETE SET NULL,
+        ip TEXT,
+        user_agent TEXT,
+        detail TEXT,
+        created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP
+    )`)
+	db.Exec(`CREATE TABLE IF NOT EXISTS user_mfa (
+        user_id INTEGER PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+        secret TEXT NOT NULL,
+        enabled BOOLEAN NOT NULL DEFAULT FALSE,
+        last_step BIGINT NOT NULL DEFAULT 0,
+        created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+        enabled_at TIMESTAMPTZ
+    )`)
+	db.Exec(`CREATE TABLE IF NOT EXISTS mfa_recovery_codes (
+        id SERIAL PRIMARY KEY,
+        user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+        code_hash TEXT NOT NULL,
+        used_at TIMESTAMPTZ
+    )`)
+	db.Exec(`CREATE TABLE IF NOT EXISTS mfa_challenges (
+        token_hash TEXT PRIMARY KEY,
+        user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+        expires_at TIMESTAMPTZ NOT NULL
+    )`)
+	db.Exec(`CREATE TABLE IF NOT EXISTS oidc_identities (
+        issuer TEXT NOT NULL,
+        subject TEXT NOT NULL,
+        user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+        provisioned BOOLEAN NOT NULL DEFAULT FALSE,
+        created_at TIMESTAMPTZ NOT NULL DEFAULT CURRENT_TIMESTAMP,
+        last_login_at TIMESTAMPTZ,
+        PRIMARY KEY (issuer, subject),
+        UNIQUE (user_id, issuer)
+    )`)
+	db.Exec(`CREATE TABLE IF NOT EXISTS oidc_states (
+        state_hash TEXT PRIMARY KEY,
+        code_verifier TEXT NOT NULL,
+        nonce TEXT NOT NULL,
+        link_user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+        expires_at TIMESTAMPTZ NOT NULL
+    )`)
+	db.Exec(`CREATE TABLE IF NOT EXISTS oidc_login_codes (
+        code_hash TEXT PRIMARY KEY,
+        user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+        expires_at TIMESTAMPTZ NOT NULL
+    )`)
+	db.Exec(`CREATE TABLE IF NOT EXISTS upload_variants (
+        upload_id INTEGER NOT NULL REFERENCES uploads(id) ON DELETE CASCADE,
+        name TEXT NOT NULL,
+        stored_filename TEXT NOT NULL,
+        width INTEGER NOT NULL,
+        height INTEGER NOT NULL,
+        filesize BIGINT NOT NULL,
+        PRIMARY KEY (upload_id, name)
+    )`)
+	db.Exec(`CREATE TABLE IF NOT EXISTS resumable_uploads (
+        id TEXT PRIMARY KEY,
+        user_id INTEGER NOT NULL REFERENCES users(id),
+        filename TEXT NOT NULL,
+        length BIGINT NOT NULL,
+        upload_offset BIGINT NOT NULL DEFAULT 0,
+        finalizing BOOLEAN NOT NULL DEFAULT FALSE,
+        created_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP,
+        updated_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+    )`)
+	db.Exec(`CREATE TABLE IF NOT EXISTS resumable_upload_parts (
+        upload_id TEXT NOT NULL REFERENCES resumable_uploads(id) ON DELETE CASCADE,
+        part_offset BIGINT NOT NULL,
+        size BIGINT NOT NULL,
+        blob_key TEXT NOT NULL,
+        PRIMARY KEY (upload_id, part_offset)
     )`)
 	db.Exec(`ALTER TABLE users ADD COLUMN IF NOT EXISTS avatar_url TEXT`)
 	db.Exec(`ALTER TABLE channel_categories ADD COLUMN IF NOT EXISTS position INTEGER NOT NULL DEFAULT 0`)
 	db.Exec(`ALTER TABLE channels ADD COLUMN IF NOT EXISTS position INTEGER NOT NULL DEFAULT 0`)
+	db.Exec(`ALTER TABLE uploads ALTER COLUMN filesize TYPE BIGINT`)
+	db.Exec(`ALTER TABLE users ADD COLUMN IF NOT EXISTS storage_quota BIGINT`)
+	db.Exec(`ALTER TABLE uploads ADD COLUMN IF NOT EXISTS blob_hash TEXT REFERENCES blobs(hash)`)
+	db.Exec(`ALTER TABLE uploads ADD COLUMN IF NOT EXISTS blob_key TEXT`)
+	db.Exec(`ALTER TABLE upload_variants ADD COLUMN IF NOT EXISTS blob_key TEXT`)
+	db.Exec(`ALTER TABLE uploads ADD COLUMN IF NOT EXISTS width INTEGER`)
+	db.Exec(`ALTER TABLE uploads ADD COLUMN IF NOT EXISTS height INTEGER`)
+	db.Exec(`ALTER TABLE users ADD COLUMN IF NOT EXISTS avatar_width INTEGER`)
+	db.Exec(`ALTER TABLE users ADD COLUMN IF NOT EXISTS avatar_height INTEGER`)
+	db.Exec(`ALTER TABLE users ADD COLUMN IF NOT EXISTS avatar_size BIGINT`)
+	// Files stored before scanning was introduced count as clean.
+	db.Exec(`ALTER TABLE uploads ADD COLUMN IF NOT EXISTS scan_status TEXT NOT NULL DEFAULT 'clean'`)
+	db.Exec(`ALTER TABLE uploads ADD COLUMN IF NOT EXISTS scan_signature TEXT`)
+	db.Exec(`ALTER TABLE uploads ADD COLUMN IF NOT EXISTS scanned_at TIMESTAMPTZ`)
+	db.Exec(`ALTER TABLE messages ADD COLUMN IF NOT EXISTS webhook_id INTEGER REFERENCES webhooks(id) ON DELETE SET NULL`)
+	db.Exec(`ALTER TABLE messages ADD COLUMN IF NOT EXISTS author_name TEXT`)
+	db.Exec(`ALTER TABLE messages ADD COLUMN IF NOT EXISTS author_avatar_url TEXT`)
+	db.Exec(`ALTER TABLE users ADD COLUMN IF NOT EXISTS is_bot BOOLEAN NOT NULL DEFAULT FALSE`)
+	db.Exec(`ALTER TABLE users ADD COLUMN IF NOT EXISTS nickname TEXT`)
+	db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS users_nickname_lower_key ON users (LOWER(nickname))`)
+	db.Exec(`ALTER TABLE users ADD COLUMN IF NOT EXISTS muted_until TIMESTAMPTZ`)
+	db.Exec(`ALTER TABLE channels ADD COLUMN IF NOT EXISTS topic TEXT`)
+	// Which backend an account belongs to; see auth.go.
+	db.Exec(`ALTER TABLE users ADD COLUMN IF NOT EXISTS auth_source TEXT NOT NULL DEFAULT 'local'`)
+	db.Exec(`UPDATE users SET auth_source = 'oidc'
+        WHERE auth_source = 'local' AND id IN (SELECT user_id FROM oidc_identities WHERE provisioned)`)
+	// The bootstrap admin always logs in with its local password. Servers
+	// set up before the flag existed get their oldest local admin.
+	db.Exec(`ALTER TABLE users ADD COLUMN IF NOT EXISTS bootstrap BOOLEAN NOT NULL DEFAULT FALSE`)
+	db.Exec(`UPDATE users SET bootstrap = TRUE
+        WHERE id = (SELECT MIN(id) FROM users WHERE role = 'admin' AND NOT is_bot AND auth_source = 'local')
+        AND NOT EXISTS (SELECT 1 FROM users WHERE bootstrap)`)
 }
 
 func ensureInitialCategoryAndChannel(db *sql.DB) {
@@ -120,6 +353,7 @@ func ensureInitialAdmin(db *sql.DB) {
 		break
 	}
 	if createUser(db, username, password, RoleAdmin) {
+		db.Exec(`UPDATE users SET bootstrap = TRUE WHERE username = $1`, username)
 		log.Println("Admin user created successfully.")
 	} else {
 		log.Println("Failed to create admin user.")
@@ -132,14 +366,31 @@ func createUser(db *sql.DB, username, password string, role Role) bool {
 	return err == nil
 }
 
+// checkUser verifies a password login against the authenticator chain
+// (auth.go). Bot accounts cannot log in.
 func checkUser(db *sql.DB, username, password string) (*User, bool) {
-	row := db.QueryRow(
-		`SELECT id, username, role, avatar_url FROM users WHERE username=$1 AND password=$2`, username, password,
-	)
+	chain := authChain
+	if isBootstrapAdmin(db, username) {
+		chain = []authenticator{localAuthenticator{}}
+	}
+	for _, a := range chain {
+		user, err := a.authenticate(db, username, password)
+		if err == nil {
+			return user, true
+		}
+		if err != errAuthFailed {
+			log.Printf("%s authentication for '%s' failed: %v", a.name(), username, err)
+		}
+	}
+	return nil, false
+}
+
+// scanUser reads id, username, role, avatar_url, is_bot and nickname.
+func scanUser(row rowScanner) (*User, bool) {
 	var u User
 	var roleStr string
 	var avatarURL sql.NullString
-	err := row.Scan(&u.ID, &u.Username, &roleStr, &avatarURL)
+	err := row.Scan(&u.ID, &u.Username, &roleStr, &avatarURL, &u.Bot, &u.Nickname)
 	if err != nil {
 		return nil, false
 	}
@@ -163,6 +414,14 @@ func generateToken() (string, error) {
 	return base64.URLEncoding.EncodeToString(b), nil
 }
 
+// hashToken is how random secrets such as webhook, bot and personal access
+// tokens and recovery codes are stored. All of them have at least 80 bits,
+// so an unsalted SHA-256 is enough.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
 func createSession(db *sql.DB, userID int64) (string, error) {
 	token, err := generateToken()
 	if err != nil {
@@ -177,27 +436,13 @@ func createSession(db *sql.DB, userID int64) (string, error) {
 }
 
 func getUserByToken(db *sql.DB, token string) (*User, bool) {
-	row := db.QueryRow(`
-		SELECT u.id, u.username, u.role, u.avatar_url
+	return scanUser(db.QueryRow(`
+		SELECT u.id, u.username, u.role, u.avatar_url, u.is_bot, COALESCE(u.nickname, '')
 		FROM sessions s
 		JOIN users u ON s.user_id = u.id
-		WHERE s.token = $1 AND (s.expires_at IS NULL OR s.expires_at > NOW())`, token)
-	var u User
-	var roleStr string
-	var avatarURL sql.NullString
-	err := row.Scan(&u.ID, &u.Username, &roleStr, &avatarURL)
-	if err != nil {
-		return nil, false
-	}
-	u.Role = Role(roleStr)
-	if avatarURL.Valid {
-		u.AvatarURL = avatarURL.String
-	} else {
-		u.AvatarURL = ""
-	}
-	return &u, true
+		WHERE s.token = $1 AND (s.expires_at IS NULL OR s.expires_at > NOW())`, token))
 }
 
 func refreshSession(db *sql.DB, token string) {
 	db.Exec(`UPDATE sessions SET expires_at=$1 WHERE token=$2`, time.Now().Add(30*24*time.Hour), token)
-}
\ No newline at end of file
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- Signed download URLs ---
+
+// signedUploadURL returns a /uploads/ URL that can be fetched without an
+// Authorization header, e.g. from <img> tags. Expiry is rounded up to the hour
+// so repeated payloads reuse the same URL and stay cacheable.
+func signedUploadURL(storedFilename string) string {
+	expires := time.Now().Add(config.SignedURLTTL).Truncate(time.Hour).Add(time.Hour).Unix()
+	return fmt.Sprintf("/uploads/%s?expires=%d&sig=%s",
+		url.PathEscape(storedFilename), expires, uploadSignature(storedFilename, expires))
+}
+
+func uploadSignature(storedFilename string, expires int64) string {
+	mac := hmac.New(sha256.New, config.SigningKey)
+	fmt.Fprintf(mac, "upload\n%s\n%d", storedFilename, expires)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifyUploadSignature checks the expires/sig query parameters for name.
+func verifyUploadSignature(storedFilename string, q url.Values) bool {
+	expires, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+	expected := uploadSignature(storedFilename, expires)
+	return hmac.Equal([]byte(expected), []byte(q.Get("sig")))
+}
+
+// --- Access control ---
+
+// isPublicUploadName reports whether a file is served without access checks.
+// Avatars are shown next to every message and in presence lists.
+func isPublicUploadName(name string) bool {
+	return strings.HasPrefix(name, "avatar_") || strings.HasPrefix(name, "thumb_")
+}
+
+// canReadUpload reports whether user may download the upload. Owners and
+// admins always can; everyone else needs to be able to see a message the
+// upload is attached to. Custom emoji images are readable by everyone.
+func canReadUpload(db *sql.DB, user *User, uploadID, ownerID int64) bool {
+	if user == nil {
+		return false
+	}
+	if user.ID == ownerID || isAdmin(user) {
+		return true
+	}
+	var isEmoji bool
+	db.QueryRow(`SELECT EXISTS (SELECT 1 FROM custom_emoji WHERE upload_id = $1)`, uploadID).Scan(&isEmoji)
+	if isEmoji {
+		return true
+	}
+	var channelID int64
+	err := db.QueryRow(`
+		SELECT m.channel_id FROM message_attachments ma JOIN messages m ON ma.message_id = m.id
+		WHERE ma.upload_id = $1`, uploadID).Scan(&channelID)
+	if err != nil {
+		return false
+	}
+	return canViewChannel(db, user, channelID)
+}
+
+// --- Download handler ---
+
+// serveUploadHandler serves files from the blob store. Requests must
+// carry a valid signature or a bearer token for a user allowed to read the
+// upload, and the upload must have passed its malware scan. Files are served
+// with the sniffed content type and headers that stop browsers rendering
+// active content inline.
+func serveUploadHandler(db *sql.DB, blobs BlobStore) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/uploads/")
+		if name == "" || strings.ContainsAny(name, "/\\") || strings.HasPrefix(name, ".") {
+			http.NotFound(w, r)
+			return
+		}
+
+		// Uploads and variants resolve to a (possibly shared) blob key; rows
+		// from before content addressing still use their stored filename.
+		var uploadID, ownerID int64
+		var origFilename, filetype sql.NullString
+		var scanStatus string
+		key := name
+		err := db.QueryRow(`
+			SELECT id, user_id, orig_filename, filetype, COALESCE(blob_key, stored_filename), scan_status
+			FROM uploads WHERE stored_filename = $1`, name).
+			Scan(&uploadID, &ownerID, &origFilename, &filetype, &key, &scanStatus)
+		if err == sql.ErrNoRows {
+			// Image variants are generated by us; the type is sniffed below.
+			err = db.QueryRow(`
+				SELECT up.id, up.user_id, up.orig_filename, COALESCE(v.blob_key, v.stored_filename), up.scan_status
+				FROM upload_variants v JOIN uploads up ON v.upload_id = up.id
+				WHERE v.stored_filename = $1`, name).Scan(&uploadID, &ownerID, &origFilename, &key, &scanStatus)
+		}
+		switch {
+		case err == sql.ErrNoRows:
+			key = name
+			if !isPublicUploadName(name) {
+				http.NotFound(w, r)
+				return
+			}
+		case err != nil:
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		case r.URL.Query().Get("sig") != "":
+			if !verifyUploadSignature(name, r.URL.Query()) {
+				http.Error(w, "Link expired or invalid", http.StatusForbidden)
+				return
+			}
+		default:
+			cred, err := authenticateRequest(db, r)
+			if err != nil {
+				writeError(w, err, "")
+				return
+			}
+			if !cred.allows(scopeMessagesRead) {
+				writeError(w, errScopeRequired, "")
+				return
+			}
+			user := cred.user
+			if err := checkMFAEnforced(db, user); err != nil {
+				writeError(w, err, "Database error")
+				return
+			}
+			// Respond as if the file did not exist so IDs cannot be probed.
+			if !canReadUpload(db, user, uploadID, ownerID) {
+				http.NotFound(w, r)
+				return
+			}
+		}
+
+		// Withheld until scanned, including from owners and admins.
+		if err := scanStatusError(scanStatus); err != nil {
+			if err == errScanPending {
+				w.Header().Set("Retry-After", "5")
+			}
+			writeError(w, err, "File unavailable")
+			return
+		}
+
+		if config.S3RedirectDownloads {
+			contentType := filetype.String
+			if contentType == "" {
+				if info, err := blobs.Stat(r.Context(), key); err == nil {
+					contentType = info.ContentType
+				}
+			}
+			contentType, disposition := safeContentHeaders(contentType, origFilename.String)
+			presigned, err := blobs.Presign(r.Context(), key, 5*time.Minute, PresignOptions{
+				ContentType:        contentType,
+				ContentDisposition: disposition,
+			})
+			if err == nil {
+				http.Redirect(w, r, presigned, http.StatusFound)
+				return
+			}
+		}
+
+		rc, info, err := blobs.Get(r.Context(), key)
+		if err == errBlobNotFound {
+			http.NotFound(w, r)
+			return
+		} else if err != nil {
+			log.Printf("Failed to read blob %s: %v", key, err)
+			http.Error(w, "Failed to read file", http.StatusInternalServerError)
+			return
+		}
+		defer rc.Close()
+
+		if !filetype.Valid || filetype.String == "" {
+			filetype.String = info.ContentType
+		}
+		rs, seekable := rc.(io.ReadSeeker)
+		var body io.Reader = rc
+		if filetype.String == "" {
+			if seekable {
+				head := make([]byte, sniffLen)
+				hn, _ := io.ReadFull(rs, head)
+				filetype.String = detectContentType(head[:hn])
+				if _, err := rs.Seek(0, io.SeekStart); err != nil {
+					http.Error(w, "Failed to read file", http.StatusInternalServerError)
+					return
+				}
+			} else {
+				br := bufio.NewReaderSize(rc, sniffLen)
+				head, _ := br.Peek(sniffLen)
+				filetype.String = detectContentType(head)
+				body = br
+			}
+		}
+
+		setSafeContentHeaders(w, filetype.String, origFilename.String)
+		w.Header().Set("Cache-Control", "private, max-age=3600")
+		if seekable {
+			http.ServeContent(w, r, name, info.ModTime, rs)
+			return
+		}
+		if !info.ModTime.IsZero() {
+			w.Header().Set("Last-Modified", info.ModTime.UTC().Format(http.TimeFormat))
+		}
+		if info.Size > 0 {
+			w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+		}
+		if r.Method == http.MethodHead {
+			return
+		}
+		io.Copy(w, body)
+	})
+}
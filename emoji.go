@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"image/gif"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// Custom emoji are images uploaded through the normal upload endpoints and
+// then registered by an admin under a :name: shortcode. Shortcodes in message
+// content become "emoji" nodes in content_ast when a matching emoji exists.
+// Every change is pushed to clients as an emoji_update event carrying the
+// full list.
+
+var emojiNamePattern = regexp.MustCompile(`^[A-Za-z0-9_]{2,32}$`)
+
+var emojiAllowedTypes = []string{"image/png", "image/jpeg", "image/gif", "image/webp"}
+
+const emojiSelect = `
+	SELECT e.id, e.name, e.animated, COALESCE(e.created_by, 0), e.created_at, up.stored_filename
+	FROM custom_emoji e JOIN uploads up ON e.upload_id = up.id`
+
+func scanEmoji(row rowScanner) (CustomEmoji, error) {
+	var e CustomEmoji
+	var storedFilename string
+	if err := row.Scan(&e.ID, &e.Name, &e.Animated, &e.CreatedBy, &e.CreatedAt, &storedFilename); err != nil {
+		return e, err
+	}
+	e.URL = signedUploadURL(storedFilename)
+	return e, nil
+}
+
+func listCustomEmoji(db *sql.DB) ([]CustomEmoji, error) {
+	rows, err := db.Query(emojiSelect + ` ORDER BY e.name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	emoji := []CustomEmoji{}
+	for rows.Next() {
+		e, err := scanEmoji(rows)
+		if err != nil {
+			return nil, err
+		}
+		emoji = append(emoji, e)
+	}
+	return emoji, rows.Err()
+}
+
+// broadcastEmojiUpdate sends the current emoji list to every client.
+func broadcastEmojiUpdate(db *sql.DB, hub *Hub) {
+	emoji, err := listCustomEmoji(db)
+	if err != nil {
+		log.Printf("Failed to load emoji for broadcast: %v", err)
+		return
+	}
+	broadcastEvent(hub, "emoji_update", emoji)
+}
+
+// resolveEmoji fills in shortcode nodes that name a custom emoji and turns
+// the rest back into plain text.
+func resolveEmoji(db *sql.DB, trees [][]MarkdownNode) error {
+	var names []string
+	for _, tree := range trees {
+		walkMarkdown(tree, func(n *MarkdownNode) {
+			if n.Type == "emoji" {
+				names = append(names, n.Name)
+			}
+		})
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	rows, err := db.Query(emojiSelect+` WHERE e.name = ANY($1)`, pq.Array(names))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	known := make(map[string]CustomEmoji)
+	for rows.Next() {
+		if e, err := scanEmoji(rows); err == nil {
+			known[e.Name] = e
+		}
+	}
+	for _, tree := range trees {
+		walkMarkdown(tree, func(n *MarkdownNode) {
+			if n.Type != "emoji" {
+				return
+			}
+			if e, ok := known[n.Name]; ok {
+				n.EmojiID, n.URL, n.Animated = e.ID, e.URL, e.Animated
+			} else {
+				*n = MarkdownNode{Type: "text", Text: ":" + n.Name + ":"}
+			}
+		})
+	}
+	return rows.Err()
+}
+
+// isAnimatedGIF reports whether the stored upload is a GIF with more than one
+// frame.
+func isAnimatedGIF(ctx context.Context, blobs BlobStore, key string) bool {
+	rc, _, err := blobs.Get(ctx, key)
+	if err != nil {
+		return false
+	}
+	defer rc.Close()
+	g, err := gif.DecodeAll(rc)
+	return err == nil && len(g.Image) > 1
+}
+
+// --- Handlers ---
+
+func getEmojiHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		emoji, err := listCustomEmoji(db)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(emoji)
+	}
+}
+
+// createEmojiHandler registers one of the admin's own uploads as an emoji.
+// GIFs with several frames are flagged as animated.
+func createEmojiHandler(db *sql.DB, hub *Hub, blobs BlobStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := userFromContext(r.Context())
+		if !isAdmin(user) {
+			http.Error(w, "Admin access required", http.StatusForbidden)
+			return
+		}
+		var req struct {
+			Name     string `json:"name"`
+			UploadID int64  `json:"upload_id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if !emojiNamePattern.MatchString(req.Name) {
+			http.Error(w, "Emoji names must be 2-32 letters, digits or underscores", http.StatusBadRequest)
+			return
+		}
+
+		var ownerID, filesize int64
+		var filetype, scanStatus, key string
+		err := db.QueryRow(`
+			SELECT user_id, COALESCE(filetype, ''), COALESCE(filesize, 0), scan_status, COALESCE(blob_key, stored_filename)
+			FROM uploads WHERE id = $1`, req.UploadID).Scan(&ownerID, &filetype, &filesize, &scanStatus, &key)
+		if err == sql.ErrNoRows || (err == nil && ownerID != user.ID) {
+			http.Error(w, "Upload not found", http.StatusBadRequest)
+			return
+		} else if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if !containsString(emojiAllowedTypes, filetype) {
+			http.Error(w, "Emoji must be a PNG, JPEG, GIF or WebP image", http.StatusUnsupportedMediaType)
+			return
+		}
+		if filesize > config.EmojiMaxBytes {
+			http.Error(w, "Emoji image is too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if scanStatus == scanInfected {
+			writeError(w, errUploadInfected, "")
+			return
+		}
+		animated := filetype == "image/gif" && isAnimatedGIF(r.Context(), blobs, key)
+
+		var id int64
+		err = db.QueryRow(`
+			INSERT INTO custom_emoji (name, upload_id, animated, created_by) VALUES ($1, $2, $3, $4)
+			ON CONFLICT DO NOTHING RETURNING id`, req.Name, req.UploadID, animated, user.ID).Scan(&id)
+		if err == sql.ErrNoRows {
+			http.Error(w, "An emoji with that name or upload already exists", http.StatusConflict)
+			return
+		} else if err != nil {
+			log.Printf("DB Error creating emoji: %v", err)
+			http.Error(w, "Failed to create emoji", http.StatusInternalServerError)
+			return
+		}
+		emoji, err := scanEmoji(db.QueryRow(emojiSelect+` WHERE e.id = $1`, id))
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		broadcastEmojiUpdate(db, hub)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(emoji)
+	}
+}
+
+// deleteEmojiHandler removes an emoji and its image.
+func deleteEmojiHandler(db *sql.DB, hub *Hub, blobs BlobStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isAdmin(userFromContext(r.Context())) {
+			http.Error(w, "Admin access required", http.StatusForbidden)
+			return
+		}
+		id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid emoji ID", http.StatusBadRequest)
+			return
+		}
+		var uploadID int64
+		err = db.QueryRow(`DELETE FROM custom_emoji WHERE id = $1 RETURNING upload_id`, id).Scan(&uploadID)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Emoji not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		// The image goes too unless it was also posted as an attachment.
+		var attached bool
+		db.QueryRow(`SELECT EXISTS (SELECT 1 FROM message_attachments WHERE upload_id = $1)`, uploadID).Scan(&attached)
+		if !attached {
+			if _, err := deleteUpload(context.Background(), db, blobs, uploadID); err != nil {
+				log.Printf("Failed to delete emoji upload %d: %v", uploadID, err)
+			}
+		}
+		broadcastEmojiUpdate(db, hub)
+		w.WriteHeader(http.StatusOK)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeDB is a database/sql driver that answers every statement with
+// answer, for testing the logic between queries without Postgres. It
+// records the statements it sees, transaction boundaries included.
+type fakeDB struct {
+	answer func(query string, args []driver.Value) (fakeResult, error)
+
+	mu      sync.Mutex
+	queries []string
+}
+
+// fakeResult is the answer to one statement: rows for queries, or a count
+// of affected rows for everything else.
+type fakeResult struct {
+	columns  []string
+	rows     [][]driver.Value
+	affected int64
+}
+
+// fakeRows answers a query with rows of the given values; the column names
+// do not matter to Scan.
+func fakeRows(rows ...[]driver.Value) fakeResult {
+	var columns []string
+	if len(rows) > 0 {
+		columns = make([]string, len(rows[0]))
+	}
+	return fakeResult{columns: columns, rows: rows}
+}
+
+func newFakeDB(t *testing.T, answer func(query string, args []driver.Value) (fakeResult, error)) (*sql.DB, *fakeDB) {
+	t.Helper()
+	f := &fakeDB{answer: answer}
+	db := sql.OpenDB(f)
+	t.Cleanup(func() { db.Close() })
+	return db, f
+}
+
+// ran reports whether a statement containing fragment was run.
+func (f *fakeDB) ran(fragment string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, q := range f.queries {
+		if strings.Contains(q, fragment) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *fakeDB) record(query string) {
+	f.mu.Lock()
+	f.queries = append(f.queries, query)
+	f.mu.Unlock()
+}
+
+func (f *fakeDB) Connect(context.Context) (driver.Conn, error) { return fakeConn{f}, nil }
+func (f *fakeDB) Driver() driver.Driver                        { return fakeDriver{f} }
+
+type fakeDriver struct{ f *fakeDB }
+
+func (d fakeDriver) Open(string) (driver.Conn, error) { return fakeConn{d.f}, nil }
+
+type fakeConn struct{ f *fakeDB }
+
+func (c fakeConn) Prepare(query string) (driver.Stmt, error) { return fakeStmt{c.f, query}, nil }
+func (c fakeConn) Close() error                              { return nil }
+func (c fakeConn) Begin() (driver.Tx, error) {
+	c.f.record("BEGIN")
+	return fakeTx{c.f}, nil
+}
+
+type fakeTx struct{ f *fakeDB }
+
+func (tx fakeTx) Commit() error   { tx.f.record("COMMIT"); return nil }
+func (tx fakeTx) Rollback() error { tx.f.record("ROLLBACK"); return nil }
+
+type fakeStmt struct {
+	f     *fakeDB
+	query string
+}
+
+func (s fakeStmt) Close() error  { return nil }
+func (s fakeStmt) NumInput() int { return -1 }
+
+func (s fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.f.record(s.query)
+	res, err := s.f.answer(s.query, args)
+	if err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(res.affected), nil
+}
+
+func (s fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.f.record(s.query)
+	res, err := s.f.answer(s.query, args)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeRowsIter{res: res}, nil
+}
+
+type fakeRowsIter struct {
+	res  fakeResult
+	next int
+}
+
+func (r *fakeRowsIter) Columns() []string { return r.res.columns }
+func (r *fakeRowsIter) Close() error      { return nil }
+
+func (r *fakeRowsIter) Next(dest []driver.Value) error {
+	if r.next >= len(r.res.rows) {
+		return io.EOF
+	}
+	copy(dest, r.res.rows[r.next])
+	r.next++
+	return nil
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// uploadGC removes uploads that were never attached to a message and blobs
+// that nothing references any more, such as avatars replaced under another
+// name. Only one pass runs at a time; totals are kept for the admin API.
+type uploadGC struct {
+	db    *sql.DB
+	blobs BlobStore
+
+	running sync.Mutex
+
+	mu             sync.Mutex
+	runs           int
+	totalReclaimed int64
+	lastReport     *GCReport
+}
+
+func newUploadGC(db *sql.DB, blobs BlobStore) *uploadGC {
+	return &uploadGC{db: db, blobs: blobs}
+}
+
+// gcTimeout bounds a single pass. Passes never run on a request's context:
+// a client disconnecting must not stop deletion half-way.
+const gcTimeout = time.Hour
+
+// runScheduled runs a pass every config.GCInterval.
+func (gc *uploadGC) runScheduled() {
+	if config.GCInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(config.GCInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), gcTimeout)
+		if _, err := gc.run(ctx, config.GCDryRun); err != nil {
+			log.Printf("Upload GC failed: %v", err)
+		}
+		cancel()
+	}
+}
+
+var errGCRunning = &httpError{http.StatusConflict, "Garbage collection is already running"}
+
+// run performs one pass. In dry-run mode it only reports what it would delete.
+func (gc *uploadGC) run(ctx context.Context, dryRun bool) (*GCReport, error) {
+	if !gc.running.TryLock() {
+		return nil, errGCRunning
+	}
+	defer gc.running.Unlock()
+
+	report := &GCReport{DryRun: dryRun, StartedAt: time.Now()}
+	if err := gc.collectStaleUploads(ctx, report); err != nil {
+		return nil, err
+	}
+	if err := gc.collectOrphanedBlobs(ctx, report); err != nil {
+		return nil, err
+	}
+	report.DurationMS = time.Since(report.StartedAt).Milliseconds()
+
+	gc.mu.Lock()
+	gc.runs++
+	gc.totalReclaimed += report.ReclaimedBytes
+	gc.lastReport = report
+	gc.mu.Unlock()
+
+	mode := ""
+	if dryRun {
+		mode = " (dry run)"
+	}
+	log.Printf("Upload GC%s: %d stale uploads (%d bytes), %d orphaned blobs (%d bytes), reclaimed %d bytes, %d errors",
+		mode, report.StaleUploads, report.StaleUploadBytes, report.OrphanedBlobs, report.OrphanedBlobBytes,
+		report.ReclaimedBytes, report.Errors)
+	return report, nil
+}
+
+// collectStaleUploads deletes uploads older than the grace period that are
+// not attached to any message.
+func (gc *uploadGC) collectStaleUploads(ctx context.Context, report *GCReport) error {
+	cutoff := time.Now().Add(-config.GCUploadGrace)
+	rows, err := gc.db.Query(`
+		SELECT up.id, COALESCE(up.filesize, 0) FROM uploads up
+		WHERE up.uploaded_at < $1
+		  AND NOT EXISTS (SELECT 1 FROM message_attachments ma WHERE ma.upload_id = up.id)
+		  AND NOT EXISTS (SELECT 1 FROM custom_emoji ce WHERE ce.upload_id = up.id)`, cutoff)
+	if err != nil {
+		return err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id, size int64
+		if err := rows.Scan(&id, &size); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+		report.StaleUploads++
+		report.StaleUploadBytes += size
+	}
+	rows.Close()
+
+	if report.DryRun {
+		return nil
+	}
+	for _, id := range ids {
+		freed, err := deleteUpload(ctx, gc.db, gc.blobs, id)
+		if err != nil {
+			log.Printf("Upload GC: failed to delete upload %d: %v", id, err)
+			report.Errors++
+			continue
+		}
+		report.ReclaimedBytes += freed
+	}
+	return nil
+}
+
+// collectOrphanedBlobs deletes stored objects older than the blob grace
+// period that no table references. Expired image proxy entries are dropped
+// first so their cached copies are collected too.
+func (gc *uploadGC) collectOrphanedBlobs(ctx context.Context, report *GCReport) error {
+	if !report.DryRun {
+		gc.db.Exec(`DELETE FROM proxy_cache WHERE fetched_at < $1`, time.Now().Add(-config.ProxyCacheTTL))
+	}
+	referenced, err := gc.referencedKeys()
+	if err != nil {
+		return err
+	}
+	cutoff := time.Now().Add(-config.GCBlobGrace)
+	var orphans []BlobInfo
+	err = gc.blobs.List(ctx, func(info BlobInfo) error {
+		if referenced[info.Key] || info.ModTime.After(cutoff) {
+			return nil
+		}
+		orphans = append(orphans, info)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, info := range orphans {
+		report.OrphanedBlobs++
+		report.OrphanedBlobBytes += info.Size
+		if report.DryRun {
+			continue
+		}
+		if err := gc.blobs.Delete(ctx, info.Key); err != nil {
+			log.Printf("Upload GC: failed to delete blob %s: %v", info.Key, err)
+			report.Errors++
+			continue
+		}
+		report.ReclaimedBytes += info.Size
+	}
+	if !report.DryRun {
+		gc.db.Exec(`DELETE FROM blobs WHERE refcount <= 0`)
+	}
+	return nil
+}
+
+// referencedKeys returns every blob key still in use.
+func (gc *uploadGC) referencedKeys() (map[string]bool, error) {
+	keys := make(map[string]bool)
+	queries := []string{
+		`SELECT blob_key FROM blobs WHERE refcount > 0`,
+		`SELECT COALESCE(blob_key, stored_filename) FROM uploads`,
+		`SELECT COALESCE(blob_key, stored_filename) FROM upload_variants`,
+		`SELECT blob_key FROM resumable_upload_parts`,
+		`SELECT blob_key FROM proxy_cache`,
+	}
+	for _, q := range queries {
+		rows, err := gc.db.Query(q)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var key string
+			if err := rows.Scan(&key); err == nil {
+				keys[key] = true
+			}
+		}
+		rows.Close()
+	}
+
+	rows, err := gc.db.Query(`SELECT id, avatar_url FROM users WHERE avatar_url IS NOT NULL AND avatar_url <> ''`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var userID int64
+		var avatarURL string
+		if err := rows.Scan(&userID, &avatarURL); err != nil {
+			continue
+		}
+		name := path.Base(strings.SplitN(avatarURL, "?", 2)[0])
+		keys[name] = true
+		if name == fmt.Sprintf("avatar_%d.png", userID) {
+			for _, spec := range avatarVariantSpecs {
+				keys[fmt.Sprintf("avatar_%d_%s.png", userID, spec.name)] = true
+			}
+		}
+	}
+	return keys, rows.Err()
+}
+
+// --- Admin API ---
+
+// gcStatusHandler reports the last pass and cumulative totals.
+func gcStatusHandler(gc *uploadGC) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isAdmin(userFromContext(r.Context())) {
+			http.Error(w, "Admin access required", http.StatusForbidden)
+			return
+		}
+		gc.mu.Lock()
+		status := map[string]interface{}{
+			"runs":                  gc.runs,
+			"total_reclaimed_bytes": gc.totalReclaimed,
+			"last_report":           gc.lastReport,
+		}
+		gc.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	}
+}
+
+// runGCHandler starts a pass immediately. Pass ?dry_run=true for a report only.
+func runGCHandler(gc *uploadGC) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isAdmin(userFromContext(r.Context())) {
+			http.Error(w, "Admin access required", http.StatusForbidden)
+			return
+		}
+		dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+		ctx, cancel := context.WithTimeout(context.Background(), gcTimeout)
+		defer cancel()
+		report, err := gc.run(ctx, dryRun)
+		if err != nil {
+			writeError(w, err, "Garbage collection failed")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// Limits applied before an image is fully decoded into memory.
+const (
+	maxImageDimension = 8192
+	maxImagePixels    = 40_000_000
+)
+
+var (
+	errNotImage      = errors.New("not a supported image")
+	errImageTooLarge = errors.New("image dimensions too large")
+)
+
+// variantSpec describes a resized copy of an image. Square variants are
+// center-cropped to size x size; the others are scaled to fit inside it.
+type variantSpec struct {
+	name   string
+	size   int
+	square bool
+}
+
+var avatarVariantSpecs = []variantSpec{
+	{"64", 64, true},
+	{"128", 128, true},
+	{"256", 256, true},
+}
+
+var attachmentVariantSpecs = []variantSpec{
+	{"thumb", 320, false},
+	{"preview", 1280, false},
+}
+
+const avatarSize = 512
+
+// decodeImage validates the dimensions of a PNG, JPEG or GIF and decodes it,
+// applying any EXIF orientation so the result is upright. For animated GIFs
+// only the first frame is returned.
+func decodeImage(r io.ReadSeeker) (image.Image, string, error) {
+	head := make([]byte, orientationScanLen)
+	n, _ := io.ReadFull(r, head)
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, "", err
+	}
+	cfg, format, err := image.DecodeConfig(r)
+	if err != nil {
+		return nil, "", errNotImage
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 {
+		return nil, "", errNotImage
+	}
+	if cfg.Width > maxImageDimension || cfg.Height > maxImageDimension || cfg.Width*cfg.Height > maxImagePixels {
+		return nil, "", errImageTooLarge
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, "", err
+	}
+	img, format, err := image.Decode(r)
+	if err != nil {
+		return nil, "", errNotImage
+	}
+	return applyOrientation(img, imageOrientation(head[:n], format)), format, nil
+}
+
+// renderVariant produces the resized image for spec. Images are never upscaled.
+func renderVariant(img image.Image, spec variantSpec) *image.RGBA {
+	src := toRGBA(img)
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	if spec.square {
+		side := w
+		if h < side {
+			side = h
+		}
+		crop := image.Rect((w-side)/2, (h-side)/2, (w-side)/2+side, (h-side)/2+side)
+		size := spec.size
+		if side < size {
+			size = side
+		}
+		return scaleImage(src, crop, size, size)
+	}
+	dw, dh := fitWithin(w, h, spec.size)
+	return scaleImage(src, src.Bounds(), dw, dh)
+}
+
+// writeVariants renders every spec that is smaller than the source image and
+// stores it under a key derived from baseName.
+func writeVariants(ctx context.Context, blobs BlobStore, img image.Image, format, baseName string, specs []variantSpec) ([]ImageVariant, error) {
+	encoded, err := renderVariants(img, format, baseName, specs)
+	if err != nil {
+		return nil, err
+	}
+	return putVariants(ctx, blobs, encoded)
+}
+
+// encodedVariant is a rendered variant that has not been stored yet.
+type encodedVariant struct {
+	ImageVariant
+	data        []byte
+	contentType string
+}
+
+// renderVariants renders and encodes the variants writeVariants would store,
+// for callers that need their sizes first.
+func renderVariants(img image.Image, format, baseName string, specs []variantSpec) ([]encodedVariant, error) {
+	b := img.Bounds()
+	ext := filepath.Ext(baseName)
+	stem := strings.TrimSuffix(baseName, ext)
+	if format == "jpeg" {
+		ext = ".jpg"
+	} else {
+		format, ext = "png", ".png"
+	}
+
+	var variants []encodedVariant
+	for _, spec := range specs {
+		if !spec.square && b.Dx() <= spec.size && b.Dy() <= spec.size {
+			continue
+		}
+		out := renderVariant(img, spec)
+		data, contentType, err := encodeImage(out, format)
+		if err != nil {
+			return nil, err
+		}
+		storedFilename := fmt.Sprintf("%s_%s%s", stem, spec.name, ext)
+		variants = append(variants, encodedVariant{
+			ImageVariant: ImageVariant{
+				Name:           spec.name,
+				StoredFilename: storedFilename,
+				URL:            fmt.Sprintf("/uploads/%s", storedFilename),
+				Width:          out.Bounds().Dx(),
+				Height:         out.Bounds().Dy(),
+				Filesize:       int64(len(data)),
+			},
+			data:        data,
+			contentType: contentType,
+		})
+	}
+	return variants, nil
+}
+
+func putVariants(ctx context.Context, blobs BlobStore, encoded []encodedVariant) ([]ImageVariant, error) {
+	variants := []ImageVariant{}
+	for _, v := range encoded {
+		if err := blobs.Put(ctx, v.StoredFilename, bytes.NewReader(v.data), int64(len(v.data)), v.contentType); err != nil {
+			return variants, err
+		}
+		variants = append(variants, v.ImageVariant)
+	}
+	return variants, nil
+}
+
+// encodeImage encodes img as format ("jpeg" or "png") and returns the
+// encoded bytes and their content type.
+func encodeImage(img image.Image, format string) ([]byte, string, error) {
+	var buf bytes.Buffer
+	if format == "jpeg" {
+		err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 85})
+		return buf.Bytes(), "image/jpeg", err
+	}
+	err := png.Encode(&buf, img)
+	return buf.Bytes(), "image/png", err
+}
+
+func fitWithin(w, h, max int) (int, int) {
+	if w <= max && h <= max {
+		return w, h
+	}
+	if w >= h {
+		nh := h * max / w
+		if nh < 1 {
+			nh = 1
+		}
+		return max, nh
+	}
+	nw := w * max / h
+	if nw < 1 {
+		nw = 1
+	}
+	return nw, max
+}
+
+func toRGBA(img image.Image) *image.RGBA {
+	if rgba, ok := img.(*image.RGBA); ok && rgba.Bounds().Min == (image.Point{}) {
+		return rgba
+	}
+	b := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, b.Min, draw.Src)
+	return dst
+}
+
+// scaleImage resizes region r of src to w x h by averaging every source pixel
+// that falls into each destination pixel.
+func scaleImage(src *image.RGBA, r image.Rectangle, w, h int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	sw, sh := r.Dx(), r.Dy()
+	for y := 0; y < h; y++ {
+		y0 := r.Min.Y + y*sh/h
+		y1 := r.Min.Y + (y+1)*sh/h
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < w; x++ {
+			x0 := r.Min.X + x*sw/w
+			x1 := r.Min.X + (x+1)*sw/w
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+			var rs, gs, bs, as, n uint64
+			for sy := y0; sy < y1; sy++ {
+				i := src.PixOffset(x0, sy)
+				for sx := x0; sx < x1; sx++ {
+					rs += uint64(src.Pix[i])
+					gs += uint64(src.Pix[i+1])
+					bs += uint64(src.Pix[i+2])
+					as += uint64(src.Pix[i+3])
+					i += 4
+					n++
+				}
+			}
+			j := dst.PixOffset(x, y)
+			dst.Pix[j] = uint8(rs / n)
+			dst.Pix[j+1] = uint8(gs / n)
+			dst.Pix[j+2] = uint8(bs / n)
+			dst.Pix[j+3] = uint8(as / n)
+		}
+	}
+	return dst
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// Just enough JOSE to verify OpenID Connect ID tokens: compact JWS with
+// RS256 signatures, checked against RSA keys from the provider's JWKS.
+
+// jwtLeeway allows for clock skew between us and the identity provider.
+const jwtLeeway = time.Minute
+
+// minRSAKeyBits is the smallest signing key we trust.
+const minRSAKeyBits = 2048
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// rsaKeys reads the RSA signing keys of a JWKS document by key ID. Other
+// key types are skipped, and so are RSA keys shorter than minRSAKeyBits, so
+// one legacy key does not break logins signed with the others.
+func rsaKeys(doc []byte) (map[string]*rsa.PublicKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(doc, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") || (k.Alg != "" && k.Alg != "RS256") {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: bad modulus: %w", k.Kid, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, fmt.Errorf("key %q: bad exponent", k.Kid)
+		}
+		pub := &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+		if bits := pub.N.BitLen(); bits < minRSAKeyBits {
+			log.Printf("Ignoring JWKS key %q: %d-bit modulus is too short", k.Kid, bits)
+			continue
+		}
+		keys[k.Kid] = pub
+	}
+	return keys, nil
+}
+
+// idTokenClaims are the ID token claims we check or use. Everything else is
+// kept in Raw, for configurable claims such as groups.
+type idTokenClaims struct {
+	Issuer   string   `json:"iss"`
+	Subject  string   `json:"sub"`
+	Audience audience `json:"aud"`
+	AZP      string   `json:"azp"`
+	Expiry   int64    `json:"exp"`
+	IssuedAt int64    `json:"iat"`
+	Nonce    string   `json:"nonce"`
+	Raw      map[string]interface{}
+}
+
+// audience is the aud claim, which may be a string or an array.
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var s string
+	if json.Unmarshal(b, &s) == nil {
+		*a = audience{s}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(b, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+// parseJWT verifies an RS256 JWT's signature and returns its claims. key
+// looks up the public key for the token's kid.
+func parseJWT(raw string, key func(kid string) (*rsa.PublicKey, error)) (*idTokenClaims, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.New("malformed header")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return nil, errors.New("malformed header")
+	}
+	// Never let the token choose its own algorithm.
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("unsupported algorithm %q", header.Alg)
+	}
+	pub, err := key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed signature")
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig); err != nil {
+		return nil, errors.New("invalid signature")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.New("malformed payload")
+	}
+	var claims idTokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("malformed claims: %w", err)
+	}
+	if err := json.Unmarshal(payload, &claims.Raw); err != nil {
+		return nil, fmt.Errorf("malformed claims: %w", err)
+	}
+	return &claims, nil
+}
+
+// validate checks an ID token's standard claims (OpenID Connect Core
+// 3.1.3.7).
+func (c *idTokenClaims) validate(issuer, clientID, nonce string, now time.Time) error {
+	if c.Issuer != issuer {
+		return fmt.Errorf("issuer %q does not match", c.Issuer)
+	}
+	if !containsString(c.Audience, clientID) {
+		return errors.New("token is not for this client")
+	}
+	if len(c.Audience) > 1 && c.AZP != clientID {
+		return errors.New("token was issued to another party")
+	}
+	if c.Expiry == 0 || now.After(time.Unix(c.Expiry, 0).Add(jwtLeeway)) {
+		return errors.New("token has expired")
+	}
+	if c.IssuedAt != 0 && time.Unix(c.IssuedAt, 0).After(now.Add(jwtLeeway)) {
+		return errors.New("token issued in the future")
+	}
+	if c.Nonce != nonce {
+		return errors.New("nonce does not match")
+	}
+	if c.Subject == "" {
+		return errors.New("token has no subject")
+	}
+	return nil
+}
+
+// stringClaim returns a string claim, or "".
+func (c *idTokenClaims) stringClaim(name string) string {
+	s, _ := c.Raw[name].(string)
+	return s
+}
+
+// listClaim returns a claim holding a string or a list of strings.
+func (c *idTokenClaims) listClaim(name string) []string {
+	switch v := c.Raw[name].(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		list := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// LDAP and Active Directory logins. The user's password is checked by
+// binding as them, either directly with a DN built from
+// config.LDAPUserDNTemplate, or by first searching for their entry with the
+// service account in config.LDAPBindDN. Connections may use ldaps:// or
+// StartTLS. A user's groups come from config.LDAPGroupAttribute on their
+// entry (memberOf by default), and when config.LDAPAdminGroups is set each
+// login makes the user an admin exactly when they are in one of them.
+// Users are created on their first login.
+//
+// This is a minimal LDAPv3 client (RFC 4511) speaking BER itself (ber.go);
+// it supports simple binds, searches and StartTLS, nothing else.
+
+// LDAP application tags (RFC 4511 section 4.2 onwards).
+const (
+	ldapBindRequest      = 0x60
+	ldapBindResponse     = 0x61
+	ldapUnbindRequest    = 0x42
+	ldapSearchRequest    = 0x63
+	ldapSearchEntry      = 0x64
+	ldapSearchDone       = 0x65
+	ldapSearchReference  = 0x73
+	ldapExtendedRequest  = 0x77
+	ldapExtendedResponse = 0x78
+
+	ldapScopeBase    = 0
+	ldapScopeSubtree = 2
+
+	ldapResultSuccess            = 0
+	ldapResultSizeLimitExceeded  = 4
+	ldapResultInvalidCredentials = 49
+
+	ldapStartTLSOID = "1.3.6.1.4.1.1466.20037"
+)
+
+// ldapError is a non-success LDAP result.
+type ldapError struct {
+	Code    int64
+	Message string
+}
+
+func (e *ldapError) Error() string {
+	return fmt.Sprintf("ldap: result %d: %s", e.Code, e.Message)
+}
+
+type ldapEntry struct {
+	DN         string
+	Attributes map[string][]string
+}
+
+// get returns the values of an attribute, matched case-insensitively.
+func (e ldapEntry) get(name string) []string {
+	for k, v := range e.Attributes {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+	return nil
+}
+
+type ldapConn struct {
+	conn   net.Conn
+	r      *bufio.Reader
+	nextID int64
+}
+
+func ldapTLSConfig(host string) (*tls.Config, error) {
+	cfg := &tls.Config{ServerName: host, InsecureSkipVerify: config.LDAPInsecureSkipVerify}
+	if config.LDAPCAFile != "" {
+		pem, err := os.ReadFile(config.LDAPCAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", config.LDAPCAFile)
+		}
+	}
+	return cfg, nil
+}
+
+// dialLDAP connects to config.LDAPURL, upgrading with StartTLS if
+// configured. The whole exchange has to finish within config.LDAPTimeout.
+func dialLDAP() (*ldapConn, error) {
+	u, err := url.Parse(config.LDAPURL)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Hostname()
+	addr := u.Host
+	dialer := &net.Dialer{Timeout: config.LDAPTimeout}
+	var conn net.Conn
+	switch u.Scheme {
+	case "ldap":
+		if u.Port() == "" {
+			addr = net.JoinHostPort(host, "389")
+		}
+		conn, err = dialer.Dial("tcp", addr)
+	case "ldaps":
+		if u.Port() == "" {
+			addr = net.JoinHostPort(host, "636")
+		}
+		var cfg *tls.Config
+		if cfg, err = ldapTLSConfig(host); err == nil {
+			conn, err = tls.DialWithDialer(dialer, "tcp", addr, cfg)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported LDAP URL scheme %q", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(config.LDAPTimeout))
+	c := &ldapConn{conn: conn, r: bufio.NewReader(conn)}
+
+	if config.LDAPStartTLS && u.Scheme == "ldap" {
+		if _, err := c.roundTrip(berSeq(ldapExtendedRequest, berString(0x80, ldapStartTLSOID)), ldapExtendedResponse); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("StartTLS: %w", err)
+		}
+		cfg, err := ldapTLSConfig(host)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		tlsConn := tls.Client(conn, cfg)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("StartTLS: %w", err)
+		}
+		c.conn, c.r = tlsConn, bufio.NewReader(tlsConn)
+	}
+	return c, nil
+}
+
+func (c *ldapConn) close() {
+	c.nextID++
+	c.conn.Write(berSeq(berSequence, berInt(berInteger, c.nextID), berTLV(ldapUnbindRequest, nil)))
+	c.conn.Close()
+}
+
+func (c *ldapConn) send(op []byte) (int64, error) {
+	c.nextID++
+	_, err := c.conn.Write(berSeq(berSequence, berInt(berInteger, c.nextID), op))
+	return c.nextID, err
+}
+
+// receive reads the next message for id and returns its protocol op.
+func (c *ldapConn) receive(id int64) (berPacket, error) {
+	for {
+		msg, err := readBER(c.r)
+		if err != nil {
+			return berPacket{}, err
+		}
+		if msg.Tag != berSequence || len(msg.Children) < 2 {
+			return berPacket{}, errors.New("ldap: malformed message")
+		}
+		// Message ID 0 is an unsolicited notification, usually a disconnect.
+		if msgID := msg.Children[0].int(); msgID == 0 {
+			return berPacket{}, errors.New("ldap: server closed the connection")
+		} else if msgID == id {
+			return msg.Children[1], nil
+		}
+	}
+}
+
+// result checks an LDAPResult: resultCode, matchedDN, diagnosticMessage.
+func ldapResult(op berPacket) error {
+	if len(op.Children) < 3 {
+		return errors.New("ldap: malformed result")
+	}
+	if code := op.Children[0].int(); code != ldapResultSuccess {
+		return &ldapError{Code: code, Message: string(op.Children[2].Data)}
+	}
+	return nil
+}
+
+// roundTrip sends a request with a single response of type want.
+func (c *ldapConn) roundTrip(op []byte, want byte) (berPacket, error) {
+	id, err := c.send(op)
+	if err != nil {
+		return berPacket{}, err
+	}
+	resp, err := c.receive(id)
+	if err != nil {
+		return berPacket{}, err
+	}
+	if resp.Tag != want {
+		return berPacket{}, fmt.Errorf("ldap: unexpected response 0x%02x", resp.Tag)
+	}
+	return resp, ldapResult(resp)
+}
+
+// bind performs a simple bind. An empty password would be an
+// unauthenticated bind, which servers accept for any DN, so it is refused.
+func (c *ldapConn) bind(dn, password string) error {
+	if password == "" {
+		return &ldapError{Code: ldapResultInvalidCredentials, Message: "empty password"}
+	}
+	_, err := c.roundTrip(berSeq(ldapBindRequest,
+		berInt(berInteger, 3),
+		berString(berOctetString, dn),
+		berString(0x80, password),
+	), ldapBindResponse)
+	return err
+}
+
+func (c *ldapConn) search(base string, scope int64, filter string, attrs []string, limit int64) ([]ldapEntry, error) {
+	f, err := encodeFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	var attrList [][]byte
+	for _, a := range attrs {
+		attrList = append(attrList, berString(berOctetString, a))
+	}
+	id, err := c.send(berSeq(ldapSearchRequest,
+		berString(berOctetString, base),
+		berInt(berEnumerated, scope),
+		berInt(berEnumerated, 0), // never dereference aliases
+		berInt(berInteger, limit),
+		berInt(berInteger, int64(config.LDAPTimeout/time.Second)),
+		berBool(false),
+		f,
+		berSeq(berSequence, attrList...),
+	))
+	if err != nil {
+		return nil, err
+	}
+	var entries []ldapEntry
+	for {
+		op, err := c.receive(id)
+		if err != nil {
+			return nil, err
+		}
+		switch op.Tag {
+		case ldapSearchEntry:
+			if len(op.Children) < 2 {
+				return nil, errors.New("ldap: malformed search entry")
+			}
+			e := ldapEntry{DN: string(op.Children[0].Data), Attributes: map[string][]string{}}
+			for _, attr := range op.Children[1].Children {
+				if len(attr.Children) < 2 {
+					continue
+				}
+				name := string(attr.Children[0].Data)
+				for _, v := range attr.Children[1].Children {
+					e.Attributes[name] = append(e.Attributes[name], string(v.Data))
+				}
+			}
+			entries = append(entries, e)
+		case ldapSearchReference:
+			// Referrals to other servers are not followed.
+		case ldapSearchDone:
+			return entries, ldapResult(op)
+		default:
+			return nil, fmt.Errorf("ldap: unexpected response 0x%02x", op.Tag)
+		}
+	}
+}
+
+// --- Authenticator ---
+
+type ldapAuthenticator struct{}
+
+func (ldapAuthenticator) name() string { return "ldap" }
+
+func (ldapAuthenticator) authenticate(db *sql.DB, username, password string) (*User, error) {
+	if username == "" || password == "" {
+		return nil, errAuthFailed
+	}
+	entry, err := ldapLogin(username, password)
+	var lerr *ldapError
+	if errors.As(err, &lerr) && lerr.Code == ldapResultInvalidCredentials {
+		return nil, errAuthFailed
+	} else if err != nil {
+		return nil, err
+	}
+
+	// The directory's spelling of the name, so "Bob" and "bob" are one user.
+	if names := entry.get(config.LDAPUsernameAttribute); len(names) > 0 && names[0] != "" {
+		username = names[0]
+	}
+	role, managed := ldapRole(entry.get(config.LDAPGroupAttribute))
+	if entry.Attributes == nil {
+		// Unread groups are not an empty list; leave the role alone.
+		managed = false
+	}
+	return syncExternalUser(db, authSourceLDAP, username, role, managed)
+}
+
+// ldapLogin checks the password by binding as the user and returns their
+// entry. Attributes is nil if the entry could not be read.
+func ldapLogin(username, password string) (ldapEntry, error) {
+	c, err := dialLDAP()
+	if err != nil {
+		return ldapEntry{}, err
+	}
+	defer c.close()
+	attrs := []string{config.LDAPGroupAttribute, config.LDAPUsernameAttribute}
+
+	if config.LDAPUserDNTemplate != "" {
+		dn := fmt.Sprintf(config.LDAPUserDNTemplate, escapeDNValue(username))
+		if err := c.bind(dn, password); err != nil {
+			return ldapEntry{}, err
+		}
+		entries, err := c.search(dn, ldapScopeBase, "(objectClass=*)", attrs, 1)
+		if err != nil || len(entries) == 0 {
+			// Some directories hide entries from their own users; the bind
+			// alone proves the password, but Attributes stays nil since the
+			// groups are unknown.
+			return ldapEntry{DN: dn}, nil
+		}
+		return entries[0], nil
+	}
+
+	if config.LDAPBindDN != "" {
+		if err := c.bind(config.LDAPBindDN, config.LDAPBindPassword); err != nil {
+			// Not %w: a rejected service account is a misconfiguration to
+			// log, not a wrong user password.
+			return ldapEntry{}, fmt.Errorf("service account bind: %v", err)
+		}
+	}
+	filter := fmt.Sprintf(config.LDAPUserFilter, escapeFilterValue(username))
+	entries, err := c.search(config.LDAPBaseDN, ldapScopeSubtree, filter, attrs, 2)
+	var lerr *ldapError
+	if errors.As(err, &lerr) && lerr.Code == ldapResultSizeLimitExceeded {
+		err = nil
+	}
+	if err != nil {
+		return ldapEntry{}, err
+	}
+	if len(entries) != 1 {
+		// No such user, or an ambiguous filter; either way not this user.
+		return ldapEntry{}, &ldapError{Code: ldapResultInvalidCredentials, Message: fmt.Sprintf("%d entries match", len(entries))}
+	}
+	if err := c.bind(entries[0].DN, password); err != nil {
+		return ldapEntry{}, err
+	}
+	return entries[0], nil
+}
+
+// ldapRole maps group DNs to a role. A configured group matches either a
+// whole DN or its first value, so "admins" matches "cn=admins,ou=groups,...".
+func ldapRole(groups []string) (role Role, managed bool) {
+	if len(config.LDAPAdminGroups) == 0 {
+		return RoleGuest, false
+	}
+	for _, g := range groups {
+		g = strings.ToLower(g)
+		first, _, _ := strings.Cut(g, ",")
+		_, cn, _ := strings.Cut(first, "=")
+		if containsString(config.LDAPAdminGroups, g) || containsString(config.LDAPAdminGroups, cn) {
+			return RoleAdmin, true
+		}
+	}
+	return RoleGuest, true
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeLDAP is a directory speaking just enough LDAPv3 for ldapLogin: simple
+// binds, and searches with equality or presence filters.
+type fakeLDAP struct {
+	passwords map[string]string // by DN
+	entries   []ldapEntry
+	// hidden makes entries invisible to their own users, as some
+	// directories do.
+	hidden bool
+
+	mu       sync.Mutex
+	searches []string // "boundDN base" for each search
+}
+
+func startFakeLDAP(t *testing.T, f *fakeLDAP) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+
+	saved := config
+	t.Cleanup(func() { config = saved })
+	config.LDAPURL = "ldap://" + ln.Addr().String()
+	config.LDAPStartTLS = false
+	config.LDAPTimeout = 5 * time.Second
+	config.LDAPUserDNTemplate = ""
+	config.LDAPBindDN = ""
+	config.LDAPBindPassword = ""
+	config.LDAPBaseDN = "ou=people,dc=example,dc=org"
+	config.LDAPUserFilter = "(uid=%s)"
+	config.LDAPUsernameAttribute = "uid"
+	config.LDAPGroupAttribute = "memberOf"
+}
+
+func (f *fakeLDAP) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	var bound string
+	for {
+		msg, err := readBER(r)
+		if err != nil || len(msg.Children) < 2 {
+			return
+		}
+		id, op := msg.Children[0].int(), msg.Children[1]
+		reply := func(resp []byte) {
+			conn.Write(berSeq(berSequence, berInt(berInteger, id), resp))
+		}
+		result := func(tag byte, code int64, message string) {
+			reply(berSeq(tag, berInt(berEnumerated, code), berString(berOctetString, ""), berString(berOctetString, message)))
+		}
+		switch op.Tag {
+		case ldapBindRequest:
+			dn, password := string(op.Children[1].Data), string(op.Children[2].Data)
+			if want, ok := f.passwords[dn]; !ok || want != password {
+				result(ldapBindResponse, ldapResultInvalidCredentials, "invalid credentials")
+				continue
+			}
+			bound = dn
+			result(ldapBindResponse, ldapResultSuccess, "")
+		case ldapSearchRequest:
+			base, scope, filter := string(op.Children[0].Data), op.Children[1].int(), op.Children[6]
+			f.mu.Lock()
+			f.searches = append(f.searches, bound+" "+base)
+			f.mu.Unlock()
+			for _, e := range f.entries {
+				visible := !f.hidden || bound != e.DN
+				inScope := e.DN == base || (scope == ldapScopeSubtree && strings.HasSuffix(e.DN, ","+base))
+				if visible && inScope && matchFakeFilter(e, filter) {
+					reply(encodeFakeEntry(e))
+				}
+			}
+			result(ldapSearchDone, ldapResultSuccess, "")
+		case ldapUnbindRequest:
+			return
+		default:
+			return
+		}
+	}
+}
+
+func matchFakeFilter(e ldapEntry, f berPacket) bool {
+	switch f.Tag {
+	case filterPresent:
+		return strings.EqualFold(string(f.Data), "objectClass") || e.get(string(f.Data)) != nil
+	case filterEquality:
+		for _, v := range e.get(string(f.Children[0].Data)) {
+			if strings.EqualFold(v, string(f.Children[1].Data)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func encodeFakeEntry(e ldapEntry) []byte {
+	var attrs [][]byte
+	for name, values := range e.Attributes {
+		var vals [][]byte
+		for _, v := range values {
+			vals = append(vals, berString(berOctetString, v))
+		}
+		attrs = append(attrs, berSeq(berSequence, berString(berOctetString, name), berSeq(berSet, vals...)))
+	}
+	return berSeq(ldapSearchEntry, berString(berOctetString, e.DN), berSeq(berSequence, attrs...))
+}
+
+const (
+	aliceDN   = "uid=alice,ou=people,dc=example,dc=org"
+	serviceDN = "cn=prisma,dc=example,dc=org"
+)
+
+func newTestDirectory() *fakeLDAP {
+	return &fakeLDAP{
+		passwords: map[string]string{aliceDN: "wonderland", serviceDN: "service-secret"},
+		entries: []ldapEntry{{
+			DN: aliceDN,
+			Attributes: map[string][]string{
+				"uid":      {"alice"},
+				"memberOf": {"cn=admins,ou=groups,dc=example,dc=org"},
+			},
+		}},
+	}
+}
+
+func isInvalidCredentials(err error) bool {
+	var lerr *ldapError
+	return errors.As(err, &lerr) && lerr.Code == ldapResultInvalidCredentials
+}
+
+func TestLDAPLoginDNTemplate(t *testing.T) {
+	dir := newTestDirectory()
+	startFakeLDAP(t, dir)
+	config.LDAPUserDNTemplate = "uid=%s,ou=people,dc=example,dc=org"
+
+	entry, err := ldapLogin("alice", "wonderland")
+	if err != nil {
+		t.Fatalf("ldapLogin: %v", err)
+	}
+	if entry.DN != aliceDN || len(entry.get("memberOf")) != 1 {
+		t.Errorf("entry = %+v", entry)
+	}
+	if _, err := ldapLogin("alice", "wrong"); !isInvalidCredentials(err) {
+		t.Errorf("wrong password: err = %v, want invalid credentials", err)
+	}
+	if _, err := ldapLogin("alice", ""); !isInvalidCredentials(err) {
+		t.Errorf("empty password: err = %v, want invalid credentials", err)
+	}
+	// The name is escaped into the DN, so it cannot pick another entry.
+	if _, err := ldapLogin("alice,ou=people", "wonderland"); !isInvalidCredentials(err) {
+		t.Errorf("DN injection: err = %v, want invalid credentials", err)
+	}
+}
+
+func TestLDAPLoginDNTemplateHiddenEntry(t *testing.T) {
+	dir := newTestDirectory()
+	dir.hidden = true
+	startFakeLDAP(t, dir)
+	config.LDAPUserDNTemplate = "uid=%s,ou=people,dc=example,dc=org"
+
+	entry, err := ldapLogin("alice", "wonderland")
+	if err != nil {
+		t.Fatalf("ldapLogin: %v", err)
+	}
+	if entry.DN != aliceDN || entry.Attributes != nil {
+		t.Errorf("entry = %+v, want the DN alone", entry)
+	}
+}
+
+func TestLDAPLoginSearch(t *testing.T) {
+	dir := newTestDirectory()
+	startFakeLDAP(t, dir)
+	config.LDAPBindDN = serviceDN
+	config.LDAPBindPassword = "service-secret"
+
+	entry, err := ldapLogin("ALICE", "wonderland")
+	if err != nil {
+		t.Fatalf("ldapLogin: %v", err)
+	}
+	if entry.DN != aliceDN || entry.get("uid")[0] != "alice" {
+		t.Errorf("entry = %+v", entry)
+	}
+	dir.mu.Lock()
+	searches := dir.searches
+	dir.mu.Unlock()
+	if len(searches) != 1 || searches[0] != serviceDN+" "+config.LDAPBaseDN {
+		t.Errorf("searches = %q, want one as the service account", searches)
+	}
+
+	for _, tt := range []struct{ name, username, password string }{
+		{"wrong password", "alice", "wrong"},
+		{"unknown user", "bob", "wonderland"},
+		{"filter injection", "*", "wonderland"},
+	} {
+		if _, err := ldapLogin(tt.username, tt.password); !isInvalidCredentials(err) {
+			t.Errorf("%s: err = %v, want invalid credentials", tt.name, err)
+		}
+	}
+}
+
+// A rejected service account is a configuration problem to log, not a wrong
+// password, so it must not look like invalid credentials.
+func TestLDAPLoginServiceBindFailure(t *testing.T) {
+	startFakeLDAP(t, newTestDirectory())
+	config.LDAPBindDN = serviceDN
+	config.LDAPBindPassword = "stale"
+
+	_, err := ldapLogin("alice", "wonderland")
+	if err == nil || !strings.Contains(err.Error(), "service account bind") {
+		t.Fatalf("err = %v, want a service account bind error", err)
+	}
+	var lerr *ldapError
+	if errors.As(err, &lerr) {
+		t.Errorf("service bind error unwraps to %v", lerr)
+	}
+}
+
+func TestLDAPRole(t *testing.T) {
+	saved := config
+	t.Cleanup(func() { config = saved })
+
+	config.LDAPAdminGroups = nil
+	if _, managed := ldapRole([]string{"cn=admins,dc=example"}); managed {
+		t.Error("roles are managed without LDAPAdminGroups")
+	}
+
+	config.LDAPAdminGroups = []string{"admins", "cn=ops,ou=groups,dc=example"}
+	tests := []struct {
+		groups []string
+		want   Role
+	}{
+		{[]string{"cn=Admins,ou=groups,dc=example"}, RoleAdmin},
+		{[]string{"CN=ops,OU=groups,DC=example"}, RoleAdmin},
+		{[]string{"cn=users,ou=groups,dc=example"}, RoleGuest},
+		{[]string{"cn=not-admins,ou=admins,dc=example"}, RoleGuest},
+		{nil, RoleGuest},
+	}
+	for _, tt := range tests {
+		if role, managed := ldapRole(tt.groups); role != tt.want || !managed {
+			t.Errorf("ldapRole(%q) = %s, %v; want %s, true", tt.groups, role, managed, tt.want)
+		}
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Brute-force protection for password logins. Failed attempts are counted
+// per account name and per client address in login_throttle, so the counts
+// are shared by every server. Past config.LoginDelayAfter failures each
+// further attempt has to wait, twice as long each time up to
+// config.LoginDelayMax, and at the lockout thresholds the key is locked for
+// config.LoginLockoutDuration. Waiting and locked attempts are rejected
+// before the password is checked. Failures older than
+// config.LoginFailureWindow are forgotten.
+//
+// A successful login clears its account's count but not its address's, so
+// one valid account cannot be used to reset guessing at others. Rows that
+// no longer delay or lock anything are pruned hourly, and names longer than
+// maxUsernameLength are refused outright, so guessing random names cannot
+// grow the table without bound.
+
+// maxUsernameLength is the longest username, in bytes, that can be
+// registered or logged in with.
+const maxUsernameLength = 64
+
+// LoginLockout is a throttled account or address as shown to admins.
+type LoginLockout struct {
+	Username      string    `json:"username,omitempty"`
+	IP            string    `json:"ip,omitempty"`
+	Failures      int       `json:"failures"`
+	LastFailureAt time.Time `json:"last_failure_at"`
+	LockedUntil   time.Time `json:"locked_until"`
+}
+
+func accountThrottleKey(username string) string {
+	return "user:" + strings.ToLower(username)
+}
+
+func ipThrottleKey(ip string) string {
+	return "ip:" + ip
+}
+
+// loginDelay is how long after the latest failure another attempt is
+// allowed, given the number of failures.
+func loginDelay(failures int) time.Duration {
+	if failures < config.LoginDelayAfter || config.LoginDelayBase <= 0 {
+		return 0
+	}
+	delay := config.LoginDelayBase
+	for i := config.LoginDelayAfter; i < failures && delay < config.LoginDelayMax; i++ {
+		delay *= 2
+	}
+	return min(delay, config.LoginDelayMax)
+}
+
+// loginWait returns how long the client must wait before trying any of
+// keys, and whether that is because of a lockout.
+func loginWait(db *sql.DB, keys ...string) (time.Duration, bool, error) {
+	rows, err := db.Query(`
+		SELECT failures, last_failure_at, COALESCE(locked_until, 'epoch') FROM login_throttle
+		WHERE key = ANY($1) AND (locked_until > NOW() OR last_failure_at > NOW() - $2 * INTERVAL '1 second')`,
+		pq.Array(keys), config.LoginFailureWindow.Seconds())
+	if err != nil {
+		return 0, false, err
+	}
+	defer rows.Close()
+	now := time.Now()
+	var wait time.Duration
+	var locked bool
+	for rows.Next() {
+		var failures int
+		var last, lockedUntil time.Time
+		if err := rows.Scan(&failures, &last, &lockedUntil); err != nil {
+			return 0, false, err
+		}
+		if d := lockedUntil.Sub(now); d > 0 {
+			wait, locked = max(wait, d), true
+		} else if d := last.Add(loginDelay(failures)).Sub(now); d > wait {
+			wait = d
+		}
+	}
+	return wait, locked, rows.Err()
+}
+
+// recordLoginFailure counts a failure against key and locks it once it
+// reaches threshold. It reports whether this failure locked the key.
+func recordLoginFailure(db *sql.DB, key string, threshold int) (bool, error) {
+	var failures int
+	err := db.QueryRow(`
+		INSERT INTO login_throttle (key, failures, last_failure_at) VALUES ($1, 1, NOW())
+		ON CONFLICT (key) DO UPDATE SET
+			failures = CASE WHEN login_throttle.last_failure_at > NOW() - $2 * INTERVAL '1 second'
+				THEN login_throttle.failures + 1 ELSE 1 END,
+			last_failure_at = NOW()
+		RETURNING failures`, key, config.LoginFailureWindow.Seconds()).Scan(&failures)
+	if err != nil || threshold <= 0 || failures < threshold {
+		return false, err
+	}
+	// Counting starts over once the lockout ends.
+	_, err = db.Exec(`UPDATE login_throttle SET failures = 0, locked_until = $1 WHERE key = $2`,
+		time.Now().Add(config.LoginLockoutDuration), key)
+	return err == nil, err
+}
+
+// checkLoginAllowed answers the request and returns false if the client has
+// to wait before trying username again.
+func checkLoginAllowed(db *sql.DB, w http.ResponseWriter, r *http.Request, username string) bool {
+	wait, locked, err := loginWait(db, accountThrottleKey(username), ipThrottleKey(clientIP(r)))
+	if err != nil {
+		// Fail closed: without the counts nothing limits guessing.
+		log.Printf("Failed to check login throttle for '%s': %v", username, err)
+		http.Error(w, "Login temporarily unavailable", http.StatusServiceUnavailable)
+		return false
+	}
+	if wait <= 0 {
+		return true
+	}
+	detail := "throttled"
+	if locked {
+		detail = "locked"
+	}
+	recordAudit(db, r, auditLoginFailed, username, nil, detail)
+	w.Header().Set("Retry-After", fmt.Sprint(int(wait.Seconds()+1)))
+	if locked {
+		http.Error(w, "Too many failed attempts; try again later", http.StatusTooManyRequests)
+	} else {
+		http.Error(w, "Too many failed attempts; slow down", http.StatusTooManyRequests)
+	}
+	return false
+}
+
+// loginFailed records a failed attempt, such as a wrong password, for
+// username.
+func loginFailed(db *sql.DB, r *http.Request, username, reason string) {
+	ip := clientIP(r)
+	log.Printf("Login failed for '%s' from %s", username, ip)
+	recordAudit(db, r, auditLoginFailed, username, nil, reason)
+	if locked, err := recordLoginFailure(db, accountThrottleKey(username), config.LoginLockoutThreshold); err != nil {
+		log.Printf("Failed to record login failure for '%s': %v", username, err)
+	} else if locked {
+		log.Printf("Locked logins for '%s' for %s", username, config.LoginLockoutDuration)
+		recordAudit(db, r, auditLoginLocked, username, nil, "account")
+	}
+	if locked, err := recordLoginFailure(db, ipThrottleKey(ip), config.LoginIPLockoutThreshold); err != nil {
+		log.Printf("Failed to record login failure from %s: %v", ip, err)
+	} else if locked {
+		log.Printf("Locked logins from %s for %s", ip, config.LoginLockoutDuration)
+		recordAudit(db, r, auditLoginLocked, username, nil, "address "+ip)
+	}
+}
+
+// pruneLoginThrottle forgets failures that no longer count and lockouts
+// that have ended.
+func pruneLoginThrottle(db *sql.DB) (int64, error) {
+	res, err := db.Exec(`
+		DELETE FROM login_throttle
+		WHERE last_failure_at < NOW() - $1 * INTERVAL '1 second' AND (locked_until IS NULL OR locked_until < NOW())`,
+		config.LoginFailureWindow.Seconds())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// runLoginThrottleCleanup prunes login_throttle periodically.
+func runLoginThrottleCleanup(db *sql.DB) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		if n, err := pruneLoginThrottle(db); err != nil {
+			log.Printf("Failed to prune login throttle: %v", err)
+		} else if n > 0 {
+			log.Printf("Pruned %d expired login throttle entries", n)
+		}
+		<-ticker.C
+	}
+}
+
+// loginSucceeded clears the account's failures and records the login.
+func loginSucceeded(db *sql.DB, r *http.Request, user *User) {
+	db.Exec(`DELETE FROM login_throttle WHERE key = $1`, accountThrottleKey(user.Username))
+	recordAudit(db, r, auditLoginSucceeded, user.Username, nil, "")
+}
+
+// --- Handlers ---
+
+// listLockoutsHandler lists accounts and addresses that are currently
+// locked or being delayed.
+func listLockoutsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isAdmin(userFromContext(r.Context())) {
+			http.Error(w, "Admin access required", http.StatusForbidden)
+			return
+		}
+		rows, err := db.Query(`
+			SELECT key, failures, last_failure_at, COALESCE(locked_until, 'epoch') FROM login_throttle
+			WHERE locked_until > NOW() OR (failures >= $1 AND last_failure_at > NOW() - $2 * INTERVAL '1 second')
+			ORDER BY last_failure_at DESC`, config.LoginDelayAfter, config.LoginFailureWindow.Seconds())
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+		lockouts := []LoginLockout{}
+		for rows.Next() {
+			var l LoginLockout
+			var key string
+			if err := rows.Scan(&key, &l.Failures, &l.LastFailureAt, &l.LockedUntil); err != nil {
+				continue
+			}
+			if name, ok := strings.CutPrefix(key, "user:"); ok {
+				l.Username = name
+			} else {
+				l.IP = strings.TrimPrefix(key, "ip:")
+			}
+			lockouts = append(lockouts, l)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(lockouts)
+	}
+}
+
+// unlockLoginHandler clears the failures and lockout of an account
+// ({"username": ...}) or an address ({"ip": ...}).
+func unlockLoginHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		admin := userFromContext(r.Context())
+		if !isAdmin(admin) {
+			http.Error(w, "Admin access required", http.StatusForbidden)
+			return
+		}
+		var req struct {
+			Username string `json:"username"`
+			IP       string `json:"ip"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		var key, detail string
+		switch {
+		case req.Username != "":
+			key, detail = accountThrottleKey(req.Username), "account"
+		case net.ParseIP(req.IP) != nil:
+			ip := net.ParseIP(req.IP).String()
+			key, detail = ipThrottleKey(ip), "address "+ip
+		default:
+			http.Error(w, "Pass a username or an IP address", http.StatusBadRequest)
+			return
+		}
+		res, err := db.Exec(`DELETE FROM login_throttle WHERE key = $1`, key)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "Not locked", http.StatusNotFound)
+			return
+		}
+		log.Printf("User %d unlocked logins for %s", admin.ID, key)
+		recordAudit(db, r, auditLoginUnlocked, req.Username, admin, detail)
+		w.WriteHeader(http.StatusOK)
+	}
+}
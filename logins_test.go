@@ -0,0 +1,73 @@
+package main
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoginDelay(t *testing.T) {
+	saved := config
+	t.Cleanup(func() { config = saved })
+	config.LoginDelayAfter = 3
+	config.LoginDelayBase = time.Second
+	config.LoginDelayMax = 30 * time.Second
+
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 0},
+		{2, 0},
+		{3, time.Second},
+		{4, 2 * time.Second},
+		{5, 4 * time.Second},
+		{7, 16 * time.Second},
+		{8, 30 * time.Second},
+		{1000, 30 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := loginDelay(tt.failures); got != tt.want {
+			t.Errorf("loginDelay(%d) = %s, want %s", tt.failures, got, tt.want)
+		}
+	}
+
+	config.LoginDelayBase = 0
+	if got := loginDelay(10); got != 0 {
+		t.Errorf("loginDelay with no base = %s, want 0", got)
+	}
+}
+
+func TestPruneLoginThrottle(t *testing.T) {
+	db, f := newFakeDB(t, func(query string, args []driver.Value) (fakeResult, error) {
+		return fakeResult{affected: 4}, nil
+	})
+	n, err := pruneLoginThrottle(db)
+	if err != nil || n != 4 {
+		t.Fatalf("pruneLoginThrottle = %d, %v", n, err)
+	}
+	// Only rows that neither delay nor lock anything may go.
+	for _, cond := range []string{"last_failure_at < NOW()", "locked_until IS NULL OR locked_until < NOW()"} {
+		if !f.ran(cond) {
+			t.Errorf("prune query lacks %q: %q", cond, f.queries)
+		}
+	}
+}
+
+// Names no account can have are refused before the throttle is consulted,
+// so they never reach login_throttle; the handler runs without a database.
+func TestLoginRefusesOverlongUsernames(t *testing.T) {
+	saved := config
+	t.Cleanup(func() { config = saved })
+	config.PasswordLogin = true
+
+	body := `{"username":"` + strings.Repeat("a", maxUsernameLength+1) + `","password":"secret"}`
+	rec := httptest.NewRecorder()
+	loginHandler(nil)(rec, httptest.NewRequest(http.MethodPost, "/api/login", strings.NewReader(body)))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("login = %d, want 401", rec.Code)
+	}
+}
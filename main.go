@@ -19,15 +19,28 @@ func main() {
 	hub := newHub()
 	go hub.run()
 
-	r := mux.NewRouter()
-	registerRoutes(r, db, hub)
+	blobs := newBlobStore()
+	go runResumableUploadCleanup(db, blobs)
+
+	gc := newUploadGC(db, blobs)
+	go gc.runScheduled()
+
+	scans := newUploadScanner(db, blobs, hub, newScanner())
+	go scans.run()
 
-	// Serve uploads (avatars, files, etc) before the web handler
-	r.PathPrefix("/uploads/").Handler(http.StripPrefix("/uploads/", http.FileServer(http.Dir("uploads"))))
+	unfurler := newLinkUnfurler(db, hub)
+	unfurler.start()
+
+	go newOutgoingDispatcher(db).run()
+	go runReminders(db, hub)
+	go runLoginThrottleCleanup(db)
+
+	r := mux.NewRouter()
+	registerRoutes(r, db, hub, blobs, gc, scans, unfurler, newImageProxy(db, blobs), newOIDCProvider())
 
 	// Catch-all: Serve Flutter web build from the "web" folder for any other route
 	r.PathPrefix("/").Handler(serveWebApp())
 
 	log.Println("Server started at :8081")
 	log.Fatal(http.ListenAndServe(":8081", r))
-}
\ No newline at end of file
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/lib/pq"
+)
+
+// Message formatting. Content is parsed into a small, stable AST that is sent
+// alongside the raw text as content_ast, plus the same tree rendered to
+// sanitized HTML as content_html, so every client formats identically.
+//
+// The dialect:
+//
+//	**bold**  *italic* or _italic_  ||spoiler||  `code`
+//	```lang         fenced code block, language optional
+//	...
+//	```
+//	> quote         consecutive quoted lines form one block
+//	[text](https://example.com)  and bare http(s) URLs
+//	@username       mention of an existing user
+//	:name:          custom emoji shortcode
+//	\*              escapes a markup character
+//
+// Block nodes are "paragraph", "code_block" and "quote". Inline nodes are
+// "text", "bold", "italic", "spoiler", "code", "link", "mention", "emoji"
+// and "line_break".
+
+const maxMarkdownDepth = 8
+
+var (
+	codeLanguagePattern = regexp.MustCompile(`^[A-Za-z0-9_+#.-]{0,32}$`)
+	mentionPattern      = regexp.MustCompile(`^@([A-Za-z0-9_.-]{1,64})`)
+	emojiPattern        = regexp.MustCompile(`^:([A-Za-z0-9_]{2,32}):`)
+	maskedLinkPattern   = regexp.MustCompile(`^\[([^\[\]\n]+)\]\((https?://[^\s()]+)\)`)
+)
+
+// parseMarkdown parses message content into block nodes. Mentions and emoji
+// are left unresolved; see resolveMentions and resolveEmoji.
+func parseMarkdown(content string) []MarkdownNode {
+	return parseBlocks(strings.ReplaceAll(content, "\r\n", "\n"), 0)
+}
+
+func parseBlocks(content string, depth int) []MarkdownNode {
+	nodes := []MarkdownNode{}
+	lines := strings.Split(content, "\n")
+	var paragraph []string
+	flush := func() {
+		if len(paragraph) > 0 {
+			text := strings.Join(paragraph, "\n")
+			nodes = append(nodes, MarkdownNode{Type: "paragraph", Children: parseInline(text, depth)})
+			paragraph = nil
+		}
+	}
+
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		trimmed := strings.TrimSpace(line)
+
+		if strings.HasPrefix(trimmed, "```") && depth < maxMarkdownDepth {
+			language := strings.TrimSpace(strings.TrimPrefix(trimmed, "```"))
+			if end := findFenceEnd(lines, i+1); end >= 0 && codeLanguagePattern.MatchString(language) {
+				flush()
+				nodes = append(nodes, MarkdownNode{
+					Type:     "code_block",
+					Language: strings.ToLower(language),
+					Text:     strings.Join(lines[i+1:end], "\n"),
+				})
+				i = end
+				continue
+			}
+		}
+
+		if strings.HasPrefix(line, ">") && depth < maxMarkdownDepth {
+			flush()
+			var quoted []string
+			for ; i < len(lines) && strings.HasPrefix(lines[i], ">"); i++ {
+				quoted = append(quoted, strings.TrimPrefix(strings.TrimPrefix(lines[i], ">"), " "))
+			}
+			i--
+			nodes = append(nodes, MarkdownNode{Type: "quote", Children: parseBlocks(strings.Join(quoted, "\n"), depth+1)})
+			continue
+		}
+
+		if trimmed == "" {
+			flush()
+			continue
+		}
+		paragraph = append(paragraph, line)
+	}
+	flush()
+	return nodes
+}
+
+func findFenceEnd(lines []string, from int) int {
+	for j := from; j < len(lines); j++ {
+		if strings.TrimSpace(lines[j]) == "```" {
+			return j
+		}
+	}
+	return -1
+}
+
+// parseInline parses inline markup. Delimiters without a matching closer are
+// kept as plain text.
+func parseInline(s string, depth int) []MarkdownNode {
+	var nodes []MarkdownNode
+	var text strings.Builder
+	emit := func(n MarkdownNode) {
+		if text.Len() > 0 {
+			nodes = append(nodes, MarkdownNode{Type: "text", Text: text.String()})
+			text.Reset()
+		}
+		nodes = append(nodes, n)
+	}
+	// wrap parses s[i+len(delim):] up to the next delim as a container node.
+	wrap := func(i int, delim, nodeType string) (int, bool) {
+		if depth >= maxMarkdownDepth {
+			return 0, false
+		}
+		start := i + len(delim)
+		end := strings.Index(s[start:], delim)
+		if end <= 0 || strings.TrimSpace(s[start:start+end]) == "" {
+			return 0, false
+		}
+		emit(MarkdownNode{Type: nodeType, Children: parseInline(s[start:start+end], depth+1)})
+		return start + end + len(delim), true
+	}
+
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s) && strings.IndexByte("\\`*_|~[]()<>@:", s[i+1]) >= 0:
+			text.WriteByte(s[i+1])
+			i += 2
+			continue
+
+		case c == '\n':
+			emit(MarkdownNode{Type: "line_break"})
+			i++
+			continue
+
+		case c == '`':
+			run := len(s[i:]) - len(strings.TrimLeft(s[i:], "`"))
+			delim := s[i : i+run]
+			if end := strings.Index(s[i+run:], delim); end > 0 {
+				code := s[i+run : i+run+end]
+				if len(code) > 2 && code[0] == ' ' && code[len(code)-1] == ' ' {
+					code = code[1 : len(code)-1]
+				}
+				emit(MarkdownNode{Type: "code", Text: code})
+				i += run + end + run
+				continue
+			}
+			text.WriteString(delim)
+			i += run
+			continue
+
+		case strings.HasPrefix(s[i:], "**"):
+			if next, ok := wrap(i, "**", "bold"); ok {
+				i = next
+				continue
+			}
+
+		case strings.HasPrefix(s[i:], "||"):
+			if next, ok := wrap(i, "||", "spoiler"); ok {
+				i = next
+				continue
+			}
+
+		case c == '*':
+			if next, ok := wrap(i, "*", "italic"); ok {
+				i = next
+				continue
+			}
+
+		case c == '_' && !isWordCharBefore(s, i):
+			// Underscores inside words (snake_case) are not emphasis.
+			if end := strings.Index(s[i+1:], "_"); end > 0 && !isWordCharAt(s, i+1+end+1) {
+				if next, ok := wrap(i, "_", "italic"); ok {
+					i = next
+					continue
+				}
+			}
+
+		case c == '[':
+			if m := maskedLinkPattern.FindStringSubmatch(s[i:]); m != nil && depth < maxMarkdownDepth {
+				emit(MarkdownNode{Type: "link", URL: m[2], Children: parseInline(m[1], depth+1)})
+				i += len(m[0])
+				continue
+			}
+
+		case c == '<' && (strings.HasPrefix(s[i+1:], "http://") || strings.HasPrefix(s[i+1:], "https://")):
+			if end := strings.IndexAny(s[i+1:], "> \n"); end > 0 && s[i+1+end] == '>' {
+				link := s[i+1 : i+1+end]
+				if isHTTPURL(link) {
+					emit(MarkdownNode{Type: "link", URL: link, Children: []MarkdownNode{{Type: "text", Text: link}}})
+					i += end + 2
+					continue
+				}
+			}
+
+		case (c == 'h' || c == 'H') && !isWordCharBefore(s, i):
+			if loc := linkPattern.FindStringIndex(s[i:]); loc != nil && loc[0] == 0 {
+				link := trimLinkPunctuation(s[i : i+loc[1]])
+				if isHTTPURL(link) {
+					emit(MarkdownNode{Type: "link", URL: link, Children: []MarkdownNode{{Type: "text", Text: link}}})
+					i += len(link)
+					continue
+				}
+			}
+
+		case c == '@' && !isWordCharBefore(s, i):
+			if m := mentionPattern.FindStringSubmatch(s[i:]); m != nil {
+				username := strings.TrimRight(m[1], ".-")
+				emit(MarkdownNode{Type: "mention", Username: username})
+				i += 1 + len(username)
+				continue
+			}
+
+		case c == ':':
+			if m := emojiPattern.FindStringSubmatch(s[i:]); m != nil {
+				emit(MarkdownNode{Type: "emoji", Name: m[1]})
+				i += len(m[0])
+				continue
+			}
+		}
+
+		_, size := utf8.DecodeRuneInString(s[i:])
+		text.WriteString(s[i : i+size])
+		i += size
+	}
+	if text.Len() > 0 {
+		nodes = append(nodes, MarkdownNode{Type: "text", Text: text.String()})
+	}
+	return nodes
+}
+
+func isWordCharBefore(s string, i int) bool {
+	if i == 0 {
+		return false
+	}
+	r, _ := utf8.DecodeLastRuneInString(s[:i])
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+func isWordCharAt(s string, i int) bool {
+	if i >= len(s) {
+		return false
+	}
+	r, _ := utf8.DecodeRuneInString(s[i:])
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// walkMarkdown calls fn for every node in the tree, depth first.
+func walkMarkdown(nodes []MarkdownNode, fn func(*MarkdownNode)) {
+	for i := range nodes {
+		fn(&nodes[i])
+		walkMarkdown(nodes[i].Children, fn)
+	}
+}
+
+// resolveMentions fills in UserID for mentions of existing users and turns
+// the rest back into plain text.
+func resolveMentions(db *sql.DB, trees [][]MarkdownNode) error {
+	var names []string
+	for _, tree := range trees {
+		walkMarkdown(tree, func(n *MarkdownNode) {
+			if n.Type == "mention" {
+				names = append(names, n.Username)
+			}
+		})
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	users := make(map[string]int64)
+	rows, err := db.Query(`SELECT id, username FROM users WHERE username = ANY($1)`, pq.Array(names))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var username string
+		if err := rows.Scan(&id, &username); err == nil {
+			users[username] = id
+		}
+	}
+	for _, tree := range trees {
+		walkMarkdown(tree, func(n *MarkdownNode) {
+			if n.Type != "mention" {
+				return
+			}
+			if id, ok := users[n.Username]; ok {
+				n.UserID = id
+			} else {
+				*n = MarkdownNode{Type: "text", Text: "@" + n.Username}
+			}
+		})
+	}
+	return rows.Err()
+}
+
+var inlineHTMLTags = map[string][2]string{
+	"bold":    {"<strong>", "</strong>"},
+	"italic":  {"<em>", "</em>"},
+	"spoiler": {`<span class="spoiler">`, "</span>"},
+}
+
+// renderMarkdownHTML renders a tree as HTML. All text is escaped and only
+// http(s) links are emitted, so the output is safe to insert into a page.
+func renderMarkdownHTML(nodes []MarkdownNode) string {
+	var b strings.Builder
+	renderNodes(&b, nodes)
+	return b.String()
+}
+
+func renderNodes(b *strings.Builder, nodes []MarkdownNode) {
+	for _, n := range nodes {
+		switch n.Type {
+		case "paragraph":
+			b.WriteString("<p>")
+			renderNodes(b, n.Children)
+			b.WriteString("</p>")
+		case "quote":
+			b.WriteString("<blockquote>")
+			renderNodes(b, n.Children)
+			b.WriteString("</blockquote>")
+		case "code_block":
+			if n.Language != "" {
+				fmt.Fprintf(b, `<pre><code class="language-%s">`, html.EscapeString(n.Language))
+			} else {
+				b.WriteString("<pre><code>")
+			}
+			b.WriteString(html.EscapeString(n.Text))
+			b.WriteString("</code></pre>")
+		case "bold", "italic", "spoiler":
+			tags := inlineHTMLTags[n.Type]
+			b.WriteString(tags[0])
+			renderNodes(b, n.Children)
+			b.WriteString(tags[1])
+		case "code":
+			b.WriteString("<code>")
+			b.WriteString(html.EscapeString(n.Text))
+			b.WriteString("</code>")
+		case "link":
+			if !isHTTPURL(n.URL) {
+				renderNodes(b, n.Children)
+				continue
+			}
+			fmt.Fprintf(b, `<a href="%s" rel="noopener noreferrer nofollow" target="_blank">`, html.EscapeString(n.URL))
+			renderNodes(b, n.Children)
+			b.WriteString("</a>")
+		case "mention":
+			fmt.Fprintf(b, `<span class="mention" data-user-id="%d">@%s</span>`, n.UserID, html.EscapeString(n.Username))
+		case "emoji":
+			fmt.Fprintf(b, `<img class="emoji" src="%s" alt=":%s:" title=":%s:" data-emoji-id="%d">`,
+				html.EscapeString(n.URL), html.EscapeString(n.Name), html.EscapeString(n.Name), n.EmojiID)
+		case "line_break":
+			b.WriteString("<br>")
+		default:
+			b.WriteString(html.EscapeString(n.Text))
+		}
+	}
+}
+
+// renderMessageContent sets ContentAST and ContentHTML on each message.
+func renderMessageContent(db *sql.DB, messages []Message) error {
+	trees := make([][]MarkdownNode, len(messages))
+	for i := range messages {
+		trees[i] = parseMarkdown(messages[i].Content)
+	}
+	if err := resolveMentions(db, trees); err != nil {
+		return err
+	}
+	if err := resolveEmoji(db, trees); err != nil {
+		return err
+	}
+	for i := range messages {
+		messages[i].ContentAST = trees[i]
+		messages[i].ContentHTML = renderMarkdownHTML(trees[i])
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+const testLinkAttrs = ` rel="noopener noreferrer nofollow" target="_blank"`
+
+func TestRenderMarkdownHTML(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"plain", "hello", "<p>hello</p>"},
+		{"script tag", "<script>alert(1)</script>", "<p>&lt;script&gt;alert(1)&lt;/script&gt;</p>"},
+		{"entities", `a & b "c" 'd'`, "<p>a &amp; b &#34;c&#34; &#39;d&#39;</p>"},
+		{"markup around html", "**<b>x</b>**", "<p><strong>&lt;b&gt;x&lt;/b&gt;</strong></p>"},
+		{"inline code", "`<i>` and ``a`b``", "<p><code>&lt;i&gt;</code> and <code>a`b</code></p>"},
+		{"code block", "```go\n<x> && y\n```", `<pre><code class="language-go">&lt;x&gt; &amp;&amp; y</code></pre>`},
+		{"code block language must be a word", "```x\"onclick\ny\n```", "<p><code>x&#34;onclick\ny\n</code></p>"},
+		{"quote", "> hi\n> <b>", "<blockquote><p>hi<br>&lt;b&gt;</p></blockquote>"},
+		{"bold italic spoiler", "**b** *i* _u_ ||s||", `<p><strong>b</strong> <em>i</em> <em>u</em> <span class="spoiler">s</span></p>`},
+		{"masked link", "[**x**](https://example.com/a)", `<p><a href="https://example.com/a"` + testLinkAttrs + `><strong>x</strong></a></p>`},
+		{"quote in link URL", `[x](https://example.com/"onmouseover="alert)`,
+			`<p><a href="https://example.com/&#34;onmouseover=&#34;alert"` + testLinkAttrs + `>x</a></p>`},
+		{"javascript masked link", "[x](javascript:alert(1))", "<p>[x](javascript:alert(1))</p>"},
+		{"data masked link", "[x](data:text/html,hi)", "<p>[x](data:text/html,hi)</p>"},
+		{"javascript angle link", "<javascript:alert(1)>", "<p>&lt;javascript:alert(1)&gt;</p>"},
+		{"angle link", "<https://example.com/>", `<p><a href="https://example.com/"` + testLinkAttrs + `>https://example.com/</a></p>`},
+		{"bare link", "see https://example.com/a_b.", `<p>see <a href="https://example.com/a_b"` + testLinkAttrs + `>https://example.com/a_b</a>.</p>`},
+		{"bare link stops at a quote", `https://example.com/"x`, `<p><a href="https://example.com/"` + testLinkAttrs + `>https://example.com/</a>&#34;x</p>`},
+		{"snake_case", "call snake_case_name now", "<p>call snake_case_name now</p>"},
+		{"underscores around a word", "(_italic_) _a_b_", "<p>(<em>italic</em>) _a_b_</p>"},
+		{"escaped delimiters", `\*not\* \_em\_ \|\|x\|\| \` + "`c\\`", "<p>*not* _em_ ||x|| `c`</p>"},
+		{"escaped backslash", `\\*i*`, `<p>\<em>i</em></p>`},
+		{"unmatched delimiters", "**a ||b `c [d](", "<p>**a ||b `c [d](</p>"},
+		{"empty emphasis", "** ** __", "<p>** ** __</p>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := renderMarkdownHTML(parseMarkdown(tt.in)); got != tt.want {
+				t.Errorf("render(%q)\n got %s\nwant %s", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseMarkdownMentionsAndEmoji(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string // JSON of the first paragraph's children
+	}{
+		{"@bob hi", `[{"type":"mention","username":"bob"},{"type":"text","text":" hi"}]`},
+		{"@bob.", `[{"type":"mention","username":"bob"},{"type":"text","text":"."}]`},
+		{"mail@example.com", `[{"type":"text","text":"mail@example.com"}]`},
+		{`\@bob`, `[{"type":"text","text":"@bob"}]`},
+		{":wave: :x:", `[{"type":"emoji","name":"wave"},{"type":"text","text":" :x:"}]`},
+	}
+	for _, tt := range tests {
+		nodes := parseMarkdown(tt.in)
+		if len(nodes) != 1 {
+			t.Errorf("parse(%q) = %d blocks", tt.in, len(nodes))
+			continue
+		}
+		got, _ := json.Marshal(nodes[0].Children)
+		if string(got) != tt.want {
+			t.Errorf("parse(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+// markdownDepth is the deepest nesting of nodes in a tree.
+func markdownDepth(nodes []MarkdownNode) int {
+	depth := 0
+	for _, n := range nodes {
+		depth = max(depth, 1+markdownDepth(n.Children))
+	}
+	return depth
+}
+
+func TestMarkdownDepthIsCapped(t *testing.T) {
+	tests := []struct {
+		name, in string
+	}{
+		{"quotes", strings.Repeat(">", 100) + " **x** ||y||"},
+		{"quotes with spaces", strings.Repeat("> ", 100) + "[*x*](https://example.com)"},
+		{"mixed inline", strings.Repeat("**||*_[", 50) + "x"},
+		{"quoted inline", strings.Repeat(">", maxMarkdownDepth-1) + "**||*[_x_](https://example.com)*||**"},
+	}
+	// Quotes and inline containers share one depth budget. A paragraph, an
+	// autolink (which never nests) and its text can come on top of it.
+	const limit = maxMarkdownDepth + 3
+	for _, tt := range tests {
+		nodes := parseMarkdown(tt.in)
+		if d := markdownDepth(nodes); d > limit {
+			t.Errorf("%s: depth %d, want at most %d", tt.name, d, limit)
+		}
+		if html := renderMarkdownHTML(nodes); strings.Count(html, "<blockquote>") > maxMarkdownDepth {
+			t.Errorf("%s: %d nested quotes", tt.name, strings.Count(html, "<blockquote>"))
+		}
+	}
+
+	// Past the cap the rest of the line is kept as text.
+	nodes := parseMarkdown(strings.Repeat(">", maxMarkdownDepth+2) + "x")
+	for i := 0; i < maxMarkdownDepth; i++ {
+		if len(nodes) != 1 || nodes[0].Type != "quote" {
+			t.Fatalf("level %d = %+v, want one quote", i, nodes)
+		}
+		nodes = nodes[0].Children
+	}
+	if got := renderMarkdownHTML(nodes); got != "<p>&gt;&gt;x</p>" {
+		t.Errorf("innermost = %s", got)
+	}
+}
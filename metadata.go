@@ -0,0 +1,452 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+)
+
+// Image metadata handling, selected by PRISMA_IMAGE_METADATA:
+//
+//	strip    drop EXIF, XMP, IPTC, comments and text chunks, keeping the
+//	         pixels byte-for-byte (the default)
+//	reencode decode and re-encode JPEG and PNG images, which drops everything
+//	         but the pixels and colour profile
+//	keep     store images exactly as uploaded
+//
+// Stripping removes the EXIF orientation tag, so JPEG and PNG images that
+// carry a non-default orientation are always rotated and re-encoded instead.
+const (
+	imageMetadataStrip    = "strip"
+	imageMetadataReencode = "reencode"
+	imageMetadataKeep     = "keep"
+)
+
+// orientationScanLen is how much of a file is searched for an EXIF
+// orientation tag. APP1 segments are limited to 64KB and come first.
+const orientationScanLen = 128 << 10
+
+var errMalformedImage = errors.New("malformed image")
+
+// sanitizeImageFile rewrites f with metadata removed according to
+// config.ImageMetadata. It returns the new contents, or nil when the file was
+// left untouched.
+func sanitizeImageFile(f *os.File, filetype string) ([]byte, error) {
+	if config.ImageMetadata == imageMetadataKeep {
+		return nil, nil
+	}
+	switch filetype {
+	case "image/jpeg", "image/png", "image/gif":
+	default:
+		return nil, nil
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	clean, err := sanitizeImage(data, filetype, config.ImageMetadata == imageMetadataReencode)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(clean, data) {
+		return nil, nil
+	}
+	if err := f.Truncate(0); err != nil {
+		return nil, err
+	}
+	if _, err := f.WriteAt(clean, 0); err != nil {
+		return nil, err
+	}
+	return clean, nil
+}
+
+// sanitizeImage returns data without metadata. GIFs are always stripped
+// block by block since re-encoding would lose animation timing details.
+func sanitizeImage(data []byte, filetype string, reencode bool) ([]byte, error) {
+	switch filetype {
+	case "image/jpeg":
+		clean, orientation, icc, err := stripJPEG(data)
+		if err == nil && !reencode && orientation <= 1 {
+			return clean, nil
+		}
+		// Files the stripper cannot parse are re-encoded if they decode.
+		img, derr := decodeUpright(data, clean, orientation)
+		if derr != nil {
+			return nil, firstError(err, derr)
+		}
+		if err != nil {
+			icc = nil
+		}
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90}); err != nil {
+			return nil, err
+		}
+		// Put the colour profile back right after SOI.
+		out := buf.Bytes()
+		return append(append(append([]byte{}, out[:2]...), icc...), out[2:]...), nil
+	case "image/png":
+		clean, orientation, err := stripPNG(data)
+		if err == nil && !reencode && orientation <= 1 {
+			return clean, nil
+		}
+		img, derr := decodeUpright(data, clean, orientation)
+		if derr != nil {
+			return nil, firstError(err, derr)
+		}
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case "image/gif":
+		clean, err := stripGIF(data)
+		if err != nil {
+			// Re-encoding would lose animation; keep a GIF that decodes as is.
+			if _, _, derr := decodeImage(bytes.NewReader(data)); derr == nil {
+				return data, nil
+			}
+		}
+		return clean, err
+	}
+	return data, nil
+}
+
+// decodeUpright decodes an image for re-encoding. Files Go cannot decode as
+// uploaded, such as a JPEG missing EOI, are decoded from their repaired
+// stripped copy, whose orientation tag is gone and is applied here instead.
+func decodeUpright(data, clean []byte, orientation int) (image.Image, error) {
+	img, _, err := decodeImage(bytes.NewReader(data))
+	if err != nil && clean != nil {
+		if img, _, err = decodeImage(bytes.NewReader(clean)); err == nil {
+			img = applyOrientation(img, orientation)
+		}
+	}
+	return img, err
+}
+
+func firstError(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// imageOrientation returns the EXIF orientation (1-8) found in the start of
+// a JPEG or PNG file, or 1 when there is none. Truncated input is fine.
+func imageOrientation(head []byte, format string) int {
+	var orientation int
+	switch format {
+	case "jpeg":
+		_, orientation, _, _ = stripJPEG(head)
+	case "png":
+		_, orientation, _ = stripPNG(head)
+	}
+	if orientation < 1 || orientation > 8 {
+		return 1
+	}
+	return orientation
+}
+
+// --- JPEG ---
+
+// stripJPEG removes APPn and COM segments other than JFIF, the ICC profile
+// and the Adobe colour transform marker, and anything after EOI. It also
+// returns the EXIF orientation and the ICC profile segments. A missing EOI
+// marker is restored. On malformed input the orientation found so far is
+// still returned.
+func stripJPEG(data []byte) (clean []byte, orientation int, icc []byte, err error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, 0, nil, errMalformedImage
+	}
+	out := make([]byte, 0, len(data))
+	out = append(out, 0xFF, 0xD8)
+	i := 2
+	for i < len(data) {
+		if data[i] != 0xFF {
+			return nil, orientation, icc, errMalformedImage
+		}
+		start := i
+		for i < len(data) && data[i] == 0xFF {
+			i++
+		}
+		if i >= len(data) {
+			return nil, orientation, icc, errMalformedImage
+		}
+		marker := data[i]
+		i++
+		if marker == 0xD9 { // EOI
+			out = append(out, 0xFF, 0xD9)
+			return out, orientation, icc, nil
+		}
+		if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) {
+			out = append(out, 0xFF, marker)
+			continue
+		}
+		if i+2 > len(data) {
+			return nil, orientation, icc, errMalformedImage
+		}
+		length := int(binary.BigEndian.Uint16(data[i:]))
+		if length < 2 || i+length > len(data) {
+			return nil, orientation, icc, errMalformedImage
+		}
+		payload := data[i+2 : i+length]
+		segment := data[start : i+length]
+		i += length
+
+		switch {
+		case marker == 0xE1 && bytes.HasPrefix(payload, []byte("Exif\x00\x00")):
+			if o := exifOrientation(payload[6:]); o != 0 {
+				orientation = o
+			}
+			continue
+		case marker == 0xE0 && bytes.HasPrefix(payload, []byte("JFIF\x00")):
+		case marker == 0xE2 && bytes.HasPrefix(payload, []byte("ICC_PROFILE\x00")):
+			icc = append(icc, 0xFF, marker)
+			icc = append(icc, data[i-length:i]...)
+		case marker == 0xEE && bytes.HasPrefix(payload, []byte("Adobe")):
+		case marker >= 0xE0 && marker <= 0xEF, marker == 0xFE:
+			continue
+		}
+		out = append(out, 0xFF, marker)
+		out = append(out, segment[len(segment)-length:]...)
+
+		if marker == 0xDA { // SOS: copy entropy-coded data up to the next marker
+			j := i
+			for j+1 < len(data) {
+				if data[j] == 0xFF && data[j+1] != 0x00 && (data[j+1] < 0xD0 || data[j+1] > 0xD7) {
+					break
+				}
+				j++
+			}
+			if j+1 >= len(data) {
+				// Scan data running to the end of the file is a JPEG that
+				// lost its EOI marker; decoders accept those once it is
+				// put back.
+				out = append(out, data[i:]...)
+				out = append(out, 0xFF, 0xD9)
+				return out, orientation, icc, nil
+			}
+			out = append(out, data[i:j]...)
+			i = j
+		}
+	}
+	return nil, orientation, icc, errMalformedImage
+}
+
+// exifOrientation reads tag 0x0112 from IFD0 of a TIFF-structured EXIF block.
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 0
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+	if order.Uint16(tiff[2:]) != 42 {
+		return 0
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 0
+	}
+	count := int(order.Uint16(tiff[ifd:]))
+	for k := 0; k < count; k++ {
+		entry := ifd + 2 + k*12
+		if entry+12 > len(tiff) {
+			return 0
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 && order.Uint16(tiff[entry+2:]) == 3 {
+			return int(order.Uint16(tiff[entry+8:]))
+		}
+	}
+	return 0
+}
+
+// --- PNG ---
+
+var (
+	pngSignature = []byte("\x89PNG\r\n\x1a\n")
+	pngIEND      = []byte("\x00\x00\x00\x00IEND\xae\x42\x60\x82")
+)
+
+// pngMetadataChunks are dropped when stripping.
+var pngMetadataChunks = map[string]bool{"tEXt": true, "zTXt": true, "iTXt": true, "eXIf": true, "tIME": true}
+
+// stripPNG removes text, time and EXIF chunks and anything after IEND,
+// restoring IEND if it is missing, and returns the EXIF orientation.
+func stripPNG(data []byte) (clean []byte, orientation int, err error) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil, 0, errMalformedImage
+	}
+	out := make([]byte, 0, len(data))
+	out = append(out, pngSignature...)
+	i := len(pngSignature)
+	sawIDAT := false
+	for i+12 <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[i:]))
+		if i+12+length > len(data) {
+			return nil, orientation, errMalformedImage
+		}
+		chunkType := string(data[i+4 : i+8])
+		chunk := data[i : i+12+length]
+		i += 12 + length
+
+		if chunkType == "eXIf" {
+			body := chunk[8 : 8+length]
+			body = bytes.TrimPrefix(body, []byte("Exif\x00\x00"))
+			if o := exifOrientation(body); o != 0 {
+				orientation = o
+			}
+		}
+		if pngMetadataChunks[chunkType] {
+			continue
+		}
+		out = append(out, chunk...)
+		if chunkType == "IEND" {
+			return out, orientation, nil
+		}
+		sawIDAT = sawIDAT || chunkType == "IDAT"
+	}
+	// A file ending cleanly after its image data only lost IEND.
+	if i == len(data) && sawIDAT {
+		return append(out, pngIEND...), orientation, nil
+	}
+	return nil, orientation, errMalformedImage
+}
+
+// --- GIF ---
+
+// stripGIF removes comment extensions and application extensions other than
+// the looping ones, and anything after the trailer.
+func stripGIF(data []byte) ([]byte, error) {
+	if len(data) < 13 || !(bytes.HasPrefix(data, []byte("GIF87a")) || bytes.HasPrefix(data, []byte("GIF89a"))) {
+		return nil, errMalformedImage
+	}
+	i := 13
+	if flags := data[10]; flags&0x80 != 0 {
+		i += 3 << (flags&0x07 + 1)
+	}
+	if i > len(data) {
+		return nil, errMalformedImage
+	}
+	out := make([]byte, 0, len(data))
+	out = append(out, data[:i]...)
+
+	// subBlocks returns the end of the data sub-blocks starting at j.
+	subBlocks := func(j int) (int, error) {
+		for j < len(data) {
+			size := int(data[j])
+			j++
+			if size == 0 {
+				return j, nil
+			}
+			j += size
+		}
+		return 0, errMalformedImage
+	}
+
+	for i < len(data) {
+		start := i
+		switch data[i] {
+		case 0x3B: // trailer
+			return append(out, 0x3B), nil
+		case 0x21: // extension
+			if i+2 > len(data) {
+				return nil, errMalformedImage
+			}
+			label := data[i+1]
+			end, err := subBlocks(i + 2)
+			if err != nil {
+				return nil, err
+			}
+			i = end
+			keep := true
+			switch label {
+			case 0xFE:
+				keep = false
+			case 0xFF:
+				keep = i-start > 14 && (bytes.Equal(data[start+3:start+14], []byte("NETSCAPE2.0")) ||
+					bytes.Equal(data[start+3:start+14], []byte("ANIMEXTS1.0")))
+			}
+			if keep {
+				out = append(out, data[start:i]...)
+			}
+		case 0x2C: // image descriptor
+			if i+10 > len(data) {
+				return nil, errMalformedImage
+			}
+			flags := data[i+9]
+			i += 10
+			if flags&0x80 != 0 {
+				i += 3 << (flags&0x07 + 1)
+			}
+			if i+1 > len(data) {
+				return nil, errMalformedImage
+			}
+			end, err := subBlocks(i + 1) // skip the LZW minimum code size
+			if err != nil {
+				return nil, err
+			}
+			i = end
+			out = append(out, data[start:i]...)
+		default:
+			return nil, errMalformedImage
+		}
+	}
+	return nil, errMalformedImage
+}
+
+// --- Orientation ---
+
+// applyOrientation transforms img so it displays upright without the EXIF
+// orientation tag.
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+	src := toRGBA(img)
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			}
+			copy(dst.Pix[dst.PixOffset(dx, dy):dst.PixOffset(dx, dy)+4], src.Pix[src.PixOffset(x, y):src.PixOffset(x, y)+4])
+		}
+	}
+	return dst
+}
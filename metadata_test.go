@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func testImage() image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, 16, 8))
+	for x := 0; x < 16; x++ {
+		img.Set(x, x%8, color.RGBA{255, 0, 0, 255})
+	}
+	return img
+}
+
+func encodeTestImage(t *testing.T, format string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var err error
+	switch format {
+	case "image/jpeg":
+		err = jpeg.Encode(&buf, testImage(), nil)
+	case "image/png":
+		err = png.Encode(&buf, testImage())
+	case "image/gif":
+		err = gif.Encode(&buf, testImage(), nil)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestSanitizeImage(t *testing.T) {
+	tests := []struct {
+		name     string
+		filetype string
+		mangle   func([]byte) []byte
+		wantErr  bool
+	}{
+		{"jpeg", "image/jpeg", nil, false},
+		{"png", "image/png", nil, false},
+		{"gif", "image/gif", nil, false},
+		// Go decodes JPEGs without an EOI marker; the stripper does not.
+		{"jpeg without EOI", "image/jpeg", func(b []byte) []byte { return b[:len(b)-2] }, false},
+		{"png without IEND", "image/png", func(b []byte) []byte { return b[:len(b)-12] }, false},
+		{"gif without trailer", "image/gif", func(b []byte) []byte { return b[:len(b)-1] }, false},
+		{"truncated jpeg", "image/jpeg", func(b []byte) []byte { return b[:len(b)/3] }, true},
+		{"garbage", "image/png", func([]byte) []byte { return []byte("not an image") }, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := encodeTestImage(t, tt.filetype)
+			if tt.mangle != nil {
+				data = tt.mangle(data)
+			}
+			for _, reencode := range []bool{false, true} {
+				clean, err := sanitizeImage(data, tt.filetype, reencode)
+				if tt.wantErr {
+					if err == nil {
+						t.Errorf("reencode=%v: expected an error", reencode)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("reencode=%v: %v", reencode, err)
+				}
+				if _, _, err := image.Decode(bytes.NewReader(clean)); err != nil {
+					t.Errorf("reencode=%v: result does not decode: %v", reencode, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,511 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Two-factor authentication with TOTP authenticator apps (RFC 6238: SHA-1,
+// 30 second steps, 6 digits). Enrolling is two calls: POST /api/mfa/enroll
+// returns a secret and an otpauth:// URI for the client to show as a QR code,
+// and POST /api/mfa/confirm with a code from the app turns MFA on and returns
+// ten single-use recovery codes.
+//
+// Once enabled, a correct password at /api/login returns an mfa_token
+// instead of a session. POST /api/login/mfa with that token and a code (or a
+// recovery code) completes the login. Wrong codes count as failed logins, so
+// logins.go throttles them like passwords. Each code is accepted only once.
+//
+// With config.RequireAdminMFA, admins without MFA can only reach /api/mfa
+// until they enroll.
+
+const (
+	totpPeriod        = 30
+	totpDigits        = 6
+	totpSkew          = 1 // steps either side of now that are still accepted
+	totpSecretBytes   = 20
+	recoveryCodeCount = 10
+	recoveryCodeBytes = 10 // 80 bits, enough to store them like tokens
+)
+
+var (
+	errMFAEnrollmentRequired = &httpError{http.StatusForbidden, "Admins must enable two-factor authentication"}
+	errReauthFailed          = &httpError{http.StatusUnauthorized, "Invalid password or code"}
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// totpCode computes the code for a time step.
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// matchTOTP returns the step code is valid for at time now, allowing for
+// totpSkew steps of clock drift.
+func matchTOTP(secret []byte, code string, now time.Time) (int64, bool) {
+	code = strings.ReplaceAll(code, " ", "")
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// totpURI is the otpauth:// URI authenticator apps read from a QR code.
+func totpURI(username, secret string) string {
+	label := url.PathEscape(config.MFAIssuer + ":" + username)
+	q := url.Values{}
+	q.Set("secret", secret)
+	q.Set("issuer", config.MFAIssuer)
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", strconv.Itoa(totpDigits))
+	q.Set("period", strconv.Itoa(totpPeriod))
+	return "otpauth://totp/" + label + "?" + q.Encode()
+}
+
+func mfaEnabled(db *sql.DB, userID int64) (bool, error) {
+	var enabled bool
+	err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM user_mfa WHERE user_id = $1 AND enabled)`, userID).Scan(&enabled)
+	return enabled, err
+}
+
+// checkMFAEnforced returns errMFAEnrollmentRequired for admins without MFA
+// when config.RequireAdminMFA is set.
+func checkMFAEnforced(db *sql.DB, user *User) error {
+	if !config.RequireAdminMFA || !isAdmin(user) {
+		return nil
+	}
+	enabled, err := mfaEnabled(db, user.ID)
+	if err != nil {
+		return err
+	}
+	if !enabled {
+		return errMFAEnrollmentRequired
+	}
+	return nil
+}
+
+// verifyTOTP checks a code against the user's secret and marks its step as
+// used. pending selects the secret of an enrollment not yet confirmed.
+func verifyTOTP(db *sql.DB, userID int64, code string, pending bool) (bool, error) {
+	var secret string
+	err := db.QueryRow(`SELECT secret FROM user_mfa WHERE user_id = $1 AND enabled = $2`, userID, !pending).Scan(&secret)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil {
+		return false, err
+	}
+	step, ok := matchTOTP(key, code, time.Now())
+	if !ok {
+		return false, nil
+	}
+	// A code seen once is spent, even within its 30 seconds.
+	res, err := db.Exec(`UPDATE user_mfa SET last_step = $1 WHERE user_id = $2 AND last_step < $1`, step, userID)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n == 1, nil
+}
+
+// useRecoveryCode consumes one of the user's recovery codes.
+func useRecoveryCode(db *sql.DB, userID int64, code string) (bool, error) {
+	res, err := db.Exec(`
+		UPDATE mfa_recovery_codes SET used_at = NOW()
+		WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL`, userID, hashToken(normalizeRecoveryCode(code)))
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n == 1, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// checkSecondFactor accepts either a current TOTP code or a recovery code.
+func checkSecondFactor(db *sql.DB, r *http.Request, user *User, code, recoveryCode string) (bool, error) {
+	if recoveryCode != "" {
+		ok, err := useRecoveryCode(db, user.ID, recoveryCode)
+		if ok {
+			recordAudit(db, r, auditMFARecoveryCodeUsed, user.Username, nil, "")
+		}
+		return ok, err
+	}
+	return verifyTOTP(db, user.ID, code, false)
+}
+
+// replaceRecoveryCodes discards the user's recovery codes and returns a
+// fresh set of 80-bit codes, formatted xxxxx-xxxxx-xxxxx-xxxxx.
+func replaceRecoveryCodes(tx *sql.Tx, userID int64) ([]string, error) {
+	if _, err := tx.Exec(`DELETE FROM mfa_recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return nil, err
+	}
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, recoveryCodeBytes)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		h := hex.EncodeToString(b)
+		codes[i] = h[:5] + "-" + h[5:10] + "-" + h[10:15] + "-" + h[15:]
+		if _, err := tx.Exec(`INSERT INTO mfa_recovery_codes (user_id, code_hash) VALUES ($1, $2)`,
+			userID, hashToken(normalizeRecoveryCode(codes[i]))); err != nil {
+			return nil, err
+		}
+	}
+	return codes, nil
+}
+
+// createMFAChallenge issues the token that stands in for a session between
+// the password and the second factor.
+func createMFAChallenge(db *sql.DB, userID int64) (string, error) {
+	token, err := generateToken()
+	if err != nil {
+		return "", err
+	}
+	db.Exec(`DELETE FROM mfa_challenges WHERE expires_at < NOW()`)
+	_, err = db.Exec(`INSERT INTO mfa_challenges (token_hash, user_id, expires_at) VALUES ($1, $2, $3)`,
+		hashToken(token), userID, time.Now().Add(config.MFAChallengeTTL))
+	return token, err
+}
+
+// reauthenticate checks the password and second factor of someone changing
+// their MFA settings. Accounts without a usable password re-authenticate
+// with the second factor alone.
+func reauthenticate(db *sql.DB, r *http.Request, user *User, password, code, recoveryCode string) error {
+	if hasUsablePassword(db, user.ID) {
+		if u, ok := checkUser(db, user.Username, password); !ok || u.ID != user.ID {
+			return errReauthFailed
+		}
+	}
+	ok, err := checkSecondFactor(db, r, user, code, recoveryCode)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errReauthFailed
+	}
+	return nil
+}
+
+// hasUsablePassword reports whether the user can sign in with a password:
+// local and directory accounts can, accounts created by single sign-on have
+// a random one nobody knows, and no one can while password login is off.
+func hasUsablePassword(db *sql.DB, userID int64) bool {
+	if !config.PasswordLogin {
+		return false
+	}
+	var source string
+	db.QueryRow(`SELECT auth_source FROM users WHERE id = $1`, userID).Scan(&source)
+	return source == authSourceLocal || source == authSourceLDAP
+}
+
+// --- Handlers ---
+
+// loginMFAHandler completes a login started at /api/login. Body:
+// {"mfa_token": ..., "code": ...} or {"mfa_token": ..., "recovery_code": ...}.
+func loginMFAHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Token        string `json:"mfa_token"`
+			Code         string `json:"code"`
+			RecoveryCode string `json:"recovery_code"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		user, ok := scanUser(db.QueryRow(`
+			SELECT u.id, u.username, u.role, u.avatar_url, u.is_bot, COALESCE(u.nickname, '')
+			FROM mfa_challenges c JOIN users u ON c.user_id = u.id
+			WHERE c.token_hash = $1 AND c.expires_at > NOW()`, hashToken(req.Token)))
+		if !ok {
+			http.Error(w, "Invalid or expired MFA token; log in again", http.StatusUnauthorized)
+			return
+		}
+		if !checkLoginAllowed(db, w, r, user.Username) {
+			return
+		}
+		ok, err := checkSecondFactor(db, r, user, req.Code, req.RecoveryCode)
+		if err != nil {
+			log.Printf("Failed to check second factor for '%s': %v", user.Username, err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			loginFailed(db, r, user.Username, "invalid MFA code")
+			http.Error(w, "Invalid code", http.StatusUnauthorized)
+			return
+		}
+		// The challenge is single-use; losing a race for it means another
+		// request already logged in with it.
+		res, err := db.Exec(`DELETE FROM mfa_challenges WHERE token_hash = $1`, hashToken(req.Token))
+		if n, _ := res.RowsAffected(); err != nil || n == 0 {
+			http.Error(w, "Invalid or expired MFA token; log in again", http.StatusUnauthorized)
+			return
+		}
+		loginSucceeded(db, r, user)
+		startSession(db, w, user)
+	}
+}
+
+// mfaStatusHandler reports whether the caller has MFA on.
+func mfaStatusHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := userFromContext(r.Context())
+		if user == nil {
+			http.Error(w, "User not found", http.StatusUnauthorized)
+			return
+		}
+		var status struct {
+			Enabled                bool `json:"enabled"`
+			Required               bool `json:"required"`
+			RecoveryCodesRemaining int  `json:"recovery_codes_remaining"`
+		}
+		err := db.QueryRow(`
+			SELECT EXISTS (SELECT 1 FROM user_mfa WHERE user_id = $1 AND enabled),
+				(SELECT COUNT(*) FROM mfa_recovery_codes WHERE user_id = $1 AND used_at IS NULL)`,
+			user.ID).Scan(&status.Enabled, &status.RecoveryCodesRemaining)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		status.Required = config.RequireAdminMFA && isAdmin(user)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	}
+}
+
+// enrollMFAHandler starts enrollment with a new secret, replacing any
+// enrollment that was not confirmed.
+func enrollMFAHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := userFromContext(r.Context())
+		if user == nil || user.Bot {
+			http.Error(w, "Only people can enable two-factor authentication", http.StatusForbidden)
+			return
+		}
+		key := make([]byte, totpSecretBytes)
+		if _, err := rand.Read(key); err != nil {
+			http.Error(w, "Failed to start enrollment", http.StatusInternalServerError)
+			return
+		}
+		secret := totpEncoding.EncodeToString(key)
+		res, err := db.Exec(`
+			INSERT INTO user_mfa (user_id, secret) VALUES ($1, $2)
+			ON CONFLICT (user_id) DO UPDATE SET secret = EXCLUDED.secret, last_step = 0, created_at = NOW()
+			WHERE NOT user_mfa.enabled`, user.ID, secret)
+		if err != nil {
+			http.Error(w, "Failed to start enrollment", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"secret": secret,
+			"uri":    totpURI(user.Username, secret),
+		})
+	}
+}
+
+// confirmMFAHandler enables MFA once the caller proves their app works, and
+// returns their recovery codes.
+func confirmMFAHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := userFromContext(r.Context())
+		if user == nil {
+			http.Error(w, "User not found", http.StatusUnauthorized)
+			return
+		}
+		var req struct {
+			Code string `json:"code"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		ok, err := verifyTOTP(db, user.ID, req.Code, true)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, "Invalid code, or no enrollment in progress", http.StatusBadRequest)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Failed to enable two-factor authentication", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+		if _, err := tx.Exec(`UPDATE user_mfa SET enabled = TRUE, enabled_at = NOW() WHERE user_id = $1`, user.ID); err != nil {
+			http.Error(w, "Failed to enable two-factor authentication", http.StatusInternalServerError)
+			return
+		}
+		codes, err := replaceRecoveryCodes(tx, user.ID)
+		if err != nil || tx.Commit() != nil {
+			log.Printf("Failed to enable MFA for user %d: %v", user.ID, err)
+			http.Error(w, "Failed to enable two-factor authentication", http.StatusInternalServerError)
+			return
+		}
+		recordAudit(db, r, auditMFAEnabled, user.Username, nil, "")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string][]string{"recovery_codes": codes})
+	}
+}
+
+type reauthRequest struct {
+	Password     string `json:"password"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// disableMFAHandler turns MFA off. It takes the password, if the account has
+// one, and a code, so a stolen session alone cannot do it.
+func disableMFAHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := userFromContext(r.Context())
+		if user == nil {
+			http.Error(w, "User not found", http.StatusUnauthorized)
+			return
+		}
+		if config.RequireAdminMFA && isAdmin(user) {
+			http.Error(w, "Admins must keep two-factor authentication enabled", http.StatusForbidden)
+			return
+		}
+		var req reauthRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if !checkLoginAllowed(db, w, r, user.Username) {
+			return
+		}
+		if err := reauthenticate(db, r, user, req.Password, req.Code, req.RecoveryCode); err != nil {
+			if err == errReauthFailed {
+				loginFailed(db, r, user.Username, "re-authentication failed")
+			}
+			writeError(w, err, "Failed to disable two-factor authentication")
+			return
+		}
+		if _, err := db.Exec(`DELETE FROM user_mfa WHERE user_id = $1`, user.ID); err != nil {
+			http.Error(w, "Failed to disable two-factor authentication", http.StatusInternalServerError)
+			return
+		}
+		db.Exec(`DELETE FROM mfa_recovery_codes WHERE user_id = $1`, user.ID)
+		recordAudit(db, r, auditMFADisabled, user.Username, nil, "")
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// regenerateRecoveryCodesHandler replaces the caller's recovery codes. Like
+// disabling MFA it takes the password and a code.
+func regenerateRecoveryCodesHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := userFromContext(r.Context())
+		if user == nil {
+			http.Error(w, "User not found", http.StatusUnauthorized)
+			return
+		}
+		var req reauthRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if !checkLoginAllowed(db, w, r, user.Username) {
+			return
+		}
+		if err := reauthenticate(db, r, user, req.Password, req.Code, req.RecoveryCode); err != nil {
+			if err == errReauthFailed {
+				loginFailed(db, r, user.Username, "re-authentication failed")
+			}
+			writeError(w, err, "Failed to regenerate recovery codes")
+			return
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Failed to regenerate recovery codes", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+		codes, err := replaceRecoveryCodes(tx, user.ID)
+		if err != nil || tx.Commit() != nil {
+			http.Error(w, "Failed to regenerate recovery codes", http.StatusInternalServerError)
+			return
+		}
+		recordAudit(db, r, auditMFACodesRegenerated, user.Username, nil, "")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string][]string{"recovery_codes": codes})
+	}
+}
+
+// resetUserMFAHandler lets an admin turn off MFA for someone who lost their
+// authenticator and recovery codes.
+func resetUserMFAHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		admin := userFromContext(r.Context())
+		if !isAdmin(admin) {
+			http.Error(w, "Admin access required", http.StatusForbidden)
+			return
+		}
+		userID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid user ID", http.StatusBadRequest)
+			return
+		}
+		var username string
+		err = db.QueryRow(`
+			DELETE FROM user_mfa m USING users u WHERE m.user_id = $1 AND u.id = m.user_id
+			RETURNING u.username`, userID).Scan(&username)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Two-factor authentication is not enabled for that user", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		db.Exec(`DELETE FROM mfa_recovery_codes WHERE user_id = $1`, userID)
+		log.Printf("User %d reset MFA for %s", admin.ID, username)
+		recordAudit(db, r, auditMFAReset, username, admin, "")
+		w.WriteHeader(http.StatusOK)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"database/sql/driver"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA-1 key of the RFC 6238 test vectors.
+var rfc6238Secret = []byte("12345678901234567890")
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 appendix B, keeping the last six of its eight digits.
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		if got := totpCode(rfc6238Secret, tt.unix/totpPeriod); got != tt.want {
+			t.Errorf("totpCode at %d = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestMatchTOTP(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	step := now.Unix() / totpPeriod
+	code := func(s int64) string { return totpCode(rfc6238Secret, s) }
+
+	tests := []struct {
+		name     string
+		code     string
+		wantStep int64
+		ok       bool
+	}{
+		{"current", code(step), step, true},
+		{"with a space", code(step)[:3] + " " + code(step)[3:], step, true},
+		{"previous step", code(step - 1), step - 1, true},
+		{"next step", code(step + 1), step + 1, true},
+		{"two steps old", code(step - 2), 0, false},
+		{"two steps ahead", code(step + 2), 0, false},
+		{"too short", code(step)[:5], 0, false},
+		{"too long", code(step) + "0", 0, false},
+		{"empty", "", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := matchTOTP(rfc6238Secret, tt.code, now)
+		if ok != tt.ok || got != tt.wantStep {
+			t.Errorf("%s: matchTOTP = %d, %v; want %d, %v", tt.name, got, ok, tt.wantStep, tt.ok)
+		}
+	}
+}
+
+// A code is spent once its step is recorded: verifyTOTP only succeeds when
+// it advances last_step, so the same code, or an older one, fails.
+func TestVerifyTOTPRejectsReplay(t *testing.T) {
+	secret := totpEncoding.EncodeToString(rfc6238Secret)
+	var lastStep int64
+	db, _ := newFakeDB(t, func(query string, args []driver.Value) (fakeResult, error) {
+		switch {
+		case strings.Contains(query, "SELECT secret FROM user_mfa"):
+			return fakeRows([]driver.Value{secret}), nil
+		case strings.Contains(query, "UPDATE user_mfa SET last_step"):
+			if step := args[0].(int64); step > lastStep {
+				lastStep = step
+				return fakeResult{affected: 1}, nil
+			}
+			return fakeResult{}, nil
+		}
+		return fakeResult{}, nil
+	})
+
+	step := time.Now().Unix() / totpPeriod
+	current := totpCode(rfc6238Secret, step)
+	if ok, err := verifyTOTP(db, 1, current, false); !ok || err != nil {
+		t.Fatalf("first use = %v, %v; want accepted", ok, err)
+	}
+	if ok, err := verifyTOTP(db, 1, current, false); ok || err != nil {
+		t.Errorf("replay = %v, %v; want refused", ok, err)
+	}
+	if ok, _ := verifyTOTP(db, 1, totpCode(rfc6238Secret, step-1), false); ok {
+		t.Error("an older code was accepted after a newer one")
+	}
+}
+
+func TestReplaceRecoveryCodes(t *testing.T) {
+	hashes := map[string]bool{}
+	db, f := newFakeDB(t, func(query string, args []driver.Value) (fakeResult, error) {
+		if strings.Contains(query, "INSERT INTO mfa_recovery_codes") {
+			hashes[args[1].(string)] = true
+		}
+		return fakeResult{affected: 1}, nil
+	})
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	codes, err := replaceRecoveryCodes(tx, 1)
+	if err != nil {
+		t.Fatalf("replaceRecoveryCodes: %v", err)
+	}
+	if !f.ran("DELETE FROM mfa_recovery_codes WHERE user_id") {
+		t.Error("old codes were kept")
+	}
+	if len(codes) != recoveryCodeCount || len(hashes) != recoveryCodeCount {
+		t.Fatalf("%d codes, %d distinct hashes; want %d", len(codes), len(hashes), recoveryCodeCount)
+	}
+	format := regexp.MustCompile(`^[0-9a-f]{5}-[0-9a-f]{5}-[0-9a-f]{5}-[0-9a-f]{5}$`)
+	for _, c := range codes {
+		if !format.MatchString(c) {
+			t.Errorf("code %q is not xxxxx-xxxxx-xxxxx-xxxxx", c)
+		}
+		// However the user types it, it hashes to the stored value.
+		typed := strings.ToUpper(strings.ReplaceAll(c, "-", " "))
+		if !hashes[hashToken(normalizeRecoveryCode(typed))] {
+			t.Errorf("%q does not match the stored hash of %q", typed, c)
+		}
+	}
+}
@@ -14,6 +14,34 @@ type User struct {
 	Username  string `json:"username"`
 	Role      Role   `json:"role"`
 	AvatarURL string `json:"avatar_url"`
+	// Bot is set for bot accounts; see bots.go.
+	Bot bool `json:"bot"`
+	// Nickname is the display name chosen with /nick, if any.
+	Nickname string `json:"nickname,omitempty"`
+}
+
+// Bot is a bot account as shown to its owner. Token is only returned when
+// the bot is created or its token regenerated.
+type Bot struct {
+	ID          int64     `json:"id"`
+	Username    string    `json:"username"`
+	AvatarURL   string    `json:"avatar_url,omitempty"`
+	Description string    `json:"description,omitempty"`
+	OwnerID     int64     `json:"owner_id"`
+	Token       string    `json:"token,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// AccessToken is a personal access token as shown to its owner. Token is
+// only returned when the token is created.
+type AccessToken struct {
+	ID         int64      `json:"id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+	Token      string     `json:"token,omitempty"`
 }
 
 type Credentials struct {
@@ -26,6 +54,7 @@ type Channel struct {
 	Name       string `json:"name"`
 	CategoryID int64  `json:"category_id"`
 	Position   int    `json:"position"`
+	Topic      string `json:"topic,omitempty"`
 }
 
 type ChannelCategory struct {
@@ -36,19 +65,124 @@ type ChannelCategory struct {
 }
 
 type Message struct {
+	ID        int64  `json:"id"`
+	ChannelID int64  `json:"channel_id"`
+	UserID    int64  `json:"user_id"`
+	Username  string `json:"username"`
+	Bot       bool   `json:"bot"`
+	Nickname  string `json:"nickname,omitempty"`
+	Content   string `json:"content"`
+	// ContentAST and ContentHTML are Content parsed as Markdown; see markdown.go.
+	ContentAST  []MarkdownNode `json:"content_ast"`
+	ContentHTML string         `json:"content_html"`
+	CreatedAt   time.Time      `json:"created_at"`
+	AvatarURL   string         `json:"avatar_url,omitempty"`
+	Attachments []Attachment   `json:"attachments"`
+	Embeds      []Embed        `json:"embeds"`
+	// WebhookID is set for messages posted through an incoming webhook;
+	// Username and AvatarURL then carry the webhook's display overrides.
+	WebhookID int64 `json:"webhook_id,omitempty"`
+}
+
+type NewMessageRequest struct {
+	Content       string  `json:"content"`
+	ChannelID     int64   `json:"channel_id"`
+	UserID        int64   `json:"user_id"`
+	AttachmentIDs []int64 `json:"attachment_ids,omitempty"`
+}
+
+// Attachment is an upload linked to a message through message_attachments.
+type Attachment struct {
+	ID       int64          `json:"id"`
+	Filename string         `json:"filename"`
+	Filesize int64          `json:"filesize"`
+	Filetype string         `json:"filetype"`
+	Width    int            `json:"width,omitempty"`
+	Height   int            `json:"height,omitempty"`
+	URL      string         `json:"url"`
+	Variants []ImageVariant `json:"variants,omitempty"`
+	// ScanStatus is "pending", "clean", "infected" or "error". Only clean
+	// files can be downloaded.
+	ScanStatus string `json:"scan_status"`
+}
+
+// Webhook is an incoming webhook that posts into a channel. Token is the
+// secret part of its URL; it and the URL are only shown when the token is
+// generated.
+type Webhook struct {
 	ID        int64     `json:"id"`
 	ChannelID int64     `json:"channel_id"`
+	Name      string    `json:"name"`
+	AvatarURL string    `json:"avatar_url,omitempty"`
+	Token     string    `json:"token,omitempty"`
+	URL       string    `json:"url,omitempty"`
+	CreatedBy int64     `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// MarkdownNode is a node of a parsed message. Which fields are set depends on
+// Type: Text for text, code and code_block; Language for code_block; URL for
+// link; UserID and Username for mention; EmojiID, Name, URL and Animated for
+// emoji; Children for containers.
+type MarkdownNode struct {
+	Type     string         `json:"type"`
+	Text     string         `json:"text,omitempty"`
+	Language string         `json:"language,omitempty"`
+	URL      string         `json:"url,omitempty"`
+	UserID   int64          `json:"user_id,omitempty"`
+	Username string         `json:"username,omitempty"`
+	EmojiID  int64          `json:"emoji_id,omitempty"`
+	Name     string         `json:"name,omitempty"`
+	Animated bool           `json:"animated,omitempty"`
+	Children []MarkdownNode `json:"children,omitempty"`
+}
+
+// CustomEmoji is an admin-uploaded image used through a :name: shortcode.
+type CustomEmoji struct {
+	ID        int64     `json:"id"`
+	Name      string    `json:"name"`
+	URL       string    `json:"url"`
+	Animated  bool      `json:"animated"`
+	CreatedBy int64     `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Embed is a rich preview shown under a message, such as a link preview.
+// Type is "link", "image", "video" or "rich".
+type Embed struct {
+	URL         string `json:"url"`
+	Type        string `json:"type"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	SiteName    string `json:"site_name,omitempty"`
+	AuthorName  string `json:"author_name,omitempty"`
+	ImageURL    string `json:"image_url,omitempty"`
+	ImageWidth  int    `json:"image_width,omitempty"`
+	ImageHeight int    `json:"image_height,omitempty"`
+	Color       string `json:"color,omitempty"`
+	// ProxyImageURL serves ImageURL through /api/proxy. It is generated for
+	// each payload and never stored.
+	ProxyImageURL string `json:"proxy_image_url,omitempty"`
+}
+
+// ChannelFile is an attachment listed in a channel's files view.
+type ChannelFile struct {
+	Attachment
+	MessageID int64     `json:"message_id"`
 	UserID    int64     `json:"user_id"`
 	Username  string    `json:"username"`
-	Content   string    `json:"content"`
-	CreatedAt time.Time `json:"created_at"`
-	AvatarURL string    `json:"avatar_url,omitempty"`
+	PostedAt  time.Time `json:"posted_at"`
 }
 
-type NewMessageRequest struct {
-	Content   string `json:"content"`
-	ChannelID int64  `json:"channel_id"`
-	UserID    int64  `json:"user_id"`
+// ImageVariant is a resized copy of an uploaded image.
+type ImageVariant struct {
+	Name           string `json:"name"`
+	StoredFilename string `json:"-"`
+	URL            string `json:"url"`
+	Width          int    `json:"width"`
+	Height         int    `json:"height"`
+	Filesize       int64  `json:"-"`
+	BlobKey        string `json:"-"`
 }
 
 type ReorderItem struct {
@@ -58,13 +192,44 @@ type ReorderItem struct {
 
 // Upload struct for file uploads
 type Upload struct {
-	ID            int64     `json:"id"`
-	UserID        int64     `json:"user_id"`
-	OrigFilename  string    `json:"orig_filename"`
-	StoredFilename string   `json:"stored_filename"`
-	Filetype      string    `json:"filetype"`
-	Filesize      int64     `json:"filesize"`
-	UploadedAt    time.Time `json:"uploaded_at"`
+	ID             int64          `json:"id"`
+	UserID         int64          `json:"user_id"`
+	OrigFilename   string         `json:"orig_filename"`
+	StoredFilename string         `json:"stored_filename"`
+	Filetype       string         `json:"filetype"`
+	Filesize       int64          `json:"filesize"`
+	Width          int            `json:"width,omitempty"`
+	Height         int            `json:"height,omitempty"`
+	UploadedAt     time.Time      `json:"uploaded_at"`
+	Variants       []ImageVariant `json:"variants,omitempty"`
+	URL            string         `json:"url,omitempty"`
+	MessageID      int64          `json:"message_id,omitempty"`
+	ScanStatus     string         `json:"scan_status"`
+	BlobHash       string         `json:"-"`
+	BlobKey        string         `json:"-"`
+}
+
+// StorageUsage reports a user's upload usage. Quota and Remaining are null
+// when the user has no limit.
+type StorageUsage struct {
+	Used        int64  `json:"used"`
+	Reserved    int64  `json:"reserved"`
+	UploadCount int64  `json:"upload_count"`
+	Quota       *int64 `json:"quota"`
+	Remaining   *int64 `json:"remaining"`
+}
+
+// GCReport summarizes one garbage collection pass over uploads and blobs.
+type GCReport struct {
+	DryRun            bool      `json:"dry_run"`
+	StartedAt         time.Time `json:"started_at"`
+	DurationMS        int64     `json:"duration_ms"`
+	StaleUploads      int       `json:"stale_uploads"`
+	StaleUploadBytes  int64     `json:"stale_upload_bytes"`
+	OrphanedBlobs     int       `json:"orphaned_blobs"`
+	OrphanedBlobBytes int64     `json:"orphaned_blob_bytes"`
+	ReclaimedBytes    int64     `json:"reclaimed_bytes"`
+	Errors            int       `json:"errors"`
 }
 
 type Session struct {
@@ -72,4 +237,4 @@ type Session struct {
 	UserID    int64     `json:"user_id"`
 	CreatedAt time.Time `json:"created_at"`
 	ExpiresAt time.Time `json:"expires_at"`
-}
\ No newline at end of file
+}
@@ -0,0 +1,629 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Single sign-on with an OpenID Connect provider, using the authorization
+// code flow with PKCE:
+//
+//  1. GET /api/oidc/login redirects the browser to the provider, and sets a
+//     cookie holding the state so the callback only completes in the
+//     browser that started the flow.
+//  2. The provider sends it back to GET /api/oidc/callback (which must be
+//     registered there as config.OIDCRedirectURL). We exchange the code for
+//     an ID token and verify it (jwt.go).
+//  3. The callback redirects to config.OIDCPostLoginURL with a one-time
+//     #oidc_code=..., which the client trades for a session at
+//     POST /api/oidc/session, the same response /api/login gives. Failures
+//     arrive as #oidc_error=....
+//
+// Identities are matched to users by (issuer, subject) in oidc_identities.
+// An unknown identity is linked to an existing account when that account's
+// holder started the flow with POST /api/oidc/link, or by username when
+// config.OIDCLinkByUsername is set and the account is a local one that is
+// not an admin's; otherwise a new user is created. When
+// config.OIDCAdminGroups is set, every login sets the role from the groups
+// claim. Second factors are the provider's business, so these logins skip
+// the local MFA challenge (config.RequireAdminMFA still applies).
+//
+// The provider is found through discovery at config.OIDCIssuer, and any
+// issuer URL works, including a mock provider on http://localhost.
+
+const (
+	oidcStateTTL     = 10 * time.Minute
+	oidcStateCookie  = "prisma_oidc_state"
+	oidcLoginCodeTTL = time.Minute
+	// oidcKeyRefetch limits how often an unknown key ID can make us fetch
+	// the provider's keys again.
+	oidcKeyRefetch = time.Minute
+)
+
+type oidcMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcProvider caches the provider's metadata and signing keys.
+type oidcProvider struct {
+	client *http.Client
+
+	mu          sync.Mutex
+	meta        *oidcMetadata
+	keys        map[string]*rsa.PublicKey
+	keysFetched time.Time
+}
+
+// newOIDCProvider returns nil unless OIDC is configured.
+func newOIDCProvider() *oidcProvider {
+	if config.OIDCIssuer == "" || config.OIDCClientID == "" {
+		return nil
+	}
+	return &oidcProvider{client: &http.Client{Timeout: config.OIDCTimeout}}
+}
+
+func (p *oidcProvider) getJSON(u string, v interface{}) error {
+	resp, err := p.client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// metadata fetches the discovery document the first time it is needed.
+func (p *oidcProvider) metadata() (*oidcMetadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.meta != nil {
+		return p.meta, nil
+	}
+	var meta oidcMetadata
+	if err := p.getJSON(strings.TrimSuffix(config.OIDCIssuer, "/")+"/.well-known/openid-configuration", &meta); err != nil {
+		return nil, err
+	}
+	if meta.Issuer != config.OIDCIssuer {
+		return nil, fmt.Errorf("discovery document is for issuer %q, not %q", meta.Issuer, config.OIDCIssuer)
+	}
+	if meta.AuthorizationEndpoint == "" || meta.TokenEndpoint == "" || meta.JWKSURI == "" {
+		return nil, errors.New("discovery document is missing endpoints")
+	}
+	p.meta = &meta
+	return p.meta, nil
+}
+
+// key returns the signing key with the given ID, fetching the key set again
+// if the provider may have rotated its keys.
+func (p *oidcProvider) key(jwksURI, kid string) (*rsa.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if k, ok := p.keys[kid]; ok {
+		return k, nil
+	}
+	if time.Since(p.keysFetched) >= oidcKeyRefetch {
+		var doc json.RawMessage
+		if err := p.getJSON(jwksURI, &doc); err != nil {
+			return nil, err
+		}
+		keys, err := rsaKeys(doc)
+		if err != nil {
+			return nil, err
+		}
+		p.keys, p.keysFetched = keys, time.Now()
+	}
+	if k, ok := p.keys[kid]; ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// exchange trades an authorization code for a verified ID token.
+func (p *oidcProvider) exchange(meta *oidcMetadata, code, verifier, nonce string) (*idTokenClaims, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {config.OIDCRedirectURL},
+		"client_id":     {config.OIDCClientID},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequest(http.MethodPost, meta.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if config.OIDCClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(config.OIDCClientID), url.QueryEscape(config.OIDCClientSecret))
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil {
+		return nil, fmt.Errorf("token endpoint: %s", resp.Status)
+	}
+	if body.Error != "" {
+		return nil, fmt.Errorf("token endpoint: %s %s", body.Error, body.ErrorDescription)
+	}
+	if resp.StatusCode != http.StatusOK || body.IDToken == "" {
+		return nil, fmt.Errorf("token endpoint: %s without an ID token", resp.Status)
+	}
+	claims, err := parseJWT(body.IDToken, func(kid string) (*rsa.PublicKey, error) {
+		return p.key(meta.JWKSURI, kid)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := claims.validate(meta.Issuer, config.OIDCClientID, nonce, time.Now()); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// pkceVerifier returns a code verifier and its S256 challenge (RFC 7636).
+func pkceVerifier() (string, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	verifier := base64.RawURLEncoding.EncodeToString(b)
+	sum := sha256.Sum256([]byte(verifier))
+	return verifier, base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// beginOIDC records a new login attempt, binds it to the browser with the
+// state cookie and returns the provider URL to send the browser to.
+// linkUserID is set when a logged-in user is linking their account.
+func beginOIDC(w http.ResponseWriter, db *sql.DB, p *oidcProvider, linkUserID int64) (string, error) {
+	meta, err := p.metadata()
+	if err != nil {
+		return "", err
+	}
+	state, err := generateToken()
+	if err != nil {
+		return "", err
+	}
+	nonce, err := generateToken()
+	if err != nil {
+		return "", err
+	}
+	verifier, challenge, err := pkceVerifier()
+	if err != nil {
+		return "", err
+	}
+	db.Exec(`DELETE FROM oidc_states WHERE expires_at < NOW()`)
+	_, err = db.Exec(`
+		INSERT INTO oidc_states (state_hash, code_verifier, nonce, link_user_id, expires_at)
+		VALUES ($1, $2, $3, NULLIF($4, 0), $5)`,
+		hashToken(state), verifier, nonce, linkUserID, time.Now().Add(oidcStateTTL))
+	if err != nil {
+		return "", err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/api/oidc",
+		MaxAge:   int(oidcStateTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(config.OIDCRedirectURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {config.OIDCClientID},
+		"redirect_uri":          {config.OIDCRedirectURL},
+		"scope":                 {strings.Join(config.OIDCScopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {challenge},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(meta.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return meta.AuthorizationEndpoint + sep + q.Encode(), nil
+}
+
+// oidcRole maps the groups claim to a role. ok is false when roles are not
+// managed by the provider.
+func oidcRole(groups []string) (role Role, ok bool) {
+	if len(config.OIDCAdminGroups) == 0 {
+		return RoleGuest, false
+	}
+	for _, g := range groups {
+		if containsString(config.OIDCAdminGroups, strings.ToLower(g)) {
+			return RoleAdmin, true
+		}
+	}
+	return RoleGuest, true
+}
+
+func oidcGroupAllowed(groups []string) bool {
+	if len(config.OIDCAllowedGroups) == 0 {
+		return true
+	}
+	for _, g := range groups {
+		if containsString(config.OIDCAllowedGroups, strings.ToLower(g)) {
+			return true
+		}
+	}
+	return false
+}
+
+// oidcUser finds, links or creates the user for a verified identity.
+func oidcUser(db *sql.DB, r *http.Request, claims *idTokenClaims, linkUserID int64) (*User, error) {
+	issuer := claims.Issuer
+	groups := claims.listClaim(config.OIDCGroupsClaim)
+	role, managed := oidcRole(groups)
+
+	var userID int64
+	err := db.QueryRow(`SELECT user_id FROM oidc_identities WHERE issuer = $1 AND subject = $2`,
+		issuer, claims.Subject).Scan(&userID)
+	switch {
+	case err == nil:
+		if linkUserID != 0 && linkUserID != userID {
+			return nil, &httpError{http.StatusConflict, "That identity is already linked to another account"}
+		}
+	case err != sql.ErrNoRows:
+		return nil, err
+	case linkUserID != 0:
+		if err := linkOIDCIdentity(db, linkUserID, issuer, claims.Subject); err != nil {
+			return nil, err
+		}
+		userID = linkUserID
+		recordAudit(db, r, auditOIDCLinked, usernameByID(db, userID), nil, "")
+	default:
+		username := claims.stringClaim(config.OIDCUsernameClaim)
+		if username == "" {
+			return nil, &httpError{http.StatusBadRequest, fmt.Sprintf("The identity provider sent no %s claim", config.OIDCUsernameClaim)}
+		}
+		if !externalUsernamePattern.MatchString(username) {
+			return nil, &httpError{http.StatusBadRequest, fmt.Sprintf("The identity provider sent an unusable username %q", username)}
+		}
+		if config.OIDCLinkByUsername {
+			// Never hand an admin account to whoever holds a matching name
+			// at the provider, and never take over an account another
+			// backend owns; admins link explicitly.
+			err := db.QueryRow(`
+				SELECT id FROM users
+				WHERE LOWER(username) = LOWER($1) AND auth_source = $2 AND NOT is_bot AND NOT bootstrap AND role <> $3`,
+				username, authSourceLocal, string(RoleAdmin)).Scan(&userID)
+			if err != nil && err != sql.ErrNoRows {
+				return nil, err
+			}
+		}
+		if userID != 0 {
+			if err := linkOIDCIdentity(db, userID, issuer, claims.Subject); err != nil {
+				return nil, err
+			}
+			recordAudit(db, r, auditOIDCLinked, username, nil, "by username")
+		} else if userID, err = provisionOIDCUser(db, username, role, issuer, claims.Subject); err != nil {
+			return nil, err
+		} else {
+			recordAudit(db, r, auditOIDCProvisioned, username, nil, "")
+			queueEvent(db, eventMemberJoined, User{ID: userID, Username: username, Role: role})
+		}
+	}
+
+	if managed {
+		db.Exec(`UPDATE users SET role = $1 WHERE id = $2 AND role <> $1`, string(role), userID)
+	}
+	db.Exec(`UPDATE oidc_identities SET last_login_at = NOW() WHERE issuer = $1 AND subject = $2`, issuer, claims.Subject)
+	user, ok := scanUser(db.QueryRow(`
+		SELECT id, username, role, avatar_url, is_bot, COALESCE(nickname, '') FROM users WHERE id = $1`, userID))
+	if !ok || user.Bot {
+		return nil, &httpError{http.StatusForbidden, "That account cannot sign in"}
+	}
+	return user, nil
+}
+
+func linkOIDCIdentity(db *sql.DB, userID int64, issuer, subject string) error {
+	res, err := db.Exec(`
+		INSERT INTO oidc_identities (issuer, subject, user_id) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING`,
+		issuer, subject, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return &httpError{http.StatusConflict, "That account is already linked to another identity"}
+	}
+	return nil
+}
+
+// provisionOIDCUser creates a user for a new identity. Its password is
+// random, so it can only sign in through the provider. Names are unique
+// case-insensitively, as for directory logins.
+func provisionOIDCUser(db *sql.DB, username string, role Role, issuer, subject string) (int64, error) {
+	password, err := generateToken()
+	if err != nil {
+		return 0, err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	taken := &httpError{http.StatusConflict, fmt.Sprintf(
+		"The username %s is taken. If it is yours, log in with your password and link your account", username)}
+	var exists bool
+	if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM users WHERE LOWER(username) = LOWER($1))`, username).Scan(&exists); err != nil {
+		return 0, err
+	} else if exists {
+		return 0, taken
+	}
+	var userID int64
+	err = tx.QueryRow(`
+		INSERT INTO users (username, password, role, auth_source) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (username) DO NOTHING RETURNING id`, username, password, string(role), authSourceOIDC).Scan(&userID)
+	if err == sql.ErrNoRows {
+		return 0, taken
+	} else if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`INSERT INTO oidc_identities (issuer, subject, user_id, provisioned) VALUES ($1, $2, $3, TRUE)`,
+		issuer, subject, userID); err != nil {
+		return 0, err
+	}
+	return userID, tx.Commit()
+}
+
+func usernameByID(db *sql.DB, userID int64) string {
+	var username string
+	db.QueryRow(`SELECT username FROM users WHERE id = $1`, userID).Scan(&username)
+	return username
+}
+
+// finishOIDC sends the browser back to the client with one fragment
+// parameter.
+func finishOIDC(w http.ResponseWriter, r *http.Request, key, value string) {
+	http.Redirect(w, r, config.OIDCPostLoginURL+"#"+url.Values{key: {value}}.Encode(), http.StatusFound)
+}
+
+var errOIDCDisabled = &httpError{http.StatusNotFound, "Single sign-on is not configured"}
+
+// --- Handlers ---
+
+// authConfigHandler tells clients which ways of logging in are available.
+func authConfigHandler(p *oidcProvider) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		resp := map[string]interface{}{
+			"password_login": config.PasswordLogin,
+			"registration":   registrationOpen(),
+			"oidc":           p != nil,
+		}
+		if p != nil {
+			resp["oidc_login_url"] = "/api/oidc/login"
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+func oidcLoginHandler(db *sql.DB, p *oidcProvider) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if p == nil {
+			writeError(w, errOIDCDisabled, "")
+			return
+		}
+		target, err := beginOIDC(w, db, p, 0)
+		if err != nil {
+			log.Printf("Failed to start OIDC login: %v", err)
+			http.Error(w, "Single sign-on is unavailable", http.StatusBadGateway)
+			return
+		}
+		http.Redirect(w, r, target, http.StatusFound)
+	}
+}
+
+// oidcLinkHandler starts the flow for a logged-in user, linking the identity
+// they sign in with to their account. It returns the URL to open, since a
+// redirect cannot carry the Authorization header.
+func oidcLinkHandler(db *sql.DB, p *oidcProvider) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if p == nil {
+			writeError(w, errOIDCDisabled, "")
+			return
+		}
+		user := userFromContext(r.Context())
+		if user == nil || user.Bot {
+			http.Error(w, "Only people can link an identity", http.StatusForbidden)
+			return
+		}
+		target, err := beginOIDC(w, db, p, user.ID)
+		if err != nil {
+			log.Printf("Failed to start OIDC link: %v", err)
+			http.Error(w, "Single sign-on is unavailable", http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"url": target})
+	}
+}
+
+func oidcCallbackHandler(db *sql.DB, p *oidcProvider) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if p == nil {
+			writeError(w, errOIDCDisabled, "")
+			return
+		}
+		q := r.URL.Query()
+		if e := q.Get("error"); e != "" {
+			if d := q.Get("error_description"); d != "" {
+				e = d
+			}
+			finishOIDC(w, r, "oidc_error", truncateRunes(e, 200))
+			return
+		}
+		// The state must come back to the browser it was issued to, or a
+		// link to this URL could sign someone into the sender's account.
+		cookie, err := r.Cookie(oidcStateCookie)
+		http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: "/api/oidc", MaxAge: -1})
+		if err != nil || q.Get("state") == "" ||
+			subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(q.Get("state"))) != 1 {
+			finishOIDC(w, r, "oidc_error", "Sign-in expired; please try again")
+			return
+		}
+		var verifier, nonce string
+		var linkUserID int64
+		err = db.QueryRow(`
+			DELETE FROM oidc_states WHERE state_hash = $1 AND expires_at > NOW()
+			RETURNING code_verifier, nonce, COALESCE(link_user_id, 0)`, hashToken(q.Get("state"))).
+			Scan(&verifier, &nonce, &linkUserID)
+		if err != nil {
+			finishOIDC(w, r, "oidc_error", "Sign-in expired; please try again")
+			return
+		}
+		meta, err := p.metadata()
+		if err != nil {
+			log.Printf("OIDC discovery failed: %v", err)
+			finishOIDC(w, r, "oidc_error", "Single sign-on is unavailable")
+			return
+		}
+		claims, err := p.exchange(meta, q.Get("code"), verifier, nonce)
+		if err != nil {
+			log.Printf("OIDC login failed: %v", err)
+			recordAudit(db, r, auditLoginFailed, "", nil, "oidc: "+err.Error())
+			finishOIDC(w, r, "oidc_error", "Sign-in failed")
+			return
+		}
+		if !oidcGroupAllowed(claims.listClaim(config.OIDCGroupsClaim)) {
+			recordAudit(db, r, auditLoginFailed, claims.stringClaim(config.OIDCUsernameClaim), nil, "oidc: not in an allowed group")
+			finishOIDC(w, r, "oidc_error", "Your account is not allowed to use this server")
+			return
+		}
+		user, err := oidcUser(db, r, claims, linkUserID)
+		if err != nil {
+			var he *httpError
+			if !errors.As(err, &he) {
+				log.Printf("OIDC login for %s failed: %v", claims.Subject, err)
+				he = &httpError{http.StatusInternalServerError, "Sign-in failed"}
+			}
+			finishOIDC(w, r, "oidc_error", he.msg)
+			return
+		}
+		if linkUserID != 0 {
+			finishOIDC(w, r, "oidc_linked", "1")
+			return
+		}
+
+		code, err := generateToken()
+		if err == nil {
+			_, err = db.Exec(`INSERT INTO oidc_login_codes (code_hash, user_id, expires_at) VALUES ($1, $2, $3)`,
+				hashToken(code), user.ID, time.Now().Add(oidcLoginCodeTTL))
+		}
+		if err != nil {
+			log.Printf("Failed to create OIDC login code for '%s': %v", user.Username, err)
+			finishOIDC(w, r, "oidc_error", "Sign-in failed")
+			return
+		}
+		recordAudit(db, r, auditLoginSucceeded, user.Username, nil, "oidc")
+		finishOIDC(w, r, "oidc_code", code)
+	}
+}
+
+// oidcSessionHandler trades the one-time code from the callback for a
+// session.
+func oidcSessionHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Code string `json:"code"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		db.Exec(`DELETE FROM oidc_login_codes WHERE expires_at < NOW()`)
+		user, ok := scanUser(db.QueryRow(`
+			WITH used AS (
+				DELETE FROM oidc_login_codes WHERE code_hash = $1 AND expires_at > NOW() RETURNING user_id)
+			SELECT u.id, u.username, u.role, u.avatar_url, u.is_bot, COALESCE(u.nickname, '')
+			FROM used JOIN users u ON u.id = used.user_id`, hashToken(req.Code)))
+		if !ok {
+			http.Error(w, "Invalid or expired code", http.StatusUnauthorized)
+			return
+		}
+		startSession(db, w, user)
+	}
+}
+
+// oidcIdentityHandler reports whether the caller's account is linked.
+func oidcIdentityHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := userFromContext(r.Context())
+		if user == nil {
+			http.Error(w, "User not found", http.StatusUnauthorized)
+			return
+		}
+		var linkedAt time.Time
+		var provisioned bool
+		err := db.QueryRow(`SELECT created_at, provisioned FROM oidc_identities WHERE user_id = $1 AND issuer = $2`,
+			user.ID, config.OIDCIssuer).Scan(&linkedAt, &provisioned)
+		if err != nil && err != sql.ErrNoRows {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		resp := map[string]interface{}{"linked": err == nil}
+		if err == nil {
+			resp["linked_at"] = linkedAt
+			resp["provisioned"] = provisioned
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// unlinkOIDCHandler removes the link between the caller's account and their
+// identity. Refused when password login is off or the account was created
+// by single sign-on, as they could not log in afterwards.
+func unlinkOIDCHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := userFromContext(r.Context())
+		if user == nil {
+			http.Error(w, "User not found", http.StatusUnauthorized)
+			return
+		}
+		if !config.PasswordLogin {
+			http.Error(w, "Password login is disabled, so single sign-on cannot be unlinked", http.StatusConflict)
+			return
+		}
+		res, err := db.Exec(`DELETE FROM oidc_identities WHERE user_id = $1 AND issuer = $2 AND NOT provisioned`,
+			user.ID, config.OIDCIssuer)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "Not linked, or the account was created by single sign-on", http.StatusNotFound)
+			return
+		}
+		recordAudit(db, r, auditOIDCUnlinked, user.Username, nil, "")
+		w.WriteHeader(http.StatusOK)
+	}
+}
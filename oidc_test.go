@@ -0,0 +1,309 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testClientID = "prisma"
+
+// mockOIDC is an identity provider serving discovery, a JWKS and a token
+// endpoint that answers every code with an ID token built from claims and
+// signed with key. The JWKS always publishes the key it started with.
+type mockOIDC struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+	kid string
+
+	mu     sync.Mutex
+	claims map[string]interface{}
+	form   url.Values
+}
+
+var (
+	testKeyOnce sync.Once
+	testKey     *rsa.PrivateKey
+)
+
+// testRSAKey is shared because generating 2048-bit keys is slow.
+func testRSAKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	testKeyOnce.Do(func() {
+		var err error
+		if testKey, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+			t.Fatal(err)
+		}
+	})
+	return testKey
+}
+
+func newMockOIDC(t *testing.T) *mockOIDC {
+	t.Helper()
+	m := &mockOIDC{key: testRSAKey(t), kid: "test-key"}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 m.URL,
+			"authorization_endpoint": m.URL + "/authorize",
+			"token_endpoint":         m.URL + "/token",
+			"jwks_uri":               m.URL + "/jwks",
+		})
+	})
+	published := m.key.PublicKey
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(jwksFor(jwkFor(m.kid, &published)))
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		m.mu.Lock()
+		m.form = r.PostForm
+		claims, key := m.claims, m.key
+		m.mu.Unlock()
+		if r.PostForm.Get("grant_type") != "authorization_code" || r.PostForm.Get("code_verifier") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_request"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": signJWT(t, key, m.kid, claims)})
+	})
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+
+	saved := config
+	t.Cleanup(func() { config = saved })
+	config.OIDCIssuer = m.URL
+	config.OIDCClientID = testClientID
+	config.OIDCClientSecret = ""
+	config.OIDCRedirectURL = "https://chat.example/api/oidc/callback"
+	config.OIDCPostLoginURL = "/"
+	return m
+}
+
+// validClaims returns claims the exchange accepts for nonce.
+func (m *mockOIDC) validClaims(nonce string) map[string]interface{} {
+	now := time.Now()
+	return map[string]interface{}{
+		"iss":                m.URL,
+		"sub":                "user-1",
+		"aud":                testClientID,
+		"exp":                now.Add(5 * time.Minute).Unix(),
+		"iat":                now.Unix(),
+		"nonce":              nonce,
+		"preferred_username": "alice",
+	}
+}
+
+func jwkFor(kid string, pub *rsa.PublicKey) map[string]string {
+	return map[string]string{
+		"kty": "RSA",
+		"kid": kid,
+		"use": "sig",
+		"alg": "RS256",
+		"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+	}
+}
+
+func jwksFor(keys ...map[string]string) []byte {
+	doc, _ := json.Marshal(map[string]interface{}{"keys": keys})
+	return doc
+}
+
+func signJWT(t *testing.T, key *rsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": kid})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestOIDCExchange(t *testing.T) {
+	m := newMockOIDC(t)
+	p := &oidcProvider{client: m.Client()}
+	meta, err := p.metadata()
+	if err != nil {
+		t.Fatalf("metadata: %v", err)
+	}
+	const nonce = "n-0S6_WzA2Mj"
+
+	tests := []struct {
+		name   string
+		modify func(c map[string]interface{})
+		want   string // substring of the error, or "" for success
+	}{
+		{"valid", func(c map[string]interface{}) {}, ""},
+		{"audience list with azp", func(c map[string]interface{}) {
+			c["aud"] = []string{testClientID, "other"}
+			c["azp"] = testClientID
+		}, ""},
+		{"bad nonce", func(c map[string]interface{}) { c["nonce"] = "replayed" }, "nonce"},
+		{"missing nonce", func(c map[string]interface{}) { delete(c, "nonce") }, "nonce"},
+		{"bad audience", func(c map[string]interface{}) { c["aud"] = "someone-else" }, "not for this client"},
+		{"audience list without azp", func(c map[string]interface{}) {
+			c["aud"] = []string{testClientID, "other"}
+		}, "another party"},
+		{"expired", func(c map[string]interface{}) {
+			c["exp"] = time.Now().Add(-jwtLeeway - time.Minute).Unix()
+		}, "expired"},
+		{"no expiry", func(c map[string]interface{}) { delete(c, "exp") }, "expired"},
+		{"issued in the future", func(c map[string]interface{}) {
+			c["iat"] = time.Now().Add(jwtLeeway + time.Minute).Unix()
+		}, "future"},
+		{"bad issuer", func(c map[string]interface{}) { c["iss"] = "https://evil.example" }, "issuer"},
+		{"no subject", func(c map[string]interface{}) { delete(c, "sub") }, "subject"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := m.validClaims(nonce)
+			tt.modify(claims)
+			m.mu.Lock()
+			m.claims = claims
+			m.mu.Unlock()
+
+			got, err := p.exchange(meta, "code-1", "verifier-1", nonce)
+			switch {
+			case tt.want == "" && err != nil:
+				t.Fatalf("exchange: %v", err)
+			case tt.want == "" && got.stringClaim("preferred_username") != "alice":
+				t.Errorf("claims = %+v", got.Raw)
+			case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+				t.Errorf("exchange error = %v, want one mentioning %q", err, tt.want)
+			}
+		})
+	}
+
+	m.mu.Lock()
+	form := m.form
+	m.mu.Unlock()
+	if form.Get("code") != "code-1" || form.Get("code_verifier") != "verifier-1" ||
+		form.Get("redirect_uri") != config.OIDCRedirectURL || form.Get("client_id") != testClientID {
+		t.Errorf("token request = %v", form)
+	}
+}
+
+func TestOIDCExchangeRejectsForeignSignature(t *testing.T) {
+	m := newMockOIDC(t)
+	p := &oidcProvider{client: m.Client()}
+	meta, err := p.metadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.mu.Lock()
+	m.key = other // signs with a key the JWKS does not publish
+	m.claims = m.validClaims("n")
+	m.mu.Unlock()
+	if _, err := p.exchange(meta, "code", "verifier", "n"); err == nil || !strings.Contains(err.Error(), "signature") {
+		t.Errorf("exchange error = %v, want an invalid signature", err)
+	}
+}
+
+func TestRSAKeysSkipsShortKeys(t *testing.T) {
+	weak, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := rsaKeys(jwksFor(jwkFor("weak", &weak.PublicKey), jwkFor("strong", &testRSAKey(t).PublicKey)))
+	if err != nil {
+		t.Fatalf("rsaKeys: %v", err)
+	}
+	if keys["weak"] != nil {
+		t.Error("rsaKeys accepted a 1024-bit key")
+	}
+	if keys["strong"] == nil {
+		t.Errorf("rsaKeys dropped the 2048-bit key: %v", keys)
+	}
+}
+
+// The callback refuses a state that was not issued to this browser before it
+// looks anything up, so it runs without a database here.
+func TestOIDCCallbackRequiresStateCookie(t *testing.T) {
+	m := newMockOIDC(t)
+	handler := oidcCallbackHandler(nil, &oidcProvider{client: m.Client()})
+
+	tests := []struct {
+		name   string
+		cookie string
+	}{
+		{"no cookie", ""},
+		{"other browser's state", "someone-elses-state"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/oidc/callback?code=c&state=attacker-state", nil)
+			if tt.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: oidcStateCookie, Value: tt.cookie})
+			}
+			rec := httptest.NewRecorder()
+			handler(rec, req)
+			if rec.Code != http.StatusFound || !strings.Contains(rec.Header().Get("Location"), "#oidc_error=") {
+				t.Fatalf("callback = %d, Location %q", rec.Code, rec.Header().Get("Location"))
+			}
+			if c := rec.Result().Cookies(); len(c) != 1 || c[0].Name != oidcStateCookie || c[0].MaxAge >= 0 {
+				t.Errorf("state cookie not cleared: %v", c)
+			}
+		})
+	}
+}
+
+// New identities only get names a directory could use, and never one that
+// differs from an existing account's by case alone.
+func TestOIDCUserChecksUsernames(t *testing.T) {
+	saved := config
+	t.Cleanup(func() { config = saved })
+	config.OIDCUsernameClaim = "preferred_username"
+	config.OIDCLinkByUsername = true
+	config.OIDCAdminGroups = nil
+
+	tests := []struct {
+		username string
+		want     int
+	}{
+		{"", http.StatusBadRequest},
+		{"has space", http.StatusBadRequest},
+		{"аdmin", http.StatusBadRequest}, // Cyrillic a
+		{strings.Repeat("a", 33), http.StatusBadRequest},
+		{"ADMIN", http.StatusConflict},
+	}
+	for _, tt := range tests {
+		db, f := newFakeDB(t, func(query string, args []driver.Value) (fakeResult, error) {
+			if strings.Contains(query, "SELECT EXISTS") {
+				return fakeRows([]driver.Value{true}), nil // "admin" exists
+			}
+			return fakeRows(), nil
+		})
+		claims := &idTokenClaims{Issuer: "https://idp.example", Subject: "s", Raw: map[string]interface{}{"preferred_username": tt.username}}
+		_, err := oidcUser(db, httptest.NewRequest(http.MethodGet, "/", nil), claims, 0)
+		var he *httpError
+		if !errors.As(err, &he) || he.status != tt.want {
+			t.Errorf("oidcUser(%q) error = %v, want status %d", tt.username, err, tt.want)
+		}
+		if f.ran("INSERT INTO users") {
+			t.Errorf("oidcUser(%q) created a user", tt.username)
+		}
+		if tt.want == http.StatusConflict && !f.ran("LOWER(username) = LOWER($1) AND auth_source = $2") {
+			t.Errorf("linking by username did not match case-insensitively on local accounts: %q", f.queries)
+		}
+	}
+}
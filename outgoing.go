@@ -0,0 +1,659 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// Outgoing webhooks notify external services of chat events. Events are
+// queued as rows in webhook_deliveries, one per subscribed webhook, in the
+// same request that caused them; a background dispatcher POSTs them and
+// retries failures with exponential backoff. Because the queue lives in
+// Postgres, pending deliveries survive restarts, and several servers can
+// share it.
+//
+// Each request carries
+//
+//	X-Prisma-Event:     the event type
+//	X-Prisma-Delivery:  the delivery ID, stable across retries
+//	X-Prisma-Timestamp: Unix seconds when the request was sent
+//	X-Prisma-Signature: sha256=<hex HMAC-SHA256 of "<timestamp>.<body>">
+//
+// keyed with the webhook's secret. The body is
+// {"id", "event", "created_at", "data"}.
+
+const (
+	eventMessageCreated = "message.created"
+	eventMessageUpdated = "message.updated"
+	eventMessageDeleted = "message.deleted"
+	eventChannelCreated = "channel.created"
+	eventChannelUpdated = "channel.updated"
+	eventChannelDeleted = "channel.deleted"
+	eventMemberJoined   = "member.joined"
+)
+
+var outgoingEventTypes = []string{
+	eventMessageCreated, eventMessageUpdated, eventMessageDeleted,
+	eventChannelCreated, eventChannelUpdated, eventChannelDeleted,
+	eventMemberJoined,
+}
+
+const (
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	deliveryFailed    = "failed"
+
+	deliveryBatchSize = 20
+	maxLoggedResponse = 1024
+	outgoingUserAgent = "PrismaWebhooks/1.0"
+)
+
+// OutgoingWebhook is an admin-registered receiver of chat events. Secret is
+// only returned when the webhook is created or its secret rotated.
+type OutgoingWebhook struct {
+	ID                  int64     `json:"id"`
+	Name                string    `json:"name"`
+	URL                 string    `json:"url"`
+	Events              []string  `json:"events"`
+	Enabled             bool      `json:"enabled"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	DisabledReason      string    `json:"disabled_reason,omitempty"`
+	Secret              string    `json:"secret,omitempty"`
+	CreatedBy           int64     `json:"created_by"`
+	CreatedAt           time.Time `json:"created_at"`
+}
+
+// WebhookDelivery is one entry of a webhook's delivery log.
+type WebhookDelivery struct {
+	ID             int64      `json:"id"`
+	WebhookID      int64      `json:"webhook_id"`
+	Event          string     `json:"event"`
+	Status         string     `json:"status"`
+	Attempts       int        `json:"attempts"`
+	ResponseStatus int        `json:"response_status,omitempty"`
+	ResponseBody   string     `json:"response_body,omitempty"`
+	LastError      string     `json:"last_error,omitempty"`
+	DurationMs     int64      `json:"duration_ms,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	LastAttemptAt  *time.Time `json:"last_attempt_at,omitempty"`
+	NextAttemptAt  *time.Time `json:"next_attempt_at,omitempty"`
+	DeliveredAt    *time.Time `json:"delivered_at,omitempty"`
+}
+
+// queueEvent records event for every enabled webhook subscribed to it.
+// Failures are logged rather than returned: a broken webhook table must not
+// stop the action that caused the event.
+func queueEvent(db *sql.DB, event string, data interface{}) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		log.Printf("Failed to encode %s event: %v", event, err)
+		return
+	}
+	_, err = db.Exec(`
+		INSERT INTO webhook_deliveries (webhook_id, event, payload)
+		SELECT id, $1, $2::jsonb FROM outgoing_webhooks WHERE enabled AND $1 = ANY(events)`, event, raw)
+	if err != nil {
+		log.Printf("Failed to queue %s event: %v", event, err)
+	}
+}
+
+// queueMessagesDeleted records a message.deleted event for every message in
+// a channel that is about to be deleted. It must run in the same transaction
+// as the delete, before the messages are gone.
+func queueMessagesDeleted(tx *sql.Tx, channelID int64) error {
+	_, err := tx.Exec(`
+		INSERT INTO webhook_deliveries (webhook_id, event, payload)
+		SELECT w.id, $2, jsonb_build_object('id', m.id, 'channel_id', m.channel_id)
+		FROM messages m CROSS JOIN outgoing_webhooks w
+		WHERE m.channel_id = $1 AND w.enabled AND $2 = ANY(w.events)
+		ORDER BY m.id`, channelID, eventMessageDeleted)
+	return err
+}
+
+// dropPendingDeliveries marks the deliveries still queued for a disabled
+// webhook as failed, so they are pruned with the rest of the log instead of
+// piling up until it is re-enabled.
+func dropPendingDeliveries(db *sql.DB, webhookID int64) {
+	_, err := db.Exec(`
+		UPDATE webhook_deliveries SET status = $1, last_error = 'Webhook disabled', next_attempt_at = NULL
+		WHERE webhook_id = $2 AND status = $3`, deliveryFailed, webhookID, deliveryPending)
+	if err != nil {
+		log.Printf("Failed to drop pending deliveries for webhook %d: %v", webhookID, err)
+	}
+}
+
+// queueDelivery records event for one webhook regardless of its
+// subscriptions, as used for dispatching slash commands. It reports false if
+// the webhook does not exist or is disabled.
+func queueDelivery(db *sql.DB, webhookID int64, event string, data interface{}) (bool, error) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return false, err
+	}
+	res, err := db.Exec(`
+		INSERT INTO webhook_deliveries (webhook_id, event, payload)
+		SELECT id, $2, $3::jsonb FROM outgoing_webhooks WHERE id = $1 AND enabled`, webhookID, event, raw)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// deliveryBackoff returns the delay before retrying after the given number
+// of failed attempts, with up to 10% jitter so failures spread out.
+func deliveryBackoff(attempts int) time.Duration {
+	d := config.OutgoingBackoffBase
+	for i := 1; i < attempts && d < config.OutgoingBackoffMax; i++ {
+		d *= 2
+	}
+	if d > config.OutgoingBackoffMax {
+		d = config.OutgoingBackoffMax
+	}
+	return d + time.Duration(rand.Int63n(int64(d)/10+1))
+}
+
+func signDelivery(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// --- Dispatcher ---
+
+type outgoingDispatcher struct {
+	db     *sql.DB
+	client *http.Client
+}
+
+func newOutgoingDispatcher(db *sql.DB) *outgoingDispatcher {
+	client := &http.Client{Timeout: config.OutgoingTimeout}
+	if !config.OutgoingAllowPrivate {
+		client = newPublicHTTPClient(config.OutgoingTimeout)
+	}
+	// A redirected POST turns into a GET; treat redirects as failures instead.
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	return &outgoingDispatcher{db: db, client: client}
+}
+
+// run delivers due events until the process exits. Old log entries are
+// pruned once an hour.
+func (d *outgoingDispatcher) run() {
+	ticker := time.NewTicker(config.OutgoingPollInterval)
+	defer ticker.Stop()
+	var lastPrune time.Time
+	for range ticker.C {
+		for d.deliverDue() == deliveryBatchSize {
+			// A full batch means more may be due.
+		}
+		if time.Since(lastPrune) > time.Hour {
+			d.prune()
+			lastPrune = time.Now()
+		}
+	}
+}
+
+type claimedDelivery struct {
+	id, webhookID int64
+	event         string
+	payload       []byte
+	attempts      int
+	createdAt     time.Time
+	url, secret   string
+}
+
+// deliverDue claims a batch of due deliveries and sends them, returning how
+// many were claimed. Claiming pushes next_attempt_at past the request
+// timeout, so a delivery held by a server that dies is picked up again.
+func (d *outgoingDispatcher) deliverDue() int {
+	lease := 2*config.OutgoingTimeout + time.Minute
+	rows, err := d.db.Query(`
+		UPDATE webhook_deliveries wd SET next_attempt_at = NOW() + $1 * INTERVAL '1 second'
+		FROM outgoing_webhooks w
+		WHERE w.id = wd.webhook_id AND wd.id IN (
+			SELECT d.id FROM webhook_deliveries d JOIN outgoing_webhooks ow ON ow.id = d.webhook_id
+			WHERE d.status = $2 AND d.next_attempt_at <= NOW() AND ow.enabled
+			ORDER BY d.next_attempt_at LIMIT $3 FOR UPDATE OF d SKIP LOCKED)
+		RETURNING wd.id, wd.webhook_id, wd.event, wd.payload, wd.attempts, wd.created_at, w.url, w.secret`,
+		int(lease.Seconds()), deliveryPending, deliveryBatchSize)
+	if err != nil {
+		log.Printf("Failed to claim webhook deliveries: %v", err)
+		return 0
+	}
+	var batch []claimedDelivery
+	for rows.Next() {
+		var c claimedDelivery
+		if err := rows.Scan(&c.id, &c.webhookID, &c.event, &c.payload, &c.attempts, &c.createdAt, &c.url, &c.secret); err == nil {
+			batch = append(batch, c)
+		}
+	}
+	rows.Close()
+	// Sent concurrently so a batch finishes within one request timeout,
+	// well inside the lease.
+	var wg sync.WaitGroup
+	for _, c := range batch {
+		wg.Add(1)
+		go func(c claimedDelivery) {
+			defer wg.Done()
+			d.deliver(c)
+		}(c)
+	}
+	wg.Wait()
+	return len(batch)
+}
+
+// deliver makes one attempt at c and records the outcome.
+func (d *outgoingDispatcher) deliver(c claimedDelivery) {
+	body, _ := json.Marshal(map[string]interface{}{
+		"id":         c.id,
+		"event":      c.event,
+		"created_at": c.createdAt,
+		"data":       json.RawMessage(c.payload),
+	})
+	timestamp := time.Now().Unix()
+
+	var status int
+	var respBody, errMsg string
+	start := time.Now()
+	req, err := http.NewRequest(http.MethodPost, c.url, bytes.NewReader(body))
+	if err == nil {
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", outgoingUserAgent)
+		req.Header.Set("X-Prisma-Event", c.event)
+		req.Header.Set("X-Prisma-Delivery", strconv.FormatInt(c.id, 10))
+		req.Header.Set("X-Prisma-Timestamp", strconv.FormatInt(timestamp, 10))
+		req.Header.Set("X-Prisma-Signature", signDelivery(c.secret, timestamp, body))
+		var resp *http.Response
+		if resp, err = d.client.Do(req); err == nil {
+			status = resp.StatusCode
+			snippet, _ := io.ReadAll(io.LimitReader(resp.Body, maxLoggedResponse))
+			respBody = strings.ToValidUTF8(string(snippet), "")
+			resp.Body.Close()
+		}
+	}
+	duration := time.Since(start)
+	attempts := c.attempts + 1
+	ok := err == nil && status >= 200 && status < 300
+	if err != nil {
+		errMsg = err.Error()
+	} else if !ok {
+		errMsg = fmt.Sprintf("unexpected status %d", status)
+	}
+
+	if ok {
+		_, err = d.db.Exec(`
+			UPDATE webhook_deliveries SET status = $1, attempts = $2, response_status = $3, response_body = $4,
+				last_error = NULL, duration_ms = $5, last_attempt_at = NOW(), delivered_at = NOW(), next_attempt_at = NULL
+			WHERE id = $6`, deliveryDelivered, attempts, status, respBody, duration.Milliseconds(), c.id)
+		if err == nil {
+			_, err = d.db.Exec(`UPDATE outgoing_webhooks SET consecutive_failures = 0 WHERE id = $1`, c.webhookID)
+		}
+		if err != nil {
+			log.Printf("Failed to record webhook delivery %d: %v", c.id, err)
+		}
+		return
+	}
+
+	newStatus, next := deliveryPending, sql.NullTime{Time: time.Now().Add(deliveryBackoff(attempts)), Valid: true}
+	if attempts >= config.OutgoingMaxAttempts {
+		newStatus, next = deliveryFailed, sql.NullTime{}
+	}
+	_, err = d.db.Exec(`
+		UPDATE webhook_deliveries SET status = $1, attempts = $2, response_status = NULLIF($3, 0), response_body = $4,
+			last_error = $5, duration_ms = $6, last_attempt_at = NOW(), next_attempt_at = $7
+		WHERE id = $8`, newStatus, attempts, status, respBody, errMsg, duration.Milliseconds(), next, c.id)
+	if err != nil {
+		log.Printf("Failed to record webhook delivery %d: %v", c.id, err)
+	}
+	var disabled bool
+	reason := fmt.Sprintf("Disabled after %d consecutive failed deliveries", config.OutgoingDisableAfter)
+	err = d.db.QueryRow(`
+		UPDATE outgoing_webhooks SET consecutive_failures = consecutive_failures + 1,
+			enabled = enabled AND consecutive_failures + 1 < $1,
+			disabled_reason = CASE WHEN enabled AND consecutive_failures + 1 >= $1 THEN $2 ELSE disabled_reason END
+		WHERE id = $3 RETURNING NOT enabled AND consecutive_failures = $1`,
+		config.OutgoingDisableAfter, reason, c.webhookID).Scan(&disabled)
+	if err != nil {
+		log.Printf("Failed to record webhook failure for %d: %v", c.webhookID, err)
+	} else if disabled {
+		log.Printf("Outgoing webhook %d is disabled after repeated failures", c.webhookID)
+		dropPendingDeliveries(d.db, c.webhookID)
+	}
+}
+
+// prune drops log entries older than config.OutgoingLogRetention that are no
+// longer pending.
+func (d *outgoingDispatcher) prune() {
+	res, err := d.db.Exec(`
+		DELETE FROM webhook_deliveries WHERE status <> $1 AND created_at < NOW() - $2 * INTERVAL '1 second'`,
+		deliveryPending, int64(config.OutgoingLogRetention.Seconds()))
+	if err != nil {
+		log.Printf("Failed to prune webhook deliveries: %v", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Printf("Pruned %d old webhook deliveries", n)
+	}
+}
+
+// --- Handlers ---
+
+const outgoingWebhookSelect = `
+	SELECT id, name, url, events, enabled, consecutive_failures, COALESCE(disabled_reason, ''), created_by, created_at
+	FROM outgoing_webhooks`
+
+func scanOutgoingWebhook(row rowScanner) (OutgoingWebhook, error) {
+	var wh OutgoingWebhook
+	err := row.Scan(&wh.ID, &wh.Name, &wh.URL, pq.Array(&wh.Events), &wh.Enabled, &wh.ConsecutiveFailures,
+		&wh.DisabledReason, &wh.CreatedBy, &wh.CreatedAt)
+	if wh.Events == nil {
+		wh.Events = []string{}
+	}
+	return wh, err
+}
+
+// outgoingWebhookRequest is the body of create and update requests. Fields
+// left out of an update keep their value.
+type outgoingWebhookRequest struct {
+	Name    *string   `json:"name"`
+	URL     *string   `json:"url"`
+	Events  *[]string `json:"events"`
+	Enabled *bool     `json:"enabled"`
+}
+
+func (req outgoingWebhookRequest) validate() error {
+	if req.Name != nil && strings.TrimSpace(*req.Name) == "" {
+		return &httpError{http.StatusBadRequest, "Name cannot be empty"}
+	}
+	if req.URL != nil {
+		if !isHTTPURL(*req.URL) {
+			return &httpError{http.StatusBadRequest, "URL must be an http(s) URL"}
+		}
+		// The public client only dials the standard ports; catch other
+		// ports here rather than on the first delivery.
+		u, _ := url.Parse(*req.URL)
+		if port := u.Port(); port != "" && port != "80" && port != "443" && !config.OutgoingAllowPrivate {
+			return &httpError{http.StatusBadRequest, "URL must use port 80 or 443"}
+		}
+	}
+	if req.Events != nil {
+		if len(*req.Events) == 0 {
+			return &httpError{http.StatusBadRequest, "Subscribe to at least one event"}
+		}
+		for _, e := range *req.Events {
+			if !containsString(outgoingEventTypes, e) {
+				return &httpError{http.StatusBadRequest, fmt.Sprintf("Unknown event type %q", e)}
+			}
+		}
+	}
+	return nil
+}
+
+func listOutgoingWebhooksHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isAdmin(userFromContext(r.Context())) {
+			http.Error(w, "Admin access required", http.StatusForbidden)
+			return
+		}
+		rows, err := db.Query(outgoingWebhookSelect + ` ORDER BY id`)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+		webhooks := []OutgoingWebhook{}
+		for rows.Next() {
+			if wh, err := scanOutgoingWebhook(rows); err == nil {
+				webhooks = append(webhooks, wh)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"webhooks": webhooks, "event_types": outgoingEventTypes})
+	}
+}
+
+func createOutgoingWebhookHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := userFromContext(r.Context())
+		if !isAdmin(user) {
+			http.Error(w, "Admin access required", http.StatusForbidden)
+			return
+		}
+		var req outgoingWebhookRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if req.Name == nil || req.URL == nil || req.Events == nil {
+			http.Error(w, "Missing fields", http.StatusBadRequest)
+			return
+		}
+		if err := req.validate(); err != nil {
+			writeError(w, err, "")
+			return
+		}
+		secret, err := generateToken()
+		if err != nil {
+			http.Error(w, "Failed to create webhook", http.StatusInternalServerError)
+			return
+		}
+		wh, err := scanOutgoingWebhook(db.QueryRow(`
+			INSERT INTO outgoing_webhooks (name, url, events, secret, created_by) VALUES ($1, $2, $3, $4, $5)
+			RETURNING id, name, url, events, enabled, consecutive_failures, COALESCE(disabled_reason, ''), created_by, created_at`,
+			strings.TrimSpace(*req.Name), *req.URL, pq.Array(*req.Events), secret, user.ID))
+		if err != nil {
+			log.Printf("DB Error creating outgoing webhook: %v", err)
+			http.Error(w, "Failed to create webhook", http.StatusInternalServerError)
+			return
+		}
+		wh.Secret = secret
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(wh)
+	}
+}
+
+// updateOutgoingWebhookHandler edits a webhook. Re-enabling it clears the
+// failure count; deliveries still pending when it is disabled are dropped.
+func updateOutgoingWebhookHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isAdmin(userFromContext(r.Context())) {
+			http.Error(w, "Admin access required", http.StatusForbidden)
+			return
+		}
+		id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid webhook ID", http.StatusBadRequest)
+			return
+		}
+		var req outgoingWebhookRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := req.validate(); err != nil {
+			writeError(w, err, "")
+			return
+		}
+		var events interface{}
+		if req.Events != nil {
+			events = pq.Array(*req.Events)
+		}
+		wh, err := scanOutgoingWebhook(db.QueryRow(`
+			UPDATE outgoing_webhooks SET
+				name = COALESCE($1, name),
+				url = COALESCE($2, url),
+				events = COALESCE($3, events),
+				consecutive_failures = CASE WHEN $4 AND NOT enabled THEN 0 ELSE consecutive_failures END,
+				disabled_reason = CASE WHEN $4 THEN NULL WHEN NOT $4 AND enabled THEN 'Disabled by an admin' ELSE disabled_reason END,
+				enabled = COALESCE($4, enabled)
+			WHERE id = $5
+			RETURNING id, name, url, events, enabled, consecutive_failures, COALESCE(disabled_reason, ''), created_by, created_at`,
+			req.Name, req.URL, events, req.Enabled, id))
+		if err == sql.ErrNoRows {
+			http.Error(w, "Webhook not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Printf("DB Error updating outgoing webhook: %v", err)
+			http.Error(w, "Failed to update webhook", http.StatusInternalServerError)
+			return
+		}
+		if !wh.Enabled {
+			dropPendingDeliveries(db, wh.ID)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(wh)
+	}
+}
+
+func rotateOutgoingWebhookSecretHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isAdmin(userFromContext(r.Context())) {
+			http.Error(w, "Admin access required", http.StatusForbidden)
+			return
+		}
+		id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid webhook ID", http.StatusBadRequest)
+			return
+		}
+		secret, err := generateToken()
+		if err != nil {
+			http.Error(w, "Failed to rotate secret", http.StatusInternalServerError)
+			return
+		}
+		wh, err := scanOutgoingWebhook(db.QueryRow(`
+			UPDATE outgoing_webhooks SET secret = $1 WHERE id = $2
+			RETURNING id, name, url, events, enabled, consecutive_failures, COALESCE(disabled_reason, ''), created_by, created_at`,
+			secret, id))
+		if err == sql.ErrNoRows {
+			http.Error(w, "Webhook not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		wh.Secret = secret
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(wh)
+	}
+}
+
+func deleteOutgoingWebhookHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isAdmin(userFromContext(r.Context())) {
+			http.Error(w, "Admin access required", http.StatusForbidden)
+			return
+		}
+		id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid webhook ID", http.StatusBadRequest)
+			return
+		}
+		res, err := db.Exec(`DELETE FROM outgoing_webhooks WHERE id = $1`, id)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "Webhook not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// webhookDeliveriesHandler returns a webhook's delivery log, newest first.
+// Accepts status, limit and offset.
+func webhookDeliveriesHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isAdmin(userFromContext(r.Context())) {
+			http.Error(w, "Admin access required", http.StatusForbidden)
+			return
+		}
+		id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid webhook ID", http.StatusBadRequest)
+			return
+		}
+		q := r.URL.Query()
+		limit, offset := pageParams(q)
+		rows, err := db.Query(`
+			SELECT id, webhook_id, event, status, attempts, COALESCE(response_status, 0), COALESCE(response_body, ''),
+				COALESCE(last_error, ''), COALESCE(duration_ms, 0), created_at, last_attempt_at, next_attempt_at, delivered_at
+			FROM webhook_deliveries WHERE webhook_id = $1 AND ($2 = '' OR status = $2)
+			ORDER BY id DESC LIMIT $3 OFFSET $4`, id, q.Get("status"), limit, offset)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+		deliveries := []WebhookDelivery{}
+		for rows.Next() {
+			var d WebhookDelivery
+			var last, next, delivered sql.NullTime
+			if err := rows.Scan(&d.ID, &d.WebhookID, &d.Event, &d.Status, &d.Attempts, &d.ResponseStatus, &d.ResponseBody,
+				&d.LastError, &d.DurationMs, &d.CreatedAt, &last, &next, &delivered); err != nil {
+				continue
+			}
+			d.LastAttemptAt, d.NextAttemptAt, d.DeliveredAt = nullTimePtr(last), nullTimePtr(next), nullTimePtr(delivered)
+			deliveries = append(deliveries, d)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(deliveries)
+	}
+}
+
+// redeliverHandler queues a logged delivery to be sent again now.
+func redeliverHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isAdmin(userFromContext(r.Context())) {
+			http.Error(w, "Admin access required", http.StatusForbidden)
+			return
+		}
+		vars := mux.Vars(r)
+		webhookID, err1 := strconv.ParseInt(vars["id"], 10, 64)
+		deliveryID, err2 := strconv.ParseInt(vars["delivery"], 10, 64)
+		if err1 != nil || err2 != nil {
+			http.Error(w, "Invalid delivery ID", http.StatusBadRequest)
+			return
+		}
+		res, err := db.Exec(`
+			UPDATE webhook_deliveries SET status = $1, attempts = 0, next_attempt_at = NOW()
+			WHERE id = $2 AND webhook_id = $3`, deliveryPending, deliveryID, webhookID)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "Delivery not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+func nullTimePtr(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignDelivery(t *testing.T) {
+	body := []byte(`{"id":1,"event":"message.created"}`)
+	got := signDelivery("s3cret", 1700000000, body)
+
+	// What a receiver computes from the headers and the raw body.
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte("1700000000."))
+	mac.Write(body)
+	if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); got != want {
+		t.Errorf("signDelivery = %s, want %s", got, want)
+	}
+	if !strings.HasPrefix(got, "sha256=") || len(got) != len("sha256=")+64 {
+		t.Errorf("signature %q is not sha256=<64 hex digits>", got)
+	}
+
+	for name, other := range map[string]string{
+		"secret":    signDelivery("other", 1700000000, body),
+		"timestamp": signDelivery("s3cret", 1700000001, body),
+		"body":      signDelivery("s3cret", 1700000000, append(body, ' ')),
+	} {
+		if other == got {
+			t.Errorf("changing the %s does not change the signature", name)
+		}
+	}
+}
+
+func TestDeliveryBackoff(t *testing.T) {
+	saved := config
+	t.Cleanup(func() { config = saved })
+	config.OutgoingBackoffBase = 30 * time.Second
+	config.OutgoingBackoffMax = time.Hour
+
+	tests := []struct {
+		attempts int
+		base     time.Duration
+	}{
+		{0, 30 * time.Second},
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{7, 32 * time.Minute},
+		{8, time.Hour},
+		{50, time.Hour},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 20; i++ {
+			got := deliveryBackoff(tt.attempts)
+			if got < tt.base || got > tt.base+tt.base/10 {
+				t.Errorf("deliveryBackoff(%d) = %s, want %s plus up to 10%%", tt.attempts, got, tt.base)
+				break
+			}
+		}
+	}
+}
+
+func TestOutgoingWebhookRequestValidate(t *testing.T) {
+	saved := config
+	t.Cleanup(func() { config = saved })
+	config.OutgoingAllowPrivate = false
+
+	str := func(s string) *string { return &s }
+	events := func(e ...string) *[]string { return &e }
+	tests := []struct {
+		name string
+		req  outgoingWebhookRequest
+		ok   bool
+	}{
+		{"empty update", outgoingWebhookRequest{}, true},
+		{"https", outgoingWebhookRequest{URL: str("https://hooks.example.com/x")}, true},
+		{"explicit 443", outgoingWebhookRequest{URL: str("https://hooks.example.com:443/x")}, true},
+		{"other port", outgoingWebhookRequest{URL: str("http://hooks.example.com:8080/x")}, false},
+		{"other scheme", outgoingWebhookRequest{URL: str("ftp://hooks.example.com/x")}, false},
+		{"credentials", outgoingWebhookRequest{URL: str("https://u:p@hooks.example.com/x")}, false},
+		{"blank name", outgoingWebhookRequest{Name: str("  ")}, false},
+		{"known event", outgoingWebhookRequest{Events: events(outgoingEventTypes[0])}, true},
+		{"no events", outgoingWebhookRequest{Events: events()}, false},
+		{"unknown event", outgoingWebhookRequest{Events: events("user.hacked")}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.req.validate(); (err == nil) != tt.ok {
+			t.Errorf("%s: validate = %v", tt.name, err)
+		}
+	}
+
+	config.OutgoingAllowPrivate = true
+	if err := (outgoingWebhookRequest{URL: str("http://10.0.0.5:8080/x")}).validate(); err != nil {
+		t.Errorf("with private targets allowed: validate = %v", err)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Image proxy: external images in message payloads are rewritten to
+// /api/proxy/<sig>/<url> so viewers never contact the origin host and
+// plain-http images load on https pages. URLs are signed by the server, so
+// the proxy cannot be used to fetch arbitrary addresses. Responses are
+// cached in the blob store for config.ProxyCacheTTL.
+
+// proxyAllowedTypes are the sniffed types the proxy will serve. SVG is
+// excluded because it can carry script.
+var proxyAllowedTypes = []string{
+	"image/png", "image/jpeg", "image/gif", "image/webp", "image/bmp", "image/x-icon", "image/vnd.microsoft.icon",
+}
+
+// proxyURL returns the signed proxy URL for an external image, or "" if the
+// proxy is disabled or raw is not an http(s) URL. Like signed upload URLs it
+// expires after config.SignedURLTTL, rounded up to the hour.
+func proxyURL(raw string) string {
+	if !config.ImageProxy || !isHTTPURL(raw) {
+		return ""
+	}
+	expires := time.Now().Add(config.SignedURLTTL).Truncate(time.Hour).Add(time.Hour).Unix()
+	return fmt.Sprintf("/api/proxy/%s/%s?expires=%d",
+		proxySignature(raw, expires), base64.RawURLEncoding.EncodeToString([]byte(raw)), expires)
+}
+
+func proxySignature(raw string, expires int64) string {
+	mac := hmac.New(sha256.New, config.SigningKey)
+	fmt.Fprintf(mac, "proxy\n%s\n%d", raw, expires)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+type proxiedImage struct {
+	contentType string
+	data        []byte
+	fetchedAt   time.Time
+}
+
+type imageProxy struct {
+	db     *sql.DB
+	blobs  BlobStore
+	client *http.Client
+}
+
+func newImageProxy(db *sql.DB, blobs BlobStore) *imageProxy {
+	return &imageProxy{db: db, blobs: blobs, client: newPublicHTTPClient(config.ProxyTimeout)}
+}
+
+// proxyCacheKey names the cached copy of raw in the blob store.
+func proxyCacheKey(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return "proxy_" + hex.EncodeToString(sum[:])
+}
+
+func (p *imageProxy) handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !config.ImageProxy {
+			http.NotFound(w, r)
+			return
+		}
+		vars := mux.Vars(r)
+		rawBytes, err := base64.RawURLEncoding.DecodeString(vars["url"])
+		raw := string(rawBytes)
+		expires, perr := strconv.ParseInt(r.URL.Query().Get("expires"), 10, 64)
+		if err != nil || perr != nil || !hmac.Equal([]byte(proxySignature(raw, expires)), []byte(vars["sig"])) {
+			http.Error(w, "Invalid signature", http.StatusForbidden)
+			return
+		}
+		if time.Now().Unix() > expires {
+			http.Error(w, "Link expired", http.StatusForbidden)
+			return
+		}
+
+		img, err := p.cached(r.Context(), raw)
+		if err != nil {
+			img, err = p.fetch(r.Context(), raw)
+		}
+		if err != nil {
+			log.Printf("Image proxy failed for %s: %v", raw, err)
+			writeError(w, err, "Failed to fetch image")
+			return
+		}
+
+		w.Header().Set("Content-Type", img.contentType)
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Content-Security-Policy", "default-src 'none'; sandbox")
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(config.ProxyCacheTTL.Seconds())))
+		http.ServeContent(w, r, "", img.fetchedAt, bytes.NewReader(img.data))
+	}
+}
+
+// cached returns a fresh cached copy of raw.
+func (p *imageProxy) cached(ctx context.Context, raw string) (*proxiedImage, error) {
+	img := &proxiedImage{}
+	var key string
+	err := p.db.QueryRow(`SELECT blob_key, content_type, fetched_at FROM proxy_cache WHERE url_hash = $1`,
+		proxyCacheKey(raw)).Scan(&key, &img.contentType, &img.fetchedAt)
+	if err != nil {
+		return nil, err
+	}
+	if time.Since(img.fetchedAt) > config.ProxyCacheTTL {
+		return nil, sql.ErrNoRows
+	}
+	rc, _, err := p.blobs.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	if img.data, err = io.ReadAll(io.LimitReader(rc, config.ProxyMaxBytes)); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+var (
+	errProxyUpstream    = &httpError{http.StatusBadGateway, "Failed to fetch image"}
+	errProxyTooLarge    = &httpError{http.StatusBadGateway, "Image too large"}
+	errProxyUnsupported = &httpError{http.StatusUnsupportedMediaType, "Unsupported image type"}
+)
+
+// fetch downloads raw, checks its size and sniffed type, and caches it.
+func (p *imageProxy) fetch(ctx context.Context, raw string) (*proxiedImage, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.ProxyTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, raw, nil)
+	if err != nil {
+		return nil, errProxyUpstream
+	}
+	req.Header.Set("User-Agent", unfurlUserAgent)
+	req.Header.Set("Accept", "image/*")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		log.Printf("Image proxy request for %s failed: %v", raw, err)
+		return nil, errProxyUpstream
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errProxyUpstream
+	}
+	if resp.ContentLength > config.ProxyMaxBytes {
+		return nil, errProxyTooLarge
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, config.ProxyMaxBytes+1))
+	if err != nil {
+		return nil, errProxyUpstream
+	}
+	if int64(len(data)) > config.ProxyMaxBytes {
+		return nil, errProxyTooLarge
+	}
+	// The origin's Content-Type is not trusted; the bytes have to be an image.
+	contentType := detectContentType(data)
+	if !containsString(proxyAllowedTypes, contentType) {
+		return nil, errProxyUnsupported
+	}
+
+	img := &proxiedImage{contentType: contentType, data: data, fetchedAt: time.Now()}
+	key := proxyCacheKey(raw)
+	if err := p.blobs.Put(ctx, key, bytes.NewReader(data), int64(len(data)), contentType); err != nil {
+		log.Printf("Failed to cache proxied image %s: %v", raw, err)
+		return img, nil
+	}
+	_, err = p.db.Exec(`
+		INSERT INTO proxy_cache (url_hash, url, blob_key, content_type, size, fetched_at) VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (url_hash) DO UPDATE SET content_type = EXCLUDED.content_type, size = EXCLUDED.size, fetched_at = EXCLUDED.fetched_at`,
+		key, raw, key, contentType, len(data), img.fetchedAt)
+	if err != nil {
+		log.Printf("Failed to record proxied image %s: %v", raw, err)
+	}
+	return img, nil
+}
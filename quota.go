@@ -0,0 +1,189 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+var (
+	errQuotaExceeded       = &httpError{http.StatusRequestEntityTooLarge, "Storage quota exceeded"}
+	errStorageLimitReached = &httpError{http.StatusInsufficientStorage, "Server storage limit reached"}
+)
+
+// queryer is a *sql.DB or *sql.Tx.
+type queryer interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// storageLimitLock is the advisory lock key serializing quota checks against
+// config.GlobalStorageLimit.
+const storageLimitLock = 0x51554f5441
+
+// lockStorageQuota serializes quota checks for userID until tx ends, so that
+// concurrent uploads cannot all pass checkStorageQuota before any of them is
+// recorded. Callers check and record the new bytes inside tx.
+func lockStorageQuota(tx *sql.Tx, userID int64) error {
+	var id int64
+	if err := tx.QueryRow(`SELECT id FROM users WHERE id = $1 FOR UPDATE`, userID).Scan(&id); err != nil {
+		return err
+	}
+	if config.GlobalStorageLimit > 0 {
+		if _, err := tx.Exec(`SELECT pg_advisory_xact_lock($1)`, storageLimitLock); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// userQuota returns the quota that applies to a user in bytes, 0 meaning
+// unlimited. A personal quota overrides the one for the user's role.
+func userQuota(db queryer, userID int64) (int64, error) {
+	var role string
+	var personal sql.NullInt64
+	err := db.QueryRow(`SELECT role, storage_quota FROM users WHERE id = $1`, userID).Scan(&role, &personal)
+	if err != nil {
+		return 0, err
+	}
+	if personal.Valid {
+		return personal.Int64, nil
+	}
+	if quota, ok := config.RoleQuotas[Role(role)]; ok {
+		return quota, nil
+	}
+	return config.DefaultQuota, nil
+}
+
+// storageUsage sums a user's stored uploads and avatar, and the declared
+// length of their unfinished resumable uploads.
+func storageUsage(db queryer, userID int64) (StorageUsage, error) {
+	var usage StorageUsage
+	err := db.QueryRow(`
+		SELECT COALESCE(SUM(filesize), 0) + (SELECT COALESCE(avatar_size, 0) FROM users WHERE id = $1), COUNT(*)
+		FROM uploads WHERE user_id = $1`, userID).Scan(&usage.Used, &usage.UploadCount)
+	if err != nil {
+		return usage, err
+	}
+	err = db.QueryRow(`SELECT COALESCE(SUM(length), 0) FROM resumable_uploads WHERE user_id = $1`, userID).
+		Scan(&usage.Reserved)
+	return usage, err
+}
+
+// checkStorageQuota fails with errQuotaExceeded when storing incoming more
+// bytes would take the user, or the server as a whole, over its limit.
+// Unfinished resumable uploads count against the limit when countReserved is
+// set, which callers clear when the bytes being checked are one of them.
+// Checks that are followed by storing the bytes run inside a transaction
+// holding lockStorageQuota.
+func checkStorageQuota(db queryer, userID, incoming int64, countReserved bool) error {
+	quota, err := userQuota(db, userID)
+	if err != nil {
+		return err
+	}
+	if quota > 0 {
+		usage, err := storageUsage(db, userID)
+		if err != nil {
+			return err
+		}
+		total := usage.Used + incoming
+		if countReserved {
+			total += usage.Reserved
+		}
+		if total > quota {
+			return errQuotaExceeded
+		}
+	}
+	if config.GlobalStorageLimit > 0 {
+		var used, reserved int64
+		err := db.QueryRow(`
+			SELECT (SELECT COALESCE(SUM(filesize), 0) FROM uploads) + (SELECT COALESCE(SUM(avatar_size), 0) FROM users)`).
+			Scan(&used)
+		if err != nil {
+			return err
+		}
+		if countReserved {
+			if err := db.QueryRow(`SELECT COALESCE(SUM(length), 0) FROM resumable_uploads`).Scan(&reserved); err != nil {
+				return err
+			}
+		}
+		if used+reserved+incoming > config.GlobalStorageLimit {
+			return errStorageLimitReached
+		}
+	}
+	return nil
+}
+
+func getStorageUsageHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := userFromContext(r.Context())
+		if user == nil {
+			http.Error(w, "User not found", http.StatusUnauthorized)
+			return
+		}
+		usage, err := storageUsage(db, user.ID)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		quota, err := userQuota(db, user.ID)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if quota > 0 {
+			remaining := quota - usage.Used - usage.Reserved
+			if remaining < 0 {
+				remaining = 0
+			}
+			usage.Quota, usage.Remaining = &quota, &remaining
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(usage)
+	}
+}
+
+// setUserQuotaHandler lets admins give a user a personal quota. A null quota
+// returns the user to their role's default.
+func setUserQuotaHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isAdmin(userFromContext(r.Context())) {
+			http.Error(w, "Admin access required", http.StatusForbidden)
+			return
+		}
+		userID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid user ID", http.StatusBadRequest)
+			return
+		}
+		var req struct {
+			Quota *int64 `json:"quota"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if req.Quota != nil && *req.Quota < 0 {
+			http.Error(w, "Quota cannot be negative", http.StatusBadRequest)
+			return
+		}
+		var quota sql.NullInt64
+		if req.Quota != nil {
+			quota = sql.NullInt64{Int64: *req.Quota, Valid: true}
+		}
+		res, err := db.Exec(`UPDATE users SET storage_quota = $1 WHERE id = $2`, quota, userID)
+		if err != nil {
+			log.Printf("DB Error setting storage quota: %v", err)
+			http.Error(w, "Failed to update quota", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"database/sql/driver"
+	"strings"
+	"testing"
+)
+
+// quotaDB answers the queries of checkStorageQuota for one user.
+type quotaDB struct {
+	role           string
+	personal       interface{} // int64, or nil for no personal quota
+	used, reserved int64
+	// Server-wide totals.
+	globalUsed, globalReserved int64
+}
+
+func (q quotaDB) answer(query string, args []driver.Value) (fakeResult, error) {
+	switch {
+	case strings.Contains(query, "SELECT role, storage_quota"):
+		return fakeRows([]driver.Value{q.role, q.personal}), nil
+	case strings.Contains(query, "FROM uploads WHERE user_id"):
+		return fakeRows([]driver.Value{q.used, int64(3)}), nil
+	case strings.Contains(query, "FROM resumable_uploads WHERE user_id"):
+		return fakeRows([]driver.Value{q.reserved}), nil
+	case strings.Contains(query, "FROM uploads) +"):
+		return fakeRows([]driver.Value{q.globalUsed}), nil
+	case strings.Contains(query, "FROM resumable_uploads"):
+		return fakeRows([]driver.Value{q.globalReserved}), nil
+	}
+	return fakeResult{}, nil
+}
+
+func TestCheckStorageQuota(t *testing.T) {
+	saved := config
+	t.Cleanup(func() { config = saved })
+	config.RoleQuotas = map[Role]int64{RoleAdmin: 0, RoleGuest: 1000}
+	config.DefaultQuota = 500
+
+	tests := []struct {
+		name          string
+		db            quotaDB
+		global        int64
+		incoming      int64
+		countReserved bool
+		want          error
+	}{
+		{"under role quota", quotaDB{role: "guest", used: 400}, 0, 600, true, nil},
+		{"over role quota", quotaDB{role: "guest", used: 400}, 0, 601, true, errQuotaExceeded},
+		{"reserved counts", quotaDB{role: "guest", used: 400, reserved: 100}, 0, 600, true, errQuotaExceeded},
+		{"own reservation does not count twice", quotaDB{role: "guest", used: 400, reserved: 600}, 0, 600, false, nil},
+		{"unlisted role uses the default", quotaDB{role: "member", used: 400}, 0, 101, true, errQuotaExceeded},
+		{"admins are unlimited", quotaDB{role: "admin", used: 1 << 40}, 0, 1 << 40, true, nil},
+		{"personal quota overrides the role's", quotaDB{role: "guest", personal: int64(5000), used: 400}, 0, 4000, true, nil},
+		{"personal quota can be lower", quotaDB{role: "guest", personal: int64(100), used: 50}, 0, 51, true, errQuotaExceeded},
+		{"personal zero is unlimited", quotaDB{role: "guest", personal: int64(0), used: 1 << 40}, 0, 1, true, nil},
+		{"under global limit", quotaDB{role: "admin", globalUsed: 9000}, 10000, 1000, true, nil},
+		{"over global limit", quotaDB{role: "admin", globalUsed: 9000}, 10000, 1001, true, errStorageLimitReached},
+		{"global reservations count", quotaDB{role: "admin", globalUsed: 9000, globalReserved: 500}, 10000, 600, true, errStorageLimitReached},
+		{"global reservations skipped", quotaDB{role: "admin", globalUsed: 9000, globalReserved: 500}, 10000, 600, false, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.GlobalStorageLimit = tt.global
+			db, _ := newFakeDB(t, tt.db.answer)
+			if err := checkStorageQuota(db, 1, tt.incoming, tt.countReserved); err != tt.want {
+				t.Errorf("checkStorageQuota = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLockStorageQuota(t *testing.T) {
+	saved := config
+	t.Cleanup(func() { config = saved })
+
+	for _, global := range []int64{0, 10000} {
+		config.GlobalStorageLimit = global
+		db, f := newFakeDB(t, func(query string, args []driver.Value) (fakeResult, error) {
+			if strings.Contains(query, "FOR UPDATE") {
+				return fakeRows([]driver.Value{int64(1)}), nil
+			}
+			return fakeResult{}, nil
+		})
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := lockStorageQuota(tx, 1); err != nil {
+			t.Fatalf("lockStorageQuota: %v", err)
+		}
+		tx.Rollback()
+		if !f.ran("FROM users WHERE id = $1 FOR UPDATE") {
+			t.Errorf("global %d: the user's row was not locked", global)
+		}
+		if got := f.ran("pg_advisory_xact_lock"); got != (global > 0) {
+			t.Errorf("global %d: advisory lock taken = %v", global, got)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimit allows Count events per Per, with bursts of up to Count. A zero
+// Count disables the limit.
+type rateLimit struct {
+	Count int
+	Per   time.Duration
+}
+
+// parseRateLimit reads limits written as "<count>/<duration>", e.g. "50/10s".
+func parseRateLimit(s string) (rateLimit, error) {
+	count, per, ok := strings.Cut(strings.TrimSpace(s), "/")
+	if !ok {
+		return rateLimit{}, fmt.Errorf("expected <count>/<duration>")
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 0 {
+		return rateLimit{}, fmt.Errorf("invalid count %q", count)
+	}
+	d, err := time.ParseDuration(per)
+	if err != nil || d <= 0 {
+		return rateLimit{}, fmt.Errorf("invalid duration %q", per)
+	}
+	return rateLimit{Count: n, Per: d}, nil
+}
+
+// rateLimiter is an in-memory token bucket per key. Limits are per server
+// process.
+type rateLimiter struct {
+	limit     rateLimit
+	mu        sync.Mutex
+	buckets   map[int64]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func newRateLimiter(limit rateLimit) *rateLimiter {
+	return &rateLimiter{limit: limit, buckets: make(map[int64]*tokenBucket), lastSweep: time.Now()}
+}
+
+// allow takes a token for key. When none is left it reports how long until
+// one is.
+func (l *rateLimiter) allow(key int64) (bool, time.Duration) {
+	if l.limit.Count == 0 {
+		return true, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	rate := float64(l.limit.Count) / l.limit.Per.Seconds()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(l.limit.Count), updated: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(l.limit.Count), b.tokens+now.Sub(b.updated).Seconds()*rate)
+	b.updated = now
+	l.sweep(now)
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// sweep drops buckets that have refilled completely, at most once per
+// period. Must be called with l.mu held.
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < l.limit.Per {
+		return
+	}
+	for key, b := range l.buckets {
+		if now.Sub(b.updated) >= l.limit.Per {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// writeRateLimited answers a request that exceeded its limit.
+func writeRateLimited(w http.ResponseWriter, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+}
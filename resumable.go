@@ -0,0 +1,469 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Resumable uploads follow the tus 1.0 protocol (https://tus.io): the client
+// creates an upload with its total length, PATCHes chunks at the current
+// offset, asks for the offset with HEAD after a failure, and finally calls
+// finalize to turn the assembled file into a regular uploads row. Every chunk
+// is written to the blob store as it arrives so any server instance can
+// continue an upload. Finalizing and deleting first claim the upload
+// (resumable_uploads.finalizing), so only one request consumes its chunks.
+
+const tusVersion = "1.0.0"
+
+type resumableUpload struct {
+	ID        string
+	UserID    int64
+	Filename  string
+	Length    int64
+	Offset    int64
+	UpdatedAt time.Time
+}
+
+func getResumableUpload(db *sql.DB, id string, userID int64) (*resumableUpload, error) {
+	var u resumableUpload
+	err := db.QueryRow(`
+		SELECT id, user_id, filename, length, upload_offset, updated_at
+		FROM resumable_uploads WHERE id = $1 AND user_id = $2`, id, userID,
+	).Scan(&u.ID, &u.UserID, &u.Filename, &u.Length, &u.Offset, &u.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+func setTusHeaders(w http.ResponseWriter) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", "creation,termination,expiration")
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(config.MaxResumableUploadSize, 10))
+}
+
+// parseUploadMetadata decodes the tus Upload-Metadata header: comma-separated
+// "key base64value" pairs.
+func parseUploadMetadata(header string) map[string]string {
+	meta := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		fields := strings.Fields(pair)
+		if len(fields) == 0 {
+			continue
+		}
+		value := ""
+		if len(fields) > 1 {
+			if decoded, err := base64.StdEncoding.DecodeString(fields[1]); err == nil {
+				value = string(decoded)
+			}
+		}
+		meta[fields[0]] = value
+	}
+	return meta
+}
+
+func lookupResumableUpload(w http.ResponseWriter, r *http.Request, db *sql.DB) (*User, *resumableUpload, bool) {
+	user := userFromContext(r.Context())
+	if user == nil {
+		http.Error(w, "User not found", http.StatusUnauthorized)
+		return nil, nil, false
+	}
+	upload, err := getResumableUpload(db, mux.Vars(r)["id"], user.ID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return nil, nil, false
+	} else if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return nil, nil, false
+	}
+	return user, upload, true
+}
+
+func createResumableUploadHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		setTusHeaders(w)
+		user := userFromContext(r.Context())
+		if user == nil {
+			http.Error(w, "User not found", http.StatusUnauthorized)
+			return
+		}
+		length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+		if err != nil || length < 0 {
+			http.Error(w, "Invalid Upload-Length", http.StatusBadRequest)
+			return
+		}
+		if length > config.MaxResumableUploadSize {
+			http.Error(w, "Upload too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		filename := parseUploadMetadata(r.Header.Get("Upload-Metadata"))["filename"]
+		if strings.TrimSpace(filename) == "" {
+			http.Error(w, "Missing filename in Upload-Metadata", http.StatusBadRequest)
+			return
+		}
+		if err := checkUploadExtension(filename); err != nil {
+			writeError(w, err, "Failed to create upload")
+			return
+		}
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			http.Error(w, "Failed to create upload", http.StatusInternalServerError)
+			return
+		}
+		id := hex.EncodeToString(b)
+
+		// The reservation is checked and recorded under the quota lock.
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Failed to create upload", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+		if err := lockStorageQuota(tx, user.ID); err != nil {
+			http.Error(w, "Failed to create upload", http.StatusInternalServerError)
+			return
+		}
+		if err := checkStorageQuota(tx, user.ID, length, true); err != nil {
+			writeError(w, err, "Failed to check storage quota")
+			return
+		}
+		_, err = tx.Exec(
+			`INSERT INTO resumable_uploads (id, user_id, filename, length) VALUES ($1, $2, $3, $4)`,
+			id, user.ID, filename, length,
+		)
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			log.Printf("DB Error creating resumable upload: %v", err)
+			http.Error(w, "Failed to create upload", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Location", "/api/uploads/resumable/"+id)
+		w.Header().Set("Upload-Offset", "0")
+		w.Header().Set("Upload-Expires", time.Now().Add(config.ResumableUploadExpiry).UTC().Format(http.TimeFormat))
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+func resumableUploadStatusHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		setTusHeaders(w)
+		_, upload, ok := lookupResumableUpload(w, r, db)
+		if !ok {
+			return
+		}
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+		w.Header().Set("Upload-Expires", upload.UpdatedAt.Add(config.ResumableUploadExpiry).UTC().Format(http.TimeFormat))
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func patchResumableUploadHandler(db *sql.DB, blobs BlobStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		setTusHeaders(w)
+		if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+			http.Error(w, "Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+			return
+		}
+		_, upload, ok := lookupResumableUpload(w, r, db)
+		if !ok {
+			return
+		}
+		offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+		if err != nil || offset != upload.Offset {
+			http.Error(w, "Upload-Offset does not match the current offset", http.StatusConflict)
+			return
+		}
+		remaining := upload.Length - upload.Offset
+
+		// Spool the chunk so it can be stored with a known size. Whatever
+		// arrived before a dropped connection is kept, as tus requires.
+		tmp, err := os.CreateTemp("", "prisma-chunk-*")
+		if err != nil {
+			http.Error(w, "Failed to store chunk", http.StatusInternalServerError)
+			return
+		}
+		defer os.Remove(tmp.Name())
+		defer tmp.Close()
+		n, copyErr := io.Copy(tmp, io.LimitReader(r.Body, remaining+1))
+		if n > remaining {
+			http.Error(w, "Chunk exceeds Upload-Length", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if n == 0 {
+			if copyErr != nil {
+				http.Error(w, "Failed to read chunk", http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			http.Error(w, "Failed to store chunk", http.StatusInternalServerError)
+			return
+		}
+
+		// The request context is cancelled when the client drops, but the
+		// bytes already received should still be stored.
+		ctx := context.Background()
+		key := fmt.Sprintf("part_%s_%d_%d", upload.ID, offset, time.Now().UnixNano())
+		if err := blobs.Put(ctx, key, tmp, n, "application/octet-stream"); err != nil {
+			log.Printf("Failed to store chunk %s: %v", key, err)
+			http.Error(w, "Failed to store chunk", http.StatusInternalServerError)
+			return
+		}
+		if err := recordResumableChunk(db, upload.ID, offset, n, key); err != nil {
+			blobs.Delete(ctx, key)
+			writeError(w, err, "Failed to store chunk")
+			return
+		}
+
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset+n, 10))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// recordResumableChunk advances the offset only if no other request wrote a
+// chunk at the same offset in the meantime.
+func recordResumableChunk(db *sql.DB, id string, offset, size int64, key string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	res, err := tx.Exec(`
+		UPDATE resumable_uploads SET upload_offset = upload_offset + $1, updated_at = NOW()
+		WHERE id = $2 AND upload_offset = $3`, size, id, offset)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		tx.Rollback()
+		return &httpError{http.StatusConflict, "Upload-Offset does not match the current offset"}
+	}
+	if _, err := tx.Exec(
+		`INSERT INTO resumable_upload_parts (upload_id, part_offset, size, blob_key) VALUES ($1, $2, $3, $4)`,
+		id, offset, size, key,
+	); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func finalizeResumableUploadHandler(db *sql.DB, blobs BlobStore, scans *uploadScanner) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		setTusHeaders(w)
+		user, upload, ok := lookupResumableUpload(w, r, db)
+		if !ok {
+			return
+		}
+		if upload.Offset != upload.Length {
+			http.Error(w, "Upload is incomplete", http.StatusConflict)
+			return
+		}
+		if !claimResumableUpload(w, db, upload.ID) {
+			return
+		}
+		// Until the chunks are stored as an upload, let the client retry.
+		stored := false
+		defer func() {
+			if !stored {
+				db.Exec(`UPDATE resumable_uploads SET finalizing = FALSE WHERE id = $1`, upload.ID)
+			}
+		}()
+
+		rows, err := db.Query(`
+			SELECT part_offset, size, blob_key FROM resumable_upload_parts
+			WHERE upload_id = $1 ORDER BY part_offset`, upload.ID)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		var keys []string
+		var next int64
+		for rows.Next() {
+			var partOffset, size int64
+			var key string
+			if err := rows.Scan(&partOffset, &size, &key); err != nil || partOffset != next {
+				rows.Close()
+				http.Error(w, "Upload chunks are inconsistent", http.StatusConflict)
+				return
+			}
+			keys = append(keys, key)
+			next += size
+		}
+		rows.Close()
+		if next != upload.Length {
+			http.Error(w, "Upload chunks are inconsistent", http.StatusConflict)
+			return
+		}
+
+		src := &blobPartsReader{ctx: r.Context(), blobs: blobs, keys: keys}
+		defer src.Close()
+		up, err := storeUpload(r.Context(), db, blobs, user.ID, upload.Filename, src)
+		if err != nil {
+			writeError(w, err, "Failed to save file")
+			return
+		}
+		stored = true
+		if up.ScanStatus == scanPending {
+			scans.notify()
+		}
+		if err := removeResumableUpload(context.Background(), db, blobs, upload.ID); err != nil {
+			log.Printf("Failed to clean up resumable upload %s: %v", upload.ID, err)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(uploadResponse(up))
+	}
+}
+
+func deleteResumableUploadHandler(db *sql.DB, blobs BlobStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		setTusHeaders(w)
+		_, upload, ok := lookupResumableUpload(w, r, db)
+		if !ok || !claimResumableUpload(w, db, upload.ID) {
+			return
+		}
+		if err := removeResumableUpload(r.Context(), db, blobs, upload.ID); err != nil {
+			log.Printf("Failed to delete resumable upload %s: %v", upload.ID, err)
+			http.Error(w, "Failed to delete upload", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// claimResumableUpload marks the upload as being finalized or deleted, and
+// answers the request with 409 if another request got there first.
+func claimResumableUpload(w http.ResponseWriter, db *sql.DB, id string) bool {
+	res, err := db.Exec(`
+		UPDATE resumable_uploads SET finalizing = TRUE, updated_at = NOW() WHERE id = $1 AND NOT finalizing`, id)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return false
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "Upload is already being finalized", http.StatusConflict)
+		return false
+	}
+	return true
+}
+
+// removeResumableUpload deletes the stored chunks and the upload's rows.
+func removeResumableUpload(ctx context.Context, db *sql.DB, blobs BlobStore, id string) error {
+	rows, err := db.Query(`SELECT blob_key FROM resumable_upload_parts WHERE upload_id = $1`, id)
+	if err != nil {
+		return err
+	}
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err == nil {
+			keys = append(keys, key)
+		}
+	}
+	rows.Close()
+	for _, key := range keys {
+		if err := blobs.Delete(ctx, key); err != nil {
+			return err
+		}
+	}
+	_, err = db.Exec(`DELETE FROM resumable_uploads WHERE id = $1`, id)
+	return err
+}
+
+// runResumableUploadCleanup periodically removes uploads that have been
+// inactive for longer than the configured expiry.
+func runResumableUploadCleanup(db *sql.DB, blobs BlobStore) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		cutoff := time.Now().Add(-config.ResumableUploadExpiry)
+		rows, err := db.Query(`SELECT id FROM resumable_uploads WHERE updated_at < $1`, cutoff)
+		if err != nil {
+			log.Printf("Failed to list expired resumable uploads: %v", err)
+		} else {
+			var ids []string
+			for rows.Next() {
+				var id string
+				if err := rows.Scan(&id); err == nil {
+					ids = append(ids, id)
+				}
+			}
+			rows.Close()
+			for _, id := range ids {
+				if err := removeResumableUpload(context.Background(), db, blobs, id); err != nil {
+					log.Printf("Failed to remove expired resumable upload %s: %v", id, err)
+				}
+			}
+			if len(ids) > 0 {
+				log.Printf("Removed %d expired resumable uploads", len(ids))
+			}
+		}
+		<-ticker.C
+	}
+}
+
+// blobPartsReader reads a sequence of blobs as one stream, opening each part
+// only when the previous one is exhausted.
+type blobPartsReader struct {
+	ctx   context.Context
+	blobs BlobStore
+	keys  []string
+	cur   io.ReadCloser
+}
+
+func (p *blobPartsReader) Read(b []byte) (int, error) {
+	for {
+		if p.cur == nil {
+			if len(p.keys) == 0 {
+				return 0, io.EOF
+			}
+			rc, _, err := p.blobs.Get(p.ctx, p.keys[0])
+			if err != nil {
+				return 0, err
+			}
+			p.cur, p.keys = rc, p.keys[1:]
+		}
+		n, err := p.cur.Read(b)
+		if err == io.EOF {
+			p.cur.Close()
+			p.cur = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (p *blobPartsReader) Close() error {
+	if p.cur != nil {
+		return p.cur.Close()
+	}
+	return nil
+}
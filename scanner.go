@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// Scan status of an upload. Downloads are only served once it is clean.
+const (
+	scanPending  = "pending"
+	scanClean    = "clean"
+	scanInfected = "infected"
+	scanFailed   = "error"
+)
+
+var (
+	errUploadInfected = &httpError{http.StatusUnprocessableEntity, "File failed malware scan"}
+	errScanPending    = &httpError{http.StatusConflict, "File is still being scanned"}
+	errScanFailed     = &httpError{http.StatusForbidden, "File could not be scanned"}
+)
+
+// scanStatusError returns the error to serve instead of a file with the given
+// scan status, or nil if it may be downloaded.
+func scanStatusError(status string) error {
+	switch status {
+	case scanClean, "":
+		return nil
+	case scanPending:
+		return errScanPending
+	case scanInfected:
+		return errUploadInfected
+	default:
+		return errScanFailed
+	}
+}
+
+// ScanResult is the verdict of a Scanner.
+type ScanResult struct {
+	Clean     bool
+	Signature string
+}
+
+// errScanRejected means the scanner looked at the file but could not give a
+// verdict, e.g. because it exceeds the scanner's size limit. Retrying will not
+// help.
+var errScanRejected = errors.New("scanner rejected the file")
+
+// Scanner checks file contents for malware.
+type Scanner interface {
+	Scan(ctx context.Context, r io.Reader) (ScanResult, error)
+}
+
+// newScanner builds the scanner selected by PRISMA_SCANNER.
+func newScanner() Scanner {
+	switch config.Scanner {
+	case "clamd":
+		log.Printf("Scanning uploads with clamd at %s", config.ClamdAddress)
+		return &clamdScanner{address: config.ClamdAddress, timeout: config.ScanTimeout}
+	case "", "none":
+		return noopScanner{}
+	default:
+		log.Fatalf("Unknown scanner %q", config.Scanner)
+		return nil
+	}
+}
+
+// noopScanner accepts everything.
+type noopScanner struct{}
+
+func (noopScanner) Scan(ctx context.Context, r io.Reader) (ScanResult, error) {
+	return ScanResult{Clean: true}, nil
+}
+
+// --- clamd ---
+
+// clamdChunkSize must stay below clamd's StreamMaxLength chunk limits.
+const clamdChunkSize = 64 << 10
+
+// clamdScanner streams files to clamd with the INSTREAM command. The address
+// is host:port, or unix:/path/to/clamd.sock.
+type clamdScanner struct {
+	address string
+	timeout time.Duration
+}
+
+func (s *clamdScanner) Scan(ctx context.Context, r io.Reader) (ScanResult, error) {
+	network, address := "tcp", s.address
+	if strings.HasPrefix(address, "unix:") {
+		network, address = "unix", strings.TrimPrefix(address, "unix:")
+	}
+	dialer := net.Dialer{Timeout: 10 * time.Second}
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return ScanResult{}, err
+	}
+	defer conn.Close()
+	if s.timeout > 0 {
+		conn.SetDeadline(time.Now().Add(s.timeout))
+	}
+
+	// Commands prefixed with "z" are NUL-terminated, and so are replies.
+	if _, err := io.WriteString(conn, "zINSTREAM\x00"); err != nil {
+		return ScanResult{}, err
+	}
+	buf := make([]byte, 4+clamdChunkSize)
+	for {
+		n, err := io.ReadFull(r, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			if _, werr := conn.Write(buf[:4+n]); werr != nil {
+				// clamd closes the connection when the stream is too long;
+				// its reply explains why.
+				break
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return ScanResult{}, err
+		}
+	}
+	conn.Write([]byte{0, 0, 0, 0})
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && reply == "" {
+		return ScanResult{}, err
+	}
+	return parseClamdReply(strings.TrimRight(reply, "\x00\n"))
+}
+
+// parseClamdReply interprets "stream: OK", "stream: <name> FOUND" and
+// "<message> ERROR" replies.
+func parseClamdReply(reply string) (ScanResult, error) {
+	reply = strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case reply == "OK":
+		return ScanResult{Clean: true}, nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return ScanResult{Signature: strings.TrimSuffix(reply, " FOUND")}, nil
+	case strings.HasSuffix(reply, " ERROR"):
+		return ScanResult{}, fmt.Errorf("%w: %s", errScanRejected, strings.TrimSuffix(reply, " ERROR"))
+	default:
+		return ScanResult{}, fmt.Errorf("unexpected clamd reply %q", reply)
+	}
+}
+
+// --- Scan queue ---
+
+// uploadScanner scans pending uploads in the background. The queue is the
+// uploads table itself, so uploads stored before a restart are still
+// scanned. Uploads sharing a blob share its verdict.
+type uploadScanner struct {
+	db      *sql.DB
+	blobs   BlobStore
+	hub     *Hub
+	scanner Scanner
+	wake    chan struct{}
+}
+
+func newUploadScanner(db *sql.DB, blobs BlobStore, hub *Hub, scanner Scanner) *uploadScanner {
+	return &uploadScanner{db: db, blobs: blobs, hub: hub, scanner: scanner, wake: make(chan struct{}, 1)}
+}
+
+// notify tells the worker there are new pending uploads.
+func (s *uploadScanner) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run processes pending uploads whenever notified, and every minute to retry
+// scans that failed because the scanner was unavailable.
+func (s *uploadScanner) run() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		for s.scanPending() {
+		}
+		select {
+		case <-s.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// scanPending scans one batch of pending blobs and reports whether any
+// verdicts were recorded, meaning there may be more work.
+func (s *uploadScanner) scanPending() bool {
+	rows, err := s.db.Query(`
+		SELECT DISTINCT ON (COALESCE(blob_hash, stored_filename))
+		       blob_hash, COALESCE(blob_key, stored_filename)
+		FROM uploads WHERE scan_status = $1 LIMIT 20`, scanPending)
+	if err != nil {
+		log.Printf("Failed to list uploads pending scan: %v", err)
+		return false
+	}
+	type pendingBlob struct {
+		hash sql.NullString
+		key  string
+	}
+	var pending []pendingBlob
+	for rows.Next() {
+		var p pendingBlob
+		if err := rows.Scan(&p.hash, &p.key); err == nil {
+			pending = append(pending, p)
+		}
+	}
+	rows.Close()
+
+	progress := false
+	for _, p := range pending {
+		if err := s.scanBlob(p.hash, p.key); err != nil {
+			log.Printf("Failed to scan %s: %v", p.key, err)
+			continue
+		}
+		progress = true
+	}
+	return progress
+}
+
+// scanBlob scans one stored object and records the verdict on every upload
+// that uses it. Infected objects are moved to a quarantine key.
+func (s *uploadScanner) scanBlob(hash sql.NullString, key string) error {
+	ctx := context.Background()
+	rc, _, err := s.blobs.Get(ctx, key)
+	if err == errBlobNotFound {
+		// Deleted while queued; nothing to serve.
+		return s.record(hash, key, scanFailed, "", "")
+	} else if err != nil {
+		return err
+	}
+	result, err := s.scanner.Scan(ctx, rc)
+	rc.Close()
+	switch {
+	case errors.Is(err, errScanRejected):
+		log.Printf("Scanner rejected %s: %v", key, err)
+		return s.record(hash, key, scanFailed, "", "")
+	case err != nil:
+		return err
+	case result.Clean:
+		return s.record(hash, key, scanClean, "", "")
+	}
+
+	log.Printf("Quarantining %s: %s", key, result.Signature)
+	quarantineKey := key
+	if hash.Valid {
+		quarantineKey = "quarantine_" + hash.String
+		if err := s.moveBlob(ctx, key, quarantineKey); err != nil {
+			return err
+		}
+	}
+	return s.record(hash, key, scanInfected, result.Signature, quarantineKey)
+}
+
+func (s *uploadScanner) moveBlob(ctx context.Context, from, to string) error {
+	rc, info, err := s.blobs.Get(ctx, from)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	if err := s.blobs.Put(ctx, to, rc, info.Size, "application/octet-stream"); err != nil {
+		return err
+	}
+	return nil
+}
+
+// record stores a verdict, repoints quarantined uploads at their new key and
+// re-broadcasts affected messages so clients update the attachment.
+func (s *uploadScanner) record(hash sql.NullString, key, status, signature, quarantineKey string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	match := `COALESCE(blob_key, stored_filename) = $1`
+	arg := key
+	if hash.Valid {
+		match, arg = `blob_hash = $1`, hash.String
+	}
+	rows, err := tx.Query(`
+		UPDATE uploads SET scan_status = $2, scan_signature = NULLIF($3, ''), scanned_at = NOW()
+		WHERE `+match+` AND scan_status = 'pending' RETURNING id`, arg, status, signature)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	var uploadIDs []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err == nil {
+			uploadIDs = append(uploadIDs, id)
+		}
+	}
+	rows.Close()
+	if quarantineKey != "" && quarantineKey != key {
+		if _, err := tx.Exec(`UPDATE uploads SET blob_key = $2 WHERE blob_hash = $1`, hash.String, quarantineKey); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err := tx.Exec(`UPDATE blobs SET blob_key = $2 WHERE hash = $1`, hash.String, quarantineKey); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if quarantineKey != "" && quarantineKey != key {
+		if err := s.blobs.Delete(context.Background(), key); err != nil {
+			log.Printf("Failed to remove quarantined blob %s: %v", key, err)
+		}
+	}
+
+	rows, err = s.db.Query(`SELECT DISTINCT message_id FROM message_attachments WHERE upload_id = ANY($1)`, pq.Array(uploadIDs))
+	if err != nil {
+		return nil
+	}
+	var messageIDs []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err == nil {
+			messageIDs = append(messageIDs, id)
+		}
+	}
+	rows.Close()
+	for _, id := range messageIDs {
+		if msg, err := getMessageByID(s.db, id); err == nil {
+			broadcastMessage(s.hub, "message_updated", msg)
+			queueEvent(s.db, eventMessageUpdated, msg)
+		}
+	}
+	return nil
+}
+
+// rescanUploadHandler lets admins queue an upload for another scan, e.g.
+// after a scanner outage or a signature update.
+func rescanUploadHandler(db *sql.DB, scans *uploadScanner) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isAdmin(userFromContext(r.Context())) {
+			http.Error(w, "Admin access required", http.StatusForbidden)
+			return
+		}
+		uploadID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid upload ID", http.StatusBadRequest)
+			return
+		}
+		// Quarantined files stay quarantined; everything else sharing the blob
+		// is rescanned together.
+		res, err := db.Exec(`
+			UPDATE uploads SET scan_status = 'pending', scan_signature = NULL, scanned_at = NULL
+			WHERE scan_status <> 'infected' AND (id = $1 OR blob_hash = (SELECT blob_hash FROM uploads WHERE id = $1))`,
+			uploadID)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "Upload not found or quarantined", http.StatusNotFound)
+			return
+		}
+		scans.notify()
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
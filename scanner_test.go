@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// startClamdStub serves the INSTREAM protocol, flagging streams that contain
+// the EICAR test string and refusing those longer than maxStream.
+func startClamdStub(t *testing.T, maxStream int) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				if cmd, err := r.ReadString(0); err != nil || cmd != "zINSTREAM\x00" {
+					io.WriteString(conn, "UNKNOWN COMMAND\x00")
+					return
+				}
+				var stream bytes.Buffer
+				for {
+					var size uint32
+					if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+						return
+					}
+					if size == 0 {
+						break
+					}
+					if stream.Len()+int(size) > maxStream {
+						io.WriteString(conn, "INSTREAM size limit exceeded. ERROR\x00")
+						return
+					}
+					if _, err := io.CopyN(&stream, r, int64(size)); err != nil {
+						return
+					}
+				}
+				if bytes.Contains(stream.Bytes(), []byte(eicar)) {
+					io.WriteString(conn, "stream: Eicar-Test-Signature FOUND\x00")
+				} else {
+					io.WriteString(conn, "stream: OK\x00")
+				}
+			}(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestClamdScanner(t *testing.T) {
+	scanner := &clamdScanner{address: startClamdStub(t, 1<<20), timeout: 5 * time.Second}
+	tests := []struct {
+		name      string
+		content   string
+		want      ScanResult
+		wantError error
+	}{
+		{"clean", "hello", ScanResult{Clean: true}, nil},
+		{"empty", "", ScanResult{Clean: true}, nil},
+		{"multiple chunks", strings.Repeat("a", 3*clamdChunkSize+17), ScanResult{Clean: true}, nil},
+		{"infected", "prefix " + eicar, ScanResult{Signature: "Eicar-Test-Signature"}, nil},
+		{"too large", strings.Repeat("a", 2<<20), ScanResult{}, errScanRejected},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := scanner.Scan(context.Background(), strings.NewReader(tt.content))
+			if tt.wantError != nil {
+				if !errors.Is(err, tt.wantError) {
+					t.Fatalf("err = %v, want %v", err, tt.wantError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClamdScannerUnavailable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	scanner := &clamdScanner{address: addr, timeout: time.Second}
+	if _, err := scanner.Scan(context.Background(), strings.NewReader("x")); err == nil || errors.Is(err, errScanRejected) {
+		t.Errorf("err = %v, want a connection error", err)
+	}
+}
+
+func TestParseClamdReply(t *testing.T) {
+	tests := []struct {
+		reply    string
+		want     ScanResult
+		rejected bool
+		fails    bool
+	}{
+		{"stream: OK", ScanResult{Clean: true}, false, false},
+		{"stream: Win.Test.EICAR_HDB-1 FOUND", ScanResult{Signature: "Win.Test.EICAR_HDB-1"}, false, false},
+		{"INSTREAM size limit exceeded. ERROR", ScanResult{}, true, true},
+		{"garbage", ScanResult{}, false, true},
+	}
+	for _, tt := range tests {
+		got, err := parseClamdReply(tt.reply)
+		if (err != nil) != tt.fails || errors.Is(err, errScanRejected) != tt.rejected || got != tt.want {
+			t.Errorf("parseClamdReply(%q) = %+v, %v", tt.reply, got, err)
+		}
+	}
+}
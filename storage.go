@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	errBlobNotFound       = errors.New("blob not found")
+	errPresignUnsupported = errors.New("presigned URLs are not supported by this storage backend")
+)
+
+// BlobInfo describes a stored object.
+type BlobInfo struct {
+	Key         string
+	Size        int64
+	ContentType string
+	ModTime     time.Time
+}
+
+// BlobStore is where uploaded file contents live. Keys are flat names such as
+// the stored_filename of an upload.
+type BlobStore interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	// Get returns the object contents. The reader also implements io.Seeker
+	// when the backend supports random access.
+	Get(ctx context.Context, key string) (io.ReadCloser, BlobInfo, error)
+	Delete(ctx context.Context, key string) error
+	Stat(ctx context.Context, key string) (BlobInfo, error)
+	// Presign returns a URL that grants temporary direct read access.
+	Presign(ctx context.Context, key string, ttl time.Duration, opts PresignOptions) (string, error)
+	// List calls fn for every stored object, stopping at the first error.
+	List(ctx context.Context, fn func(BlobInfo) error) error
+}
+
+// PresignOptions override response headers on presigned downloads.
+type PresignOptions struct {
+	ContentType        string
+	ContentDisposition string
+}
+
+// newBlobStore builds the backend selected by PRISMA_STORAGE.
+func newBlobStore() BlobStore {
+	switch config.StorageBackend {
+	case "s3":
+		store, err := newS3BlobStore(config.S3)
+		if err != nil {
+			log.Fatalf("Failed to configure S3 storage: %v", err)
+		}
+		log.Printf("Storing uploads in bucket %q at %s", config.S3.Bucket, config.S3.Endpoint)
+		return store
+	case "", "fs":
+		return &fsBlobStore{dir: config.UploadDir}
+	default:
+		log.Fatalf("Unknown storage backend %q", config.StorageBackend)
+		return nil
+	}
+}
+
+// --- Local filesystem backend ---
+
+type fsBlobStore struct {
+	dir string
+}
+
+func (s *fsBlobStore) path(key string) (string, error) {
+	if key == "" || strings.ContainsAny(key, "/\\") || strings.HasPrefix(key, ".") {
+		return "", errBlobNotFound
+	}
+	return filepath.Join(s.dir, key), nil
+}
+
+func (s *fsBlobStore) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.dir, os.ModePerm); err != nil {
+		return err
+	}
+	// Write to a temporary name so readers never see a partial file.
+	tmp, err := os.CreateTemp(s.dir, ".put-*")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *fsBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, BlobInfo, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, BlobInfo{}, err
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, BlobInfo{}, errBlobNotFound
+	} else if err != nil {
+		return nil, BlobInfo{}, err
+	}
+	stat, err := f.Stat()
+	if err != nil || stat.IsDir() {
+		f.Close()
+		return nil, BlobInfo{}, errBlobNotFound
+	}
+	return f, BlobInfo{Key: key, Size: stat.Size(), ModTime: stat.ModTime()}, nil
+}
+
+func (s *fsBlobStore) Delete(ctx context.Context, key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *fsBlobStore) Stat(ctx context.Context, key string) (BlobInfo, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	stat, err := os.Stat(path)
+	if os.IsNotExist(err) || (err == nil && stat.IsDir()) {
+		return BlobInfo{}, errBlobNotFound
+	} else if err != nil {
+		return BlobInfo{}, err
+	}
+	return BlobInfo{Key: key, Size: stat.Size(), ModTime: stat.ModTime()}, nil
+}
+
+func (s *fsBlobStore) Presign(ctx context.Context, key string, ttl time.Duration, opts PresignOptions) (string, error) {
+	return "", errPresignUnsupported
+}
+
+func (s *fsBlobStore) List(ctx context.Context, fn func(BlobInfo) error) error {
+	entries, err := os.ReadDir(s.dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		// Skip directories and in-progress writes from Put.
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		if err := fn(BlobInfo{Key: entry.Name(), Size: info.Size(), ModTime: info.ModTime()}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
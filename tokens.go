@@ -0,0 +1,319 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+)
+
+// Personal access tokens let people script against the API without handing
+// out their session. They are sent like session tokens,
+//
+//	Authorization: Bearer pat_<token>
+//
+// but only allow what their scopes cover (see routeScope), always expire,
+// and are stored as a SHA-256 hash. Tokens cannot manage tokens, bots,
+// two-factor authentication or single sign-on links; that takes a session.
+
+const accessTokenPrefix = "pat_"
+
+const (
+	scopeMessagesRead  = "messages:read"
+	scopeMessagesWrite = "messages:write"
+	scopeUpload        = "upload"
+	// scopeAdmin lets the token use its owner's admin role, and covers every
+	// other scope. Without it an admin's token acts as a guest.
+	scopeAdmin = "admin"
+)
+
+var accessTokenScopes = []string{scopeMessagesRead, scopeMessagesWrite, scopeUpload, scopeAdmin}
+
+const maxAccessTokenName = 64
+
+var errScopeRequired = &httpError{http.StatusForbidden, "Token lacks the required scope"}
+
+// credential is an authenticated request's user and what it may do.
+type credential struct {
+	user *User
+	// session is the session token, when one was used, so the caller can
+	// refresh it.
+	session string
+	// scopes is nil for sessions and bot tokens, which can do everything.
+	scopes []string
+}
+
+// allows reports whether the credential covers scope. The empty scope is
+// reserved for sessions and bots.
+func (c *credential) allows(scope string) bool {
+	if c.scopes == nil {
+		return true
+	}
+	if scope == "" {
+		return false
+	}
+	return containsString(c.scopes, scope) || containsString(c.scopes, scopeAdmin)
+}
+
+// routeScopes maps "METHOD /path-template" under /api to the scope a
+// personal access token needs for it. Routes that are not listed, such as
+// token, bot, two-factor and single sign-on management, are closed to
+// tokens.
+var routeScopes = map[string]string{
+	"GET /categories":                    scopeMessagesRead,
+	"GET /channels/{id:[0-9]+}/messages": scopeMessagesRead,
+	"GET /channels/{id:[0-9]+}/files":    scopeMessagesRead,
+	"GET /emoji":                         scopeMessagesRead,
+	"GET /commands":                      scopeMessagesRead,
+	"GET /commands/autocomplete":         scopeMessagesRead,
+	"GET /reminders":                     scopeMessagesRead,
+
+	"POST /messages":                scopeMessagesWrite,
+	"DELETE /reminders/{id:[0-9]+}": scopeMessagesWrite,
+
+	"POST /upload-avatar":                             scopeUpload,
+	"POST /upload-file":                               scopeUpload,
+	"GET /uploads":                                    scopeUpload,
+	"GET /uploads/{id:[0-9]+}":                        scopeUpload,
+	"DELETE /uploads/{id:[0-9]+}":                     scopeUpload,
+	"GET /me/storage":                                 scopeUpload,
+	"POST /uploads/resumable":                         scopeUpload,
+	"HEAD /uploads/resumable/{id:[0-9a-f]+}":          scopeUpload,
+	"PATCH /uploads/resumable/{id:[0-9a-f]+}":         scopeUpload,
+	"DELETE /uploads/resumable/{id:[0-9a-f]+}":        scopeUpload,
+	"POST /uploads/resumable/{id:[0-9a-f]+}/finalize": scopeUpload,
+
+	"POST /categories":                              scopeAdmin,
+	"POST /channels":                                scopeAdmin,
+	"PUT /channels/{id:[0-9]+}":                     scopeAdmin,
+	"DELETE /channels/{id:[0-9]+}":                  scopeAdmin,
+	"POST /reorder/categories":                      scopeAdmin,
+	"POST /reorder/channels":                        scopeAdmin,
+	"POST /uploads/{id:[0-9]+}/rescan":              scopeAdmin,
+	"PUT /users/{id:[0-9]+}/storage-quota":          scopeAdmin,
+	"POST /emoji":                                   scopeAdmin,
+	"DELETE /emoji/{id:[0-9]+}":                     scopeAdmin,
+	"GET /channels/{id:[0-9]+}/webhooks":            scopeAdmin,
+	"POST /channels/{id:[0-9]+}/webhooks":           scopeAdmin,
+	"POST /webhooks/{id:[0-9]+}/token":              scopeAdmin,
+	"DELETE /webhooks/{id:[0-9]+}":                  scopeAdmin,
+	"POST /commands":                                scopeAdmin,
+	"DELETE /commands/{name:[a-z0-9_-]+}":           scopeAdmin,
+	"GET /outgoing-webhooks":                        scopeAdmin,
+	"POST /outgoing-webhooks":                       scopeAdmin,
+	"PUT /outgoing-webhooks/{id:[0-9]+}":            scopeAdmin,
+	"DELETE /outgoing-webhooks/{id:[0-9]+}":         scopeAdmin,
+	"POST /outgoing-webhooks/{id:[0-9]+}/secret":    scopeAdmin,
+	"GET /outgoing-webhooks/{id:[0-9]+}/deliveries": scopeAdmin,
+	"POST /outgoing-webhooks/{id:[0-9]+}/deliveries/{delivery:[0-9]+}/redeliver": scopeAdmin,
+	"GET /admin/audit-log":        scopeAdmin,
+	"GET /admin/lockouts":         scopeAdmin,
+	"POST /admin/lockouts/unlock": scopeAdmin,
+	"GET /admin/gc":               scopeAdmin,
+	"POST /admin/gc":              scopeAdmin,
+}
+
+// routeScope returns the scope a personal access token needs for the route r
+// matched, or "" if tokens may not use it.
+func routeScope(r *http.Request) string {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return ""
+	}
+	path, err := route.GetPathTemplate()
+	if err != nil {
+		return ""
+	}
+	return routeScopes[r.Method+" "+strings.TrimPrefix(path, "/api")]
+}
+
+// getUserByAccessToken resolves an unexpired personal access token. Admin
+// tokens older than config.AdminTokenMaxLifetime count as expired, whatever
+// expiry they were created with.
+func getUserByAccessToken(db *sql.DB, token string) (*User, []string, bool) {
+	var id, userID int64
+	var scopes []string
+	err := db.QueryRow(`
+		SELECT id, user_id, scopes FROM personal_access_tokens
+		WHERE token_hash = $1 AND expires_at > NOW()
+		  AND (NOT $2 = ANY(scopes) OR created_at > NOW() - $3 * INTERVAL '1 second')`,
+		hashToken(token), scopeAdmin, int64(config.AdminTokenMaxLifetime.Seconds())).Scan(&id, &userID, pq.Array(&scopes))
+	if err != nil {
+		return nil, nil, false
+	}
+	user, ok := scanUser(db.QueryRow(`
+		SELECT id, username, role, avatar_url, is_bot, COALESCE(nickname, '') FROM users WHERE id = $1`, userID))
+	if !ok {
+		return nil, nil, false
+	}
+	if user.Role == RoleAdmin && !containsString(scopes, scopeAdmin) {
+		user.Role = RoleGuest
+	}
+	db.Exec(`
+		UPDATE personal_access_tokens SET last_used_at = NOW()
+		WHERE id = $1 AND (last_used_at IS NULL OR last_used_at < NOW() - INTERVAL '1 minute')`, id)
+	return user, scopes, true
+}
+
+const accessTokenSelect = `
+	SELECT id, name, scopes, expires_at, last_used_at, created_at FROM personal_access_tokens`
+
+func scanAccessToken(row rowScanner) (AccessToken, error) {
+	var t AccessToken
+	var lastUsed sql.NullTime
+	err := row.Scan(&t.ID, &t.Name, pq.Array(&t.Scopes), &t.ExpiresAt, &lastUsed, &t.CreatedAt)
+	if lastUsed.Valid {
+		t.LastUsedAt = &lastUsed.Time
+	}
+	return t, err
+}
+
+// --- Handlers ---
+
+func listAccessTokensHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := userFromContext(r.Context())
+		if user == nil {
+			http.Error(w, "User not found", http.StatusUnauthorized)
+			return
+		}
+		rows, err := db.Query(accessTokenSelect+` WHERE user_id = $1 ORDER BY created_at DESC`, user.ID)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+		tokens := []AccessToken{}
+		for rows.Next() {
+			if t, err := scanAccessToken(rows); err == nil {
+				tokens = append(tokens, t)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(tokens)
+	}
+}
+
+// createAccessTokenHandler creates a token for the caller and returns it,
+// the only time the token itself is shown. expires_at defaults to
+// config.TokenDefaultLifetime from now, or less for admin tokens.
+func createAccessTokenHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := userFromContext(r.Context())
+		if user == nil || user.Bot {
+			http.Error(w, "Only people can create access tokens", http.StatusForbidden)
+			return
+		}
+		var req struct {
+			Name      string     `json:"name"`
+			Scopes    []string   `json:"scopes"`
+			ExpiresAt *time.Time `json:"expires_at"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		req.Name = strings.TrimSpace(req.Name)
+		if req.Name == "" || len([]rune(req.Name)) > maxAccessTokenName {
+			http.Error(w, "Token names must be 1-64 characters", http.StatusBadRequest)
+			return
+		}
+		scopes := []string{}
+		for _, s := range req.Scopes {
+			if !containsString(accessTokenScopes, s) {
+				http.Error(w, "Unknown scope "+s+"; expected one of "+strings.Join(accessTokenScopes, ", "), http.StatusBadRequest)
+				return
+			}
+			if !containsString(scopes, s) {
+				scopes = append(scopes, s)
+			}
+		}
+		if len(scopes) == 0 {
+			http.Error(w, "At least one scope is required", http.StatusBadRequest)
+			return
+		}
+		if containsString(scopes, scopeAdmin) && !isAdmin(user) {
+			http.Error(w, "Admin access required", http.StatusForbidden)
+			return
+		}
+		now := time.Now()
+		lifetime, maxLifetime := config.TokenDefaultLifetime, config.TokenMaxLifetime
+		if containsString(scopes, scopeAdmin) {
+			maxLifetime = config.AdminTokenMaxLifetime
+			if lifetime > maxLifetime {
+				lifetime = maxLifetime
+			}
+		}
+		expires := now.Add(lifetime)
+		if req.ExpiresAt != nil {
+			expires = *req.ExpiresAt
+		}
+		if !expires.After(now) || expires.Sub(now) > maxLifetime {
+			http.Error(w, "Tokens must expire within "+maxLifetime.String(), http.StatusBadRequest)
+			return
+		}
+
+		var owned int
+		db.QueryRow(`SELECT COUNT(*) FROM personal_access_tokens WHERE user_id = $1 AND expires_at > NOW()`, user.ID).Scan(&owned)
+		if owned >= config.MaxTokensPerUser {
+			http.Error(w, "Token limit reached", http.StatusForbidden)
+			return
+		}
+		secret, err := generateToken()
+		if err != nil {
+			http.Error(w, "Failed to create token", http.StatusInternalServerError)
+			return
+		}
+		token := accessTokenPrefix + secret
+		t, err := scanAccessToken(db.QueryRow(`
+			INSERT INTO personal_access_tokens (user_id, name, token_hash, scopes, expires_at)
+			VALUES ($1, $2, $3, $4, $5)
+			RETURNING id, name, scopes, expires_at, last_used_at, created_at`,
+			user.ID, req.Name, hashToken(token), pq.Array(scopes), expires))
+		if err != nil {
+			log.Printf("DB Error creating access token: %v", err)
+			http.Error(w, "Failed to create token", http.StatusInternalServerError)
+			return
+		}
+		t.Token = token
+		log.Printf("User %d created access token %d with scopes %s", user.ID, t.ID, strings.Join(scopes, ","))
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(t)
+	}
+}
+
+// deleteAccessTokenHandler revokes one of the caller's tokens. Admins can
+// revoke anyone's.
+func deleteAccessTokenHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := userFromContext(r.Context())
+		if user == nil {
+			http.Error(w, "User not found", http.StatusUnauthorized)
+			return
+		}
+		id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid token ID", http.StatusBadRequest)
+			return
+		}
+		res, err := db.Exec(`DELETE FROM personal_access_tokens WHERE id = $1 AND (user_id = $2 OR $3)`,
+			id, user.ID, isAdmin(user))
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "Token not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// scopeRouter is the real route table with every request stopped before
+// authentication and answered with the scope it needs.
+func scopeRouter() *mux.Router {
+	r := mux.NewRouter()
+	registerRoutes(r, nil, nil, nil, nil, nil, nil, nil, nil)
+	r.Use(func(http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(routeScope(r)))
+		})
+	})
+	return r
+}
+
+func TestRouteScope(t *testing.T) {
+	router := scopeRouter()
+	tests := []struct {
+		method, path, want string
+	}{
+		{"GET", "/api/channels/1/messages", scopeMessagesRead},
+		{"POST", "/api/messages", scopeMessagesWrite},
+		{"POST", "/api/upload-file", scopeUpload},
+		{"PATCH", "/api/uploads/resumable/ab12", scopeUpload},
+		{"PUT", "/api/channels/1", scopeAdmin},
+		{"DELETE", "/api/channels/1", scopeAdmin},
+		{"POST", "/api/emoji", scopeAdmin},
+		{"POST", "/api/channels/1/webhooks", scopeAdmin},
+		{"PUT", "/api/users/1/storage-quota", scopeAdmin},
+		{"GET", "/api/tokens", ""},
+		{"POST", "/api/tokens", ""},
+		{"POST", "/api/bots", ""},
+		{"POST", "/api/mfa/disable", ""},
+		{"POST", "/api/oidc/link", ""},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.path, nil))
+		if got := rec.Body.String(); got != tt.want {
+			t.Errorf("%s %s needs %q, want %q", tt.method, tt.path, got, tt.want)
+		}
+	}
+}
+
+// Every entry in routeScopes must name a registered route, so a renamed
+// route cannot silently fall back to being closed or, worse, leave a stale
+// grant behind.
+func TestRouteScopesMatchRoutes(t *testing.T) {
+	registered := map[string]bool{}
+	scopeRouter().Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil || !strings.HasPrefix(path, "/api/") {
+			return nil
+		}
+		methods, _ := route.GetMethods()
+		for _, m := range methods {
+			registered[m+" "+strings.TrimPrefix(path, "/api")] = true
+		}
+		return nil
+	})
+	for key := range routeScopes {
+		if !registered[key] {
+			t.Errorf("routeScopes lists %q, which is not a route", key)
+		}
+	}
+}
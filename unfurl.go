@@ -0,0 +1,510 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"image"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Link previews: URLs in new messages are fetched in the background, their
+// OpenGraph, Twitter card and oEmbed metadata is turned into an Embed, and
+// the message is re-broadcast with message_updated once embeds are attached.
+// Previews are cached per URL, including failures, for config.UnfurlCacheTTL.
+
+const (
+	maxEmbedsPerMessage = 5
+	unfurlWorkers       = 4
+	// failedPreviewTTL is how long a URL without a preview is remembered.
+	failedPreviewTTL = time.Hour
+	unfurlUserAgent  = "Mozilla/5.0 (compatible; PrismaBot/1.0; link preview)"
+)
+
+var (
+	linkPattern      = regexp.MustCompile(`https?://[^\s<>"]+`)
+	metaTagPattern   = regexp.MustCompile(`(?is)<meta\s([^>]*)>`)
+	linkTagPattern   = regexp.MustCompile(`(?is)<link\s([^>]*)>`)
+	titleTagPattern  = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+	attributePattern = regexp.MustCompile(`(?s)([a-zA-Z_:-]+)\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'>]+))`)
+	colorPattern     = regexp.MustCompile(`^#[0-9a-fA-F]{3,8}$`)
+)
+
+// extractLinks returns the distinct http(s) URLs in content, in order. Links
+// wrapped in <angle brackets> are skipped so senders can suppress previews.
+func extractLinks(content string) []string {
+	var links []string
+	seen := make(map[string]bool)
+	for _, loc := range linkPattern.FindAllStringIndex(content, -1) {
+		link := trimLinkPunctuation(content[loc[0]:loc[1]])
+		if loc[0] > 0 && content[loc[0]-1] == '<' && loc[0]+len(link) < len(content) && content[loc[0]+len(link)] == '>' {
+			continue
+		}
+		u, err := url.Parse(link)
+		if err != nil || checkOutboundURL(u) != nil || seen[link] {
+			continue
+		}
+		seen[link] = true
+		links = append(links, link)
+		if len(links) == maxEmbedsPerMessage {
+			break
+		}
+	}
+	return links
+}
+
+// trimLinkPunctuation drops sentence punctuation that follows a link, and a
+// closing parenthesis unless the link itself opened one.
+func trimLinkPunctuation(link string) string {
+	for len(link) > 0 {
+		last := link[len(link)-1]
+		switch {
+		case strings.IndexByte(".,;:!?'*_~>", last) >= 0:
+			link = link[:len(link)-1]
+		case last == ')' && strings.Count(link, "(") < strings.Count(link, ")"):
+			link = link[:len(link)-1]
+		default:
+			return link
+		}
+	}
+	return link
+}
+
+// --- Worker ---
+
+type unfurlJob struct {
+	messageID int64
+	links     []string
+}
+
+type linkUnfurler struct {
+	db     *sql.DB
+	hub    *Hub
+	client *http.Client
+	jobs   chan unfurlJob
+}
+
+func newLinkUnfurler(db *sql.DB, hub *Hub) *linkUnfurler {
+	return &linkUnfurler{
+		db:     db,
+		hub:    hub,
+		client: newPublicHTTPClient(config.UnfurlTimeout),
+		jobs:   make(chan unfurlJob, 256),
+	}
+}
+
+func (u *linkUnfurler) start() {
+	for i := 0; i < unfurlWorkers; i++ {
+		go func() {
+			for job := range u.jobs {
+				u.process(job)
+			}
+		}()
+	}
+}
+
+// enqueue schedules previews for the links in a new message. It never blocks
+// the request; when the queue is full the message simply gets no embeds.
+func (u *linkUnfurler) enqueue(messageID int64, content string) {
+	if !config.UnfurlLinks {
+		return
+	}
+	links := extractLinks(content)
+	if len(links) == 0 {
+		return
+	}
+	select {
+	case u.jobs <- unfurlJob{messageID, links}:
+	default:
+		log.Printf("Link preview queue full, skipping message %d", messageID)
+	}
+}
+
+func (u *linkUnfurler) process(job unfurlJob) {
+	var embeds []Embed
+	for _, link := range job.links {
+		embed, err := u.preview(link)
+		if err != nil {
+			log.Printf("Link preview for %s failed: %v", link, err)
+			continue
+		}
+		if embed != nil {
+			embeds = append(embeds, *embed)
+		}
+	}
+	if len(embeds) == 0 {
+		return
+	}
+	if err := addMessageEmbeds(u.db, job.messageID, embeds); err != nil {
+		// Most likely the message was deleted in the meantime.
+		log.Printf("Failed to attach embeds to message %d: %v", job.messageID, err)
+		return
+	}
+	if msg, err := getMessageByID(u.db, job.messageID); err == nil {
+		broadcastMessage(u.hub, "message_updated", msg)
+		queueEvent(u.db, eventMessageUpdated, msg)
+	}
+}
+
+// preview returns the cached embed for link, fetching it when the cache entry
+// is missing or stale. A nil embed means the page has nothing to show.
+func (u *linkUnfurler) preview(link string) (*Embed, error) {
+	var raw []byte
+	var fetchedAt time.Time
+	err := u.db.QueryRow(`SELECT embed, fetched_at FROM link_previews WHERE url = $1`, link).Scan(&raw, &fetchedAt)
+	if err == nil {
+		ttl := config.UnfurlCacheTTL
+		if raw == nil {
+			ttl = failedPreviewTTL
+		}
+		if time.Since(fetchedAt) < ttl {
+			if raw == nil {
+				return nil, nil
+			}
+			var embed Embed
+			if err := json.Unmarshal(raw, &embed); err != nil {
+				return nil, err
+			}
+			return &embed, nil
+		}
+	} else if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), config.UnfurlTimeout)
+	defer cancel()
+	embed, fetchErr := u.fetch(ctx, link)
+	raw = nil
+	if embed != nil {
+		raw, _ = json.Marshal(embed)
+	}
+	_, err = u.db.Exec(`
+		INSERT INTO link_previews (url, embed, fetched_at) VALUES ($1, $2, NOW())
+		ON CONFLICT (url) DO UPDATE SET embed = EXCLUDED.embed, fetched_at = EXCLUDED.fetched_at`, link, raw)
+	if err != nil {
+		log.Printf("Failed to cache link preview for %s: %v", link, err)
+	}
+	return embed, fetchErr
+}
+
+// --- Fetching ---
+
+var errPreviewTooLarge = errors.New("response too large")
+
+// get fetches target and returns the response with its body limited to
+// config.UnfurlMaxBytes.
+func (u *linkUnfurler) get(ctx context.Context, target, accept string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", unfurlUserAgent)
+	req.Header.Set("Accept", accept)
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	if resp.ContentLength > config.UnfurlMaxBytes {
+		resp.Body.Close()
+		return nil, errPreviewTooLarge
+	}
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(resp.Body, config.UnfurlMaxBytes), resp.Body}
+	return resp, nil
+}
+
+func (u *linkUnfurler) fetch(ctx context.Context, link string) (*Embed, error) {
+	resp, err := u.get(ctx, link, "text/html,application/xhtml+xml,image/*;q=0.8")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+
+	switch {
+	case strings.HasPrefix(mediaType, "image/"):
+		embed := &Embed{URL: link, Type: "image", ImageURL: link}
+		if cfg, _, err := image.DecodeConfig(resp.Body); err == nil {
+			embed.ImageWidth, embed.ImageHeight = cfg.Width, cfg.Height
+		}
+		return embed, nil
+	case mediaType == "text/html" || mediaType == "application/xhtml+xml":
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		page := parsePageMetadata(string(body), resp.Request.URL)
+		embed := page.embed(link)
+		if page.oembedURL != "" {
+			if err := u.applyOEmbed(ctx, embed, page.oembedURL); err != nil {
+				log.Printf("oEmbed lookup for %s failed: %v", link, err)
+			}
+		}
+		if embed.Title == "" && embed.Description == "" && embed.ImageURL == "" {
+			return nil, nil
+		}
+		return embed, nil
+	}
+	return nil, nil
+}
+
+// oEmbedResponse holds the oEmbed fields we use. The provider's html is
+// ignored: it is arbitrary markup and would need sandboxing to display.
+type oEmbedResponse struct {
+	Type            string      `json:"type"`
+	Title           string      `json:"title"`
+	AuthorName      string      `json:"author_name"`
+	ProviderName    string      `json:"provider_name"`
+	URL             string      `json:"url"`
+	Width           json.Number `json:"width"`
+	Height          json.Number `json:"height"`
+	ThumbnailURL    string      `json:"thumbnail_url"`
+	ThumbnailWidth  json.Number `json:"thumbnail_width"`
+	ThumbnailHeight json.Number `json:"thumbnail_height"`
+}
+
+// applyOEmbed fills gaps in embed from the page's oEmbed endpoint.
+func (u *linkUnfurler) applyOEmbed(ctx context.Context, embed *Embed, endpoint string) error {
+	resp, err := u.get(ctx, endpoint, "application/json")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var o oEmbedResponse
+	if err := json.NewDecoder(resp.Body).Decode(&o); err != nil {
+		return err
+	}
+	if embed.Title == "" {
+		embed.Title = truncateRunes(o.Title, 256)
+	}
+	if embed.SiteName == "" {
+		embed.SiteName = truncateRunes(o.ProviderName, 128)
+	}
+	embed.AuthorName = truncateRunes(o.AuthorName, 128)
+	switch o.Type {
+	case "photo":
+		if isHTTPURL(o.URL) {
+			embed.Type = "image"
+			embed.ImageURL = o.URL
+			embed.ImageWidth, embed.ImageHeight = numberToInt(o.Width), numberToInt(o.Height)
+		}
+	case "video", "rich":
+		embed.Type = o.Type
+	}
+	if embed.ImageURL == "" && isHTTPURL(o.ThumbnailURL) {
+		embed.ImageURL = o.ThumbnailURL
+		embed.ImageWidth, embed.ImageHeight = numberToInt(o.ThumbnailWidth), numberToInt(o.ThumbnailHeight)
+	}
+	return nil
+}
+
+// --- HTML metadata ---
+
+type pageMetadata struct {
+	meta      map[string]string
+	title     string
+	oembedURL string
+	base      *url.URL
+}
+
+// parsePageMetadata collects <meta> properties, the <title> and the oEmbed
+// discovery link from the document head.
+func parsePageMetadata(doc string, base *url.URL) *pageMetadata {
+	if end := strings.Index(strings.ToLower(doc), "</head>"); end >= 0 {
+		doc = doc[:end]
+	}
+	page := &pageMetadata{meta: make(map[string]string), base: base}
+	for _, m := range metaTagPattern.FindAllStringSubmatch(doc, -1) {
+		attrs := parseAttributes(m[1])
+		key := attrs["property"]
+		if key == "" {
+			key = attrs["name"]
+		}
+		key = strings.ToLower(key)
+		if _, exists := page.meta[key]; key != "" && !exists {
+			page.meta[key] = strings.TrimSpace(attrs["content"])
+		}
+	}
+	if m := titleTagPattern.FindStringSubmatch(doc); m != nil {
+		page.title = strings.TrimSpace(html.UnescapeString(m[1]))
+	}
+	for _, m := range linkTagPattern.FindAllStringSubmatch(doc, -1) {
+		attrs := parseAttributes(m[1])
+		if strings.EqualFold(attrs["rel"], "alternate") && strings.EqualFold(attrs["type"], "application/json+oembed") {
+			page.oembedURL = page.resolve(attrs["href"])
+			break
+		}
+	}
+	return page
+}
+
+func parseAttributes(s string) map[string]string {
+	attrs := make(map[string]string)
+	for _, m := range attributePattern.FindAllStringSubmatch(s, -1) {
+		attrs[strings.ToLower(m[1])] = html.UnescapeString(m[2] + m[3] + m[4])
+	}
+	return attrs
+}
+
+// first returns the first non-empty meta value among keys.
+func (p *pageMetadata) first(keys ...string) string {
+	for _, key := range keys {
+		if v := p.meta[key]; v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// resolve makes ref absolute against the page URL, returning "" for anything
+// that is not an http(s) URL.
+func (p *pageMetadata) resolve(ref string) string {
+	if ref == "" {
+		return ""
+	}
+	u, err := p.base.Parse(ref)
+	if err != nil || checkOutboundURL(u) != nil {
+		return ""
+	}
+	return u.String()
+}
+
+func (p *pageMetadata) embed(link string) *Embed {
+	embed := &Embed{
+		URL:         link,
+		Type:        "link",
+		Title:       truncateRunes(p.first("og:title", "twitter:title"), 256),
+		Description: truncateRunes(p.first("og:description", "twitter:description", "description"), 1024),
+		SiteName:    truncateRunes(p.first("og:site_name", "application-name"), 128),
+		ImageURL:    p.resolve(p.first("og:image", "og:image:url", "og:image:secure_url", "twitter:image", "twitter:image:src")),
+		Color:       p.first("theme-color"),
+	}
+	if embed.Title == "" {
+		embed.Title = truncateRunes(p.title, 256)
+	}
+	if embed.ImageURL != "" {
+		embed.ImageWidth, _ = strconv.Atoi(p.meta["og:image:width"])
+		embed.ImageHeight, _ = strconv.Atoi(p.meta["og:image:height"])
+	}
+	if ogType := p.meta["og:type"]; strings.HasPrefix(ogType, "video") {
+		embed.Type = "video"
+	}
+	if !colorPattern.MatchString(embed.Color) {
+		embed.Color = ""
+	}
+	return embed
+}
+
+func truncateRunes(s string, max int) string {
+	s = strings.TrimSpace(s)
+	runes := []rune(s)
+	if len(runes) <= max {
+		return s
+	}
+	return strings.TrimSpace(string(runes[:max-1])) + "…"
+}
+
+func isHTTPURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && checkOutboundURL(u) == nil
+}
+
+func numberToInt(n json.Number) int {
+	f, err := n.Float64()
+	if err != nil {
+		return 0
+	}
+	return int(f)
+}
+
+// --- Storage ---
+
+// addMessageEmbeds appends embeds to a message.
+func addMessageEmbeds(db *sql.DB, messageID int64, embeds []Embed) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	var next int
+	if err := tx.QueryRow(`SELECT COALESCE(MAX(position) + 1, 0) FROM message_embeds WHERE message_id = $1`, messageID).Scan(&next); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := insertEmbeds(tx, messageID, next, embeds); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// insertEmbeds stores embeds for a message starting at position start.
+func insertEmbeds(tx *sql.Tx, messageID int64, start int, embeds []Embed) error {
+	for i, embed := range embeds {
+		raw, err := json.Marshal(embed)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`INSERT INTO message_embeds (message_id, position, embed) VALUES ($1, $2, $3)`,
+			messageID, start+i, raw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadEmbeds fills in Embeds for every message in the slice.
+func loadEmbeds(db *sql.DB, messages []Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	ids := make([]int64, len(messages))
+	index := make(map[int64]int, len(messages))
+	for i, msg := range messages {
+		ids[i] = msg.ID
+		index[msg.ID] = i
+		if messages[i].Embeds == nil {
+			messages[i].Embeds = []Embed{}
+		}
+	}
+	rows, err := db.Query(`
+		SELECT message_id, embed FROM message_embeds
+		WHERE message_id = ANY($1) ORDER BY message_id, position`, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var messageID int64
+		var raw []byte
+		if err := rows.Scan(&messageID, &raw); err != nil {
+			return err
+		}
+		var embed Embed
+		if err := json.Unmarshal(raw, &embed); err != nil {
+			continue
+		}
+		embed.ProxyImageURL = proxyURL(embed.ImageURL)
+		i := index[messageID]
+		messages[i].Embeds = append(messages[i].Embeds, embed)
+	}
+	return rows.Err()
+}
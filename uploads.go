@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// storeUpload spools src to a temporary file, generates image variants, puts
+// everything into the blob store and records the upload row. It is shared by
+// every path that creates uploads. The stored file type is sniffed from the
+// content; client claims are ignored.
+//
+// Blobs are content-addressed by SHA-256: identical files are stored once and
+// shared through the blobs table's reference count, while every upload keeps
+// its own row, name and owner.
+func storeUpload(ctx context.Context, db *sql.DB, blobs BlobStore, userID int64, origFilename string, src io.Reader) (*Upload, error) {
+	head := make([]byte, sniffLen)
+	hn, err := io.ReadFull(src, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return nil, err
+	}
+	head = head[:hn]
+	filetype := detectContentType(head)
+	if err := checkUploadType(origFilename, filetype); err != nil {
+		return nil, err
+	}
+
+	tmp, err := os.CreateTemp("", "prisma-upload-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, hash), io.MultiReader(bytes.NewReader(head), src))
+	if err != nil {
+		return nil, err
+	}
+	// Metadata is stripped before hashing so copies of a photo that differ
+	// only in EXIF share a blob.
+	digest := hash.Sum(nil)
+	clean, err := sanitizeImageFile(tmp, filetype)
+	if errors.Is(err, errImageTooLarge) {
+		return nil, &httpError{http.StatusBadRequest, "Image dimensions too large"}
+	} else if errors.Is(err, errMalformedImage) || errors.Is(err, errNotImage) {
+		return nil, &httpError{http.StatusBadRequest, "Malformed image file"}
+	} else if err != nil {
+		return nil, err
+	}
+	if clean != nil {
+		sum := sha256.Sum256(clean)
+		digest, n = sum[:], int64(len(clean))
+	}
+	// Reservations are not counted: a finalizing resumable upload is one.
+	// insertUpload repeats the check under a lock; this one saves storing
+	// content that would be refused.
+	if err := checkStorageQuota(db, userID, n, false); err != nil {
+		return nil, err
+	}
+
+	up := &Upload{
+		UserID:         userID,
+		OrigFilename:   origFilename,
+		StoredFilename: fmt.Sprintf("file_%d_%d%s", userID, time.Now().UnixNano(), filepath.Ext(origFilename)),
+		Filetype:       filetype,
+		Filesize:       n,
+		ScanStatus:     scanPending,
+		BlobHash:       hex.EncodeToString(digest),
+	}
+	up.BlobKey = "sha256_" + up.BlobHash
+
+	reused, err := reuseBlob(ctx, db, blobs, up)
+	if err != nil {
+		return nil, err
+	}
+	if !reused {
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		img, format, err := decodeImage(tmp)
+		if errors.Is(err, errImageTooLarge) {
+			return nil, &httpError{http.StatusBadRequest, "Image dimensions too large"}
+		}
+
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		if err := blobs.Put(ctx, up.BlobKey, tmp, n, filetype); err != nil {
+			return nil, err
+		}
+		if img != nil {
+			up.Width, up.Height = img.Bounds().Dx(), img.Bounds().Dy()
+			up.Variants, err = writeVariants(ctx, blobs, img, format, up.BlobKey, attachmentVariantSpecs)
+			if err != nil {
+				log.Printf("Failed to create image variants for %s: %v", up.BlobKey, err)
+			}
+			for i := range up.Variants {
+				up.Variants[i].BlobKey = up.Variants[i].StoredFilename
+			}
+		}
+	}
+	nameVariants(up)
+
+	if err := insertUpload(db, up); err != nil {
+		if !reused {
+			var referenced bool
+			db.QueryRow(`SELECT EXISTS (SELECT 1 FROM blobs WHERE hash = $1)`, up.BlobHash).Scan(&referenced)
+			if !referenced {
+				blobs.Delete(ctx, up.BlobKey)
+				for _, v := range up.Variants {
+					blobs.Delete(ctx, v.BlobKey)
+				}
+			}
+		}
+		return nil, err
+	}
+	return up, nil
+}
+
+// reuseBlob fills in dimensions, variants and a clean scan verdict from an
+// existing blob with the same content. It reports false when the content has
+// to be stored, and fails with errUploadInfected for quarantined content.
+func reuseBlob(ctx context.Context, db *sql.DB, blobs BlobStore, up *Upload) (bool, error) {
+	var sourceID int64
+	var width, height sql.NullInt64
+	var scanStatus string
+	err := db.QueryRow(`
+		SELECT up.id, up.width, up.height, up.scan_status FROM blobs b JOIN uploads up ON up.blob_hash = b.hash
+		WHERE b.hash = $1 AND b.refcount > 0 LIMIT 1`, up.BlobHash).Scan(&sourceID, &width, &height, &scanStatus)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if scanStatus == scanInfected {
+		return false, errUploadInfected
+	}
+	// The row can outlive the object if a concurrent delete just released it.
+	if _, err := blobs.Stat(ctx, up.BlobKey); err == errBlobNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	variants, err := loadUploadVariants(db, []int64{sourceID})
+	if err != nil {
+		return false, err
+	}
+	up.Width, up.Height = int(width.Int64), int(height.Int64)
+	up.Variants = variants[sourceID]
+	if scanStatus == scanClean {
+		up.ScanStatus = scanClean
+	}
+	return true, nil
+}
+
+// nameVariants gives each variant a per-upload stored_filename derived from
+// the upload's own, so URLs and access checks stay tied to this upload even
+// when the variant blob is shared.
+func nameVariants(up *Upload) {
+	stem := strings.TrimSuffix(up.StoredFilename, filepath.Ext(up.StoredFilename))
+	for i, v := range up.Variants {
+		up.Variants[i].StoredFilename = fmt.Sprintf("%s_%s%s", stem, v.Name, filepath.Ext(v.BlobKey))
+	}
+}
+
+func insertUpload(db *sql.DB, up *Upload) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := lockStorageQuota(tx, up.UserID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := checkStorageQuota(tx, up.UserID, up.Filesize, false); err != nil {
+		tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO blobs (hash, blob_key, size, content_type, refcount) VALUES ($1, $2, $3, $4, 1)
+		ON CONFLICT (hash) DO UPDATE SET refcount = blobs.refcount + 1`,
+		up.BlobHash, up.BlobKey, up.Filesize, up.Filetype)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = tx.QueryRow(
+		`INSERT INTO uploads (user_id, orig_filename, stored_filename, filetype, filesize, width, height, blob_hash, blob_key, scan_status)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING id, uploaded_at`,
+		up.UserID, up.OrigFilename, up.StoredFilename, up.Filetype, up.Filesize, nullInt(up.Width), nullInt(up.Height),
+		up.BlobHash, up.BlobKey, up.ScanStatus,
+	).Scan(&up.ID, &up.UploadedAt)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, v := range up.Variants {
+		if _, err := tx.Exec(
+			`INSERT INTO upload_variants (upload_id, name, stored_filename, width, height, filesize, blob_key) VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+			up.ID, v.Name, v.StoredFilename, v.Width, v.Height, v.Filesize, v.BlobKey,
+		); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// deleteUpload removes an upload row, which also detaches it from any message,
+// and releases its blob. Stored objects are deleted once nothing references
+// them. It returns the number of bytes removed from the blob store.
+func deleteUpload(ctx context.Context, db *sql.DB, blobs BlobStore, uploadID int64) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	var hash sql.NullString
+	var key string
+	var size sql.NullInt64
+	err = tx.QueryRow(`
+		SELECT blob_hash, COALESCE(blob_key, stored_filename), filesize
+		FROM uploads WHERE id = $1 FOR UPDATE`, uploadID).Scan(&hash, &key, &size)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	type storedObject struct {
+		key  string
+		size int64
+	}
+	objects := []storedObject{{key, size.Int64}}
+	rows, err := tx.Query(`SELECT COALESCE(blob_key, stored_filename), filesize FROM upload_variants WHERE upload_id = $1`, uploadID)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	for rows.Next() {
+		var o storedObject
+		if err := rows.Scan(&o.key, &o.size); err == nil {
+			objects = append(objects, o)
+		}
+	}
+	rows.Close()
+
+	if _, err := tx.Exec(`DELETE FROM uploads WHERE id = $1`, uploadID); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	release := true
+	if hash.Valid {
+		var refcount int
+		err := tx.QueryRow(`UPDATE blobs SET refcount = refcount - 1 WHERE hash = $1 RETURNING refcount`, hash.String).Scan(&refcount)
+		if err != nil && err != sql.ErrNoRows {
+			tx.Rollback()
+			return 0, err
+		}
+		if refcount > 0 {
+			release = false
+		} else if _, err := tx.Exec(`DELETE FROM blobs WHERE hash = $1`, hash.String); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	if !release {
+		return 0, nil
+	}
+
+	var freed int64
+	for _, o := range objects {
+		if err := blobs.Delete(ctx, o.key); err != nil {
+			log.Printf("Failed to delete blob %s: %v", o.key, err)
+			continue
+		}
+		freed += o.size
+	}
+	return freed, nil
+}
+
+// loadUploadVariants returns the variants of each upload keyed by upload ID.
+func loadUploadVariants(db *sql.DB, uploadIDs []int64) (map[int64][]ImageVariant, error) {
+	variants := make(map[int64][]ImageVariant)
+	if len(uploadIDs) == 0 {
+		return variants, nil
+	}
+	rows, err := db.Query(`
+		SELECT upload_id, name, stored_filename, width, height, filesize, COALESCE(blob_key, stored_filename)
+		FROM upload_variants WHERE upload_id = ANY($1) ORDER BY upload_id, width`, pq.Array(uploadIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var uploadID int64
+		var v ImageVariant
+		if err := rows.Scan(&uploadID, &v.Name, &v.StoredFilename, &v.Width, &v.Height, &v.Filesize, &v.BlobKey); err != nil {
+			return nil, err
+		}
+		v.URL = signedUploadURL(v.StoredFilename)
+		variants[uploadID] = append(variants[uploadID], v)
+	}
+	return variants, rows.Err()
+}
+
+// uploadResponse is the JSON returned after an upload completes.
+func uploadResponse(up *Upload) map[string]interface{} {
+	for i := range up.Variants {
+		up.Variants[i].URL = signedUploadURL(up.Variants[i].StoredFilename)
+	}
+	return map[string]interface{}{
+		"id":              up.ID,
+		"orig_filename":   up.OrigFilename,
+		"stored_filename": up.StoredFilename,
+		"filetype":        up.Filetype,
+		"filesize":        up.Filesize,
+		"width":           up.Width,
+		"height":          up.Height,
+		"variants":        up.Variants,
+		"url":             signedUploadURL(up.StoredFilename),
+		"scan_status":     up.ScanStatus,
+	}
+}
+
+func nullInt(v int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(v), Valid: v != 0}
+}
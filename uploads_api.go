@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// --- Upload management API ---
+
+const uploadSelect = `
+	SELECT up.id, up.user_id, up.orig_filename, up.stored_filename, up.filetype, up.filesize,
+	       up.width, up.height, up.uploaded_at, ma.message_id, up.scan_status
+	FROM uploads up LEFT JOIN message_attachments ma ON ma.upload_id = up.id`
+
+func scanUpload(row rowScanner) (Upload, error) {
+	var up Upload
+	var filetype sql.NullString
+	var filesize, width, height, messageID sql.NullInt64
+	err := row.Scan(&up.ID, &up.UserID, &up.OrigFilename, &up.StoredFilename, &filetype, &filesize,
+		&width, &height, &up.UploadedAt, &messageID, &up.ScanStatus)
+	if err != nil {
+		return up, err
+	}
+	up.Filetype = filetype.String
+	up.Filesize = filesize.Int64
+	up.Width, up.Height = int(width.Int64), int(height.Int64)
+	up.MessageID = messageID.Int64
+	up.URL = signedUploadURL(up.StoredFilename)
+	return up, nil
+}
+
+// loadVariantsInto fills in Variants for every upload in the slice.
+func loadVariantsInto(db *sql.DB, uploads []Upload) error {
+	ids := make([]int64, len(uploads))
+	for i, up := range uploads {
+		ids[i] = up.ID
+	}
+	variants, err := loadUploadVariants(db, ids)
+	if err != nil {
+		return err
+	}
+	for i := range uploads {
+		uploads[i].Variants = variants[uploads[i].ID]
+	}
+	return nil
+}
+
+// pageParams reads limit/offset query parameters with sane bounds.
+func pageParams(q url.Values) (int, int) {
+	limit, err := strconv.Atoi(q.Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = 50
+	}
+	if limit > 200 {
+		limit = 200
+	}
+	offset, err := strconv.Atoi(q.Get("offset"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+	return limit, offset
+}
+
+// typeFilter turns "image/*" or "application/pdf" into a condition on column.
+func typeFilter(column, filter string) (string, string) {
+	if strings.HasSuffix(filter, "/*") {
+		return fmt.Sprintf("split_part(%s, '/', 1)", column), strings.TrimSuffix(filter, "/*")
+	}
+	return fmt.Sprintf("split_part(%s, ';', 1)", column), filter
+}
+
+// listUploadsHandler lists the caller's uploads. Admins may pass all=true or
+// another user_id. Filters: type, min_size, max_size, since, until, attached.
+func listUploadsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := userFromContext(r.Context())
+		if user == nil {
+			http.Error(w, "User not found", http.StatusUnauthorized)
+			return
+		}
+		q := r.URL.Query()
+		var where []string
+		var args []interface{}
+		add := func(cond string, v interface{}) {
+			args = append(args, v)
+			where = append(where, fmt.Sprintf(cond, len(args)))
+		}
+
+		switch {
+		case q.Get("user_id") != "":
+			userID, err := strconv.ParseInt(q.Get("user_id"), 10, 64)
+			if err != nil {
+				http.Error(w, "Invalid user_id", http.StatusBadRequest)
+				return
+			}
+			if userID != user.ID && !isAdmin(user) {
+				http.Error(w, "Admin access required", http.StatusForbidden)
+				return
+			}
+			add("up.user_id = $%d", userID)
+		case q.Get("all") == "true":
+			if !isAdmin(user) {
+				http.Error(w, "Admin access required", http.StatusForbidden)
+				return
+			}
+		default:
+			add("up.user_id = $%d", user.ID)
+		}
+
+		if t := q.Get("type"); t != "" {
+			expr, value := typeFilter("up.filetype", t)
+			add(expr+" = $%d", value)
+		}
+		for param, cond := range map[string]string{"min_size": "up.filesize >= $%d", "max_size": "up.filesize <= $%d"} {
+			if v := q.Get(param); v != "" {
+				size, err := parseByteSize(v)
+				if err != nil {
+					http.Error(w, "Invalid "+param, http.StatusBadRequest)
+					return
+				}
+				add(cond, size)
+			}
+		}
+		for param, cond := range map[string]string{"since": "up.uploaded_at >= $%d", "until": "up.uploaded_at < $%d"} {
+			if v := q.Get(param); v != "" {
+				t, err := time.Parse(time.RFC3339, v)
+				if err != nil {
+					http.Error(w, "Invalid "+param+", expected RFC 3339", http.StatusBadRequest)
+					return
+				}
+				add(cond, t)
+			}
+		}
+		switch q.Get("attached") {
+		case "true":
+			where = append(where, "ma.message_id IS NOT NULL")
+		case "false":
+			where = append(where, "ma.message_id IS NULL")
+		}
+
+		query := uploadSelect
+		if len(where) > 0 {
+			query += " WHERE " + strings.Join(where, " AND ")
+		}
+		limit, offset := pageParams(q)
+		query += fmt.Sprintf(" ORDER BY up.uploaded_at DESC, up.id DESC LIMIT %d OFFSET %d", limit, offset)
+
+		rows, err := db.Query(query, args...)
+		if err != nil {
+			log.Printf("DB Error listing uploads: %v", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+		uploads := []Upload{}
+		for rows.Next() {
+			if up, err := scanUpload(rows); err == nil {
+				uploads = append(uploads, up)
+			}
+		}
+		rows.Close()
+		if err := loadVariantsInto(db, uploads); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(uploads)
+	}
+}
+
+func getUploadHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := userFromContext(r.Context())
+		uploadID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid upload ID", http.StatusBadRequest)
+			return
+		}
+		up, err := scanUpload(db.QueryRow(uploadSelect+` WHERE up.id = $1`, uploadID))
+		if err == sql.ErrNoRows || (err == nil && !canReadUpload(db, user, up.ID, up.UserID)) {
+			http.Error(w, "Upload not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		uploads := []Upload{up}
+		if err := loadVariantsInto(db, uploads); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(uploads[0])
+	}
+}
+
+// deleteUploadHandler deletes an upload owned by the caller (or any upload,
+// for admins). Messages it was attached to are re-broadcast without it.
+func deleteUploadHandler(db *sql.DB, hub *Hub, blobs BlobStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := userFromContext(r.Context())
+		if user == nil {
+			http.Error(w, "User not found", http.StatusUnauthorized)
+			return
+		}
+		uploadID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid upload ID", http.StatusBadRequest)
+			return
+		}
+		var ownerID int64
+		var messageID sql.NullInt64
+		err = db.QueryRow(`
+			SELECT up.user_id, ma.message_id FROM uploads up
+			LEFT JOIN message_attachments ma ON ma.upload_id = up.id WHERE up.id = $1`, uploadID).Scan(&ownerID, &messageID)
+		if err == sql.ErrNoRows || (err == nil && ownerID != user.ID && !isAdmin(user)) {
+			http.Error(w, "Upload not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		var isEmoji bool
+		db.QueryRow(`SELECT EXISTS (SELECT 1 FROM custom_emoji WHERE upload_id = $1)`, uploadID).Scan(&isEmoji)
+		if isEmoji {
+			http.Error(w, "Upload is in use as a custom emoji", http.StatusConflict)
+			return
+		}
+
+		if _, err := deleteUpload(context.Background(), db, blobs, uploadID); err != nil {
+			log.Printf("Failed to delete upload %d: %v", uploadID, err)
+			http.Error(w, "Failed to delete upload", http.StatusInternalServerError)
+			return
+		}
+		if messageID.Valid {
+			if msg, err := getMessageByID(db, messageID.Int64); err == nil {
+				broadcastMessage(hub, "message_updated", msg)
+				queueEvent(db, eventMessageUpdated, msg)
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// channelFilesHandler lists attachments posted in a channel, newest first.
+// Accepts the same type filter and pagination as the uploads list.
+func channelFilesHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := userFromContext(r.Context())
+		channelID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid channel ID", http.StatusBadRequest)
+			return
+		}
+		if !canViewChannel(db, user, channelID) {
+			http.Error(w, "Channel not found", http.StatusNotFound)
+			return
+		}
+		q := r.URL.Query()
+		query := `
+			SELECT up.id, up.orig_filename, up.stored_filename, up.filetype, up.filesize, up.width, up.height,
+			       up.scan_status, m.id, m.user_id, u.username, m.created_at
+			FROM message_attachments ma
+			JOIN messages m ON ma.message_id = m.id
+			JOIN uploads up ON ma.upload_id = up.id
+			JOIN users u ON m.user_id = u.id
+			WHERE m.channel_id = $1`
+		args := []interface{}{channelID}
+		if t := q.Get("type"); t != "" {
+			expr, value := typeFilter("up.filetype", t)
+			args = append(args, value)
+			query += fmt.Sprintf(" AND %s = $%d", expr, len(args))
+		}
+		limit, offset := pageParams(q)
+		query += fmt.Sprintf(" ORDER BY m.created_at DESC, ma.position LIMIT %d OFFSET %d", limit, offset)
+
+		rows, err := db.Query(query, args...)
+		if err != nil {
+			log.Printf("DB Error listing channel files: %v", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+		files := []ChannelFile{}
+		var ids []int64
+		for rows.Next() {
+			var f ChannelFile
+			var storedFilename string
+			var filetype sql.NullString
+			var filesize, width, height sql.NullInt64
+			if err := rows.Scan(&f.ID, &f.Filename, &storedFilename, &filetype, &filesize, &width, &height,
+				&f.ScanStatus, &f.MessageID, &f.UserID, &f.Username, &f.PostedAt); err != nil {
+				continue
+			}
+			f.Filetype = filetype.String
+			f.Filesize = filesize.Int64
+			f.Width, f.Height = int(width.Int64), int(height.Int64)
+			f.URL = signedUploadURL(storedFilename)
+			files = append(files, f)
+			ids = append(ids, f.ID)
+		}
+		rows.Close()
+		variants, err := loadUploadVariants(db, ids)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		for i := range files {
+			files[i].Variants = variants[files[i].ID]
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(files)
+	}
+}
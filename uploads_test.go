@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"strings"
+	"testing"
+	"time"
+)
+
+func putTestBlob(t *testing.T, blobs BlobStore, key, content string) {
+	t.Helper()
+	if err := blobs.Put(context.Background(), key, strings.NewReader(content), int64(len(content)), "text/plain"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReuseBlob(t *testing.T) {
+	tests := []struct {
+		name       string
+		source     []driver.Value // the existing upload of the blob, if any
+		stored     bool           // whether the blob's object exists
+		wantReused bool
+		wantErr    error
+		wantStatus string
+	}{
+		{"new content", nil, false, false, nil, scanPending},
+		{"stored clean", []driver.Value{int64(7), int64(640), int64(480), scanClean}, true, true, nil, scanClean},
+		{"stored, scan pending", []driver.Value{int64(7), int64(640), int64(480), scanPending}, true, true, nil, scanPending},
+		{"object released meanwhile", []driver.Value{int64(7), int64(640), int64(480), scanClean}, false, false, nil, scanPending},
+		{"quarantined", []driver.Value{int64(7), nil, nil, scanInfected}, true, false, errUploadInfected, scanPending},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, _ := newFakeDB(t, func(query string, args []driver.Value) (fakeResult, error) {
+				switch {
+				case strings.Contains(query, "FROM blobs b JOIN uploads"):
+					if tt.source == nil {
+						return fakeRows(), nil
+					}
+					return fakeRows(tt.source), nil
+				case strings.Contains(query, "FROM upload_variants"):
+					return fakeRows([]driver.Value{int64(7), "thumb", "file_1_1_thumb.jpg", int64(320), int64(240), int64(900), "sha256_ab_thumb.jpg"}), nil
+				}
+				return fakeResult{}, nil
+			})
+			blobs := &fsBlobStore{dir: t.TempDir()}
+			up := &Upload{BlobHash: "ab", BlobKey: "sha256_ab", ScanStatus: scanPending}
+			if tt.stored {
+				putTestBlob(t, blobs, up.BlobKey, "content")
+			}
+
+			reused, err := reuseBlob(context.Background(), db, blobs, up)
+			if reused != tt.wantReused || err != tt.wantErr {
+				t.Fatalf("reuseBlob = %v, %v; want %v, %v", reused, err, tt.wantReused, tt.wantErr)
+			}
+			if up.ScanStatus != tt.wantStatus {
+				t.Errorf("scan status = %q, want %q", up.ScanStatus, tt.wantStatus)
+			}
+			if reused && (up.Width != 640 || up.Height != 480 || len(up.Variants) != 1 || up.Variants[0].BlobKey != "sha256_ab_thumb.jpg") {
+				t.Errorf("reused upload = %+v", up)
+			}
+		})
+	}
+}
+
+func TestInsertUploadCountsReference(t *testing.T) {
+	db, f := newFakeDB(t, func(query string, args []driver.Value) (fakeResult, error) {
+		switch {
+		case strings.Contains(query, "FOR UPDATE"):
+			return fakeRows([]driver.Value{int64(1)}), nil
+		case strings.Contains(query, "SELECT role, storage_quota"):
+			return fakeRows([]driver.Value{string(RoleAdmin), nil}), nil
+		case strings.Contains(query, "INSERT INTO uploads"):
+			return fakeRows([]driver.Value{int64(9), time.Now()}), nil
+		}
+		return fakeResult{affected: 1}, nil
+	})
+	saved := config
+	t.Cleanup(func() { config = saved })
+	config.RoleQuotas = map[Role]int64{RoleAdmin: 0}
+	config.GlobalStorageLimit = 0
+
+	up := &Upload{UserID: 1, BlobHash: "ab", BlobKey: "sha256_ab", Filesize: 10, ScanStatus: scanPending}
+	if err := insertUpload(db, up); err != nil {
+		t.Fatalf("insertUpload: %v", err)
+	}
+	if up.ID != 9 {
+		t.Errorf("ID = %d", up.ID)
+	}
+	if !f.ran("ON CONFLICT (hash) DO UPDATE SET refcount = blobs.refcount + 1") || !f.ran("COMMIT") {
+		t.Errorf("queries = %q, want the blob's refcount raised in a committed transaction", f.queries)
+	}
+}
+
+func TestDeleteUploadReleasesBlob(t *testing.T) {
+	tests := []struct {
+		name          string
+		hash          interface{} // nil for uploads stored before deduplication
+		refcountAfter int64
+		wantFreed     int64
+		wantDeleted   bool
+	}{
+		{"shared blob", "ab", 1, 0, false},
+		{"last reference", "ab", 0, 7 + 5, true},
+		{"not deduplicated", nil, 0, 7 + 5, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, f := newFakeDB(t, func(query string, args []driver.Value) (fakeResult, error) {
+				switch {
+				case strings.Contains(query, "FROM uploads WHERE id = $1 FOR UPDATE"):
+					return fakeRows([]driver.Value{tt.hash, "sha256_ab", int64(7)}), nil
+				case strings.Contains(query, "FROM upload_variants WHERE upload_id = $1"):
+					return fakeRows([]driver.Value{"sha256_ab_thumb.jpg", int64(5)}), nil
+				case strings.Contains(query, "UPDATE blobs SET refcount = refcount - 1"):
+					return fakeRows([]driver.Value{tt.refcountAfter}), nil
+				}
+				return fakeResult{affected: 1}, nil
+			})
+			blobs := &fsBlobStore{dir: t.TempDir()}
+			putTestBlob(t, blobs, "sha256_ab", "content")
+			putTestBlob(t, blobs, "sha256_ab_thumb.jpg", "thumb")
+
+			freed, err := deleteUpload(context.Background(), db, blobs, 3)
+			if err != nil {
+				t.Fatalf("deleteUpload: %v", err)
+			}
+			if freed != tt.wantFreed {
+				t.Errorf("freed %d bytes, want %d", freed, tt.wantFreed)
+			}
+			if got := f.ran("DELETE FROM blobs WHERE hash"); got != (tt.wantDeleted && tt.hash != nil) {
+				t.Errorf("blob row deleted = %v", got)
+			}
+			if got := f.ran("refcount - 1"); got != (tt.hash != nil) {
+				t.Errorf("refcount decremented = %v", got)
+			}
+			for _, key := range []string{"sha256_ab", "sha256_ab_thumb.jpg"} {
+				_, err := blobs.Stat(context.Background(), key)
+				if gone := err == errBlobNotFound; gone != tt.wantDeleted {
+					t.Errorf("%s deleted = %v, want %v", key, gone, tt.wantDeleted)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Incoming webhooks let scripts and integrations post into a channel without
+// a user account. Each webhook has a secret URL,
+//
+//	POST /api/webhooks/<id>/<token>        native JSON payload
+//	POST /api/webhooks/<id>/<token>/slack  Slack-compatible payload
+//
+// and posts through postMessage like any other message. The webhook's creator
+// is recorded as the author; the payload may override the displayed name and
+// avatar.
+
+const (
+	maxWebhookNameLength = 80
+	maxEmbedTitle        = 256
+	maxEmbedDescription  = 4096
+)
+
+// webhookPayload is the native payload format.
+type webhookPayload struct {
+	Content   string  `json:"content"`
+	Username  string  `json:"username"`
+	AvatarURL string  `json:"avatar_url"`
+	Embeds    []Embed `json:"embeds"`
+}
+
+// slackPayload is the subset of Slack's incoming webhook format we
+// understand. Blocks are ignored; integrations that send them also send text.
+type slackPayload struct {
+	Text        string            `json:"text"`
+	Username    string            `json:"username"`
+	IconURL     string            `json:"icon_url"`
+	Attachments []slackAttachment `json:"attachments"`
+}
+
+type slackAttachment struct {
+	Fallback   string `json:"fallback"`
+	Color      string `json:"color"`
+	Pretext    string `json:"pretext"`
+	AuthorName string `json:"author_name"`
+	Title      string `json:"title"`
+	TitleLink  string `json:"title_link"`
+	Text       string `json:"text"`
+	ImageURL   string `json:"image_url"`
+	Footer     string `json:"footer"`
+	Fields     []struct {
+		Title string `json:"title"`
+		Value string `json:"value"`
+	} `json:"fields"`
+}
+
+var (
+	slackEntityPattern = regexp.MustCompile(`<([^<>|\n]+)(?:\|([^<>\n]+))?>`)
+	slackBoldPattern   = regexp.MustCompile(`(^|[\s(])\*([^*\s](?:[^*\n]*[^*\s])?)\*`)
+	slackColors        = map[string]string{"good": "#2eb886", "warning": "#daa038", "danger": "#a30200"}
+)
+
+var (
+	errWebhookEmpty       = &httpError{http.StatusBadRequest, "Message is empty"}
+	errWebhookAvatar      = &httpError{http.StatusBadRequest, "avatar_url must be an http(s) URL"}
+	errWebhookEmbedsLimit = &httpError{http.StatusBadRequest, fmt.Sprintf("At most %d embeds per message", maxEmbedsPerMessage)}
+)
+
+func webhookURL(id int64, token string) string {
+	return fmt.Sprintf("/api/webhooks/%d/%s", id, token)
+}
+
+const webhookSelect = `
+	SELECT id, channel_id, name, COALESCE(avatar_url, ''), created_by, created_at FROM webhooks`
+
+func scanWebhook(row rowScanner) (Webhook, error) {
+	var wh Webhook
+	err := row.Scan(&wh.ID, &wh.ChannelID, &wh.Name, &wh.AvatarURL, &wh.CreatedBy, &wh.CreatedAt)
+	return wh, err
+}
+
+// withToken sets the token and secret URL, which are only ever returned
+// when the token is generated; the database keeps just its hash.
+func (wh Webhook) withToken(token string) Webhook {
+	wh.Token, wh.URL = token, webhookURL(wh.ID, token)
+	return wh
+}
+
+// draft turns a native payload into a message for wh.
+func (p webhookPayload) draft(wh Webhook) (messageDraft, error) {
+	d := messageDraft{
+		ChannelID:    wh.ChannelID,
+		UserID:       wh.CreatedBy,
+		Content:      strings.TrimSpace(p.Content),
+		WebhookID:    wh.ID,
+		AuthorName:   truncateRunes(p.Username, maxWebhookNameLength),
+		AuthorAvatar: strings.TrimSpace(p.AvatarURL),
+	}
+	if d.AuthorName == "" {
+		d.AuthorName = wh.Name
+	}
+	if d.AuthorAvatar == "" {
+		d.AuthorAvatar = wh.AvatarURL
+	} else if !isHTTPURL(d.AuthorAvatar) {
+		return d, errWebhookAvatar
+	}
+	if len(p.Embeds) > maxEmbedsPerMessage {
+		return d, errWebhookEmbedsLimit
+	}
+	for _, e := range p.Embeds {
+		if e = sanitizeEmbed(e); e != (Embed{Type: "rich"}) {
+			d.Embeds = append(d.Embeds, e)
+		}
+	}
+	if d.Content == "" && len(d.Embeds) == 0 {
+		return d, errWebhookEmpty
+	}
+	return d, nil
+}
+
+// sanitizeEmbed clamps a caller-supplied embed to what link previews could
+// have produced: http(s) URLs only, bounded text, a valid colour.
+func sanitizeEmbed(e Embed) Embed {
+	e = Embed{
+		URL:         strings.TrimSpace(e.URL),
+		Type:        "rich",
+		Title:       truncateRunes(e.Title, maxEmbedTitle),
+		Description: truncateRunes(e.Description, maxEmbedDescription),
+		SiteName:    truncateRunes(e.SiteName, maxEmbedTitle),
+		AuthorName:  truncateRunes(e.AuthorName, maxEmbedTitle),
+		ImageURL:    strings.TrimSpace(e.ImageURL),
+		Color:       e.Color,
+	}
+	if !isHTTPURL(e.URL) {
+		e.URL = ""
+	}
+	if !isHTTPURL(e.ImageURL) {
+		e.ImageURL = ""
+	}
+	if !colorPattern.MatchString(e.Color) {
+		e.Color = ""
+	}
+	return e
+}
+
+// native converts a Slack payload into the native format.
+func (p slackPayload) native() webhookPayload {
+	out := webhookPayload{Username: p.Username, AvatarURL: p.IconURL}
+	content := []string{convertSlackText(p.Text)}
+	for _, a := range p.Attachments {
+		if a.Pretext != "" {
+			content = append(content, convertSlackText(a.Pretext))
+		}
+		e := Embed{
+			URL:         a.TitleLink,
+			Title:       convertSlackText(a.Title),
+			Description: convertSlackText(a.Text),
+			AuthorName:  a.AuthorName,
+			SiteName:    a.Footer,
+			ImageURL:    a.ImageURL,
+			Color:       a.Color,
+		}
+		if c, ok := slackColors[a.Color]; ok {
+			e.Color = c
+		} else if a.Color != "" && !strings.HasPrefix(a.Color, "#") {
+			e.Color = "#" + a.Color
+		}
+		for _, f := range a.Fields {
+			e.Description += fmt.Sprintf("\n**%s**\n%s", convertSlackText(f.Title), convertSlackText(f.Value))
+		}
+		e.Description = strings.TrimSpace(e.Description)
+		if e.Title == "" && e.Description == "" {
+			e.Description = a.Fallback
+		}
+		out.Embeds = append(out.Embeds, e)
+	}
+	out.Content = strings.TrimSpace(strings.Join(content, "\n"))
+	return out
+}
+
+// convertSlackText rewrites Slack mrkdwn into our dialect: <url|label> links,
+// <!here>-style mentions, *bold* and the three HTML entities Slack escapes.
+func convertSlackText(s string) string {
+	s = slackEntityPattern.ReplaceAllStringFunc(s, func(m string) string {
+		sub := slackEntityPattern.FindStringSubmatch(m)
+		target, label := sub[1], sub[2]
+		switch {
+		case strings.HasPrefix(target, "!"):
+			return "@" + strings.TrimPrefix(target, "!")
+		case strings.HasPrefix(target, "@"), strings.HasPrefix(target, "#"):
+			if label != "" {
+				return target[:1] + label
+			}
+			return target
+		case isHTTPURL(target):
+			if label != "" {
+				return fmt.Sprintf("[%s](%s)", label, target)
+			}
+			return target
+		case strings.HasPrefix(target, "mailto:"):
+			if label != "" {
+				return label
+			}
+			return strings.TrimPrefix(target, "mailto:")
+		}
+		return m
+	})
+	s = slackBoldPattern.ReplaceAllString(s, "$1**$2**")
+	return strings.NewReplacer("&lt;", "<", "&gt;", ">", "&amp;", "&").Replace(s)
+}
+
+// --- Handlers ---
+
+// executeWebhookHandler posts a message through a webhook. It is public; the
+// token in the URL is the credential. Each webhook is held to limiter
+// (config.WebhookRateLimit).
+func executeWebhookHandler(db *sql.DB, hub *Hub, unfurler *linkUnfurler, limiter *rateLimiter, slack bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := strconv.ParseInt(vars["id"], 10, 64)
+		if err != nil {
+			http.Error(w, "Unknown webhook", http.StatusNotFound)
+			return
+		}
+		wh, err := scanWebhook(db.QueryRow(webhookSelect+` WHERE id = $1 AND token_hash = $2`, id, hashToken(vars["token"])))
+		if err == sql.ErrNoRows {
+			http.Error(w, "Unknown webhook", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		// Checked after the token so that requests with a wrong token
+		// cannot use up a webhook's allowance.
+		if ok, retryAfter := limiter.allow(wh.ID); !ok {
+			writeRateLimited(w, retryAfter)
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, 1<<20)
+		var payload webhookPayload
+		if slack {
+			var sp slackPayload
+			// Slack also accepts the JSON as a form field named payload.
+			if strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+				err = json.Unmarshal([]byte(r.FormValue("payload")), &sp)
+			} else {
+				err = json.NewDecoder(r.Body).Decode(&sp)
+			}
+			payload = sp.native()
+		} else {
+			err = json.NewDecoder(r.Body).Decode(&payload)
+		}
+		if err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		draft, err := payload.draft(wh)
+		if err != nil {
+			writeError(w, err, "Invalid payload")
+			return
+		}
+		msgID, err := postMessage(db, hub, unfurler, draft)
+		if err != nil {
+			writeError(w, err, "Failed to send message")
+			return
+		}
+
+		if slack {
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte("ok"))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]int64{"id": msgID})
+	}
+}
+
+func listWebhooksHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isAdmin(userFromContext(r.Context())) {
+			http.Error(w, "Admin access required", http.StatusForbidden)
+			return
+		}
+		channelID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid channel ID", http.StatusBadRequest)
+			return
+		}
+		rows, err := db.Query(webhookSelect+` WHERE channel_id = $1 ORDER BY id`, channelID)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+		webhooks := []Webhook{}
+		for rows.Next() {
+			if wh, err := scanWebhook(rows); err == nil {
+				webhooks = append(webhooks, wh)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(webhooks)
+	}
+}
+
+func createWebhookHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := userFromContext(r.Context())
+		if !isAdmin(user) {
+			http.Error(w, "Admin access required", http.StatusForbidden)
+			return
+		}
+		channelID, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid channel ID", http.StatusBadRequest)
+			return
+		}
+		var req struct {
+			Name      string `json:"name"`
+			AvatarURL string `json:"avatar_url"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		req.Name = truncateRunes(req.Name, maxWebhookNameLength)
+		if req.Name == "" {
+			http.Error(w, "Missing fields", http.StatusBadRequest)
+			return
+		}
+		if req.AvatarURL != "" && !isHTTPURL(req.AvatarURL) {
+			writeError(w, errWebhookAvatar, "")
+			return
+		}
+		var exists bool
+		db.QueryRow(`SELECT EXISTS (SELECT 1 FROM channels WHERE id = $1)`, channelID).Scan(&exists)
+		if !exists {
+			http.Error(w, "Channel not found", http.StatusNotFound)
+			return
+		}
+		token, err := generateToken()
+		if err != nil {
+			http.Error(w, "Failed to create webhook", http.StatusInternalServerError)
+			return
+		}
+		wh, err := scanWebhook(db.QueryRow(`
+			INSERT INTO webhooks (channel_id, name, avatar_url, token_hash, created_by) VALUES ($1, $2, NULLIF($3, ''), $4, $5)
+			RETURNING id, channel_id, name, COALESCE(avatar_url, ''), created_by, created_at`,
+			channelID, req.Name, req.AvatarURL, hashToken(token), user.ID))
+		if err != nil {
+			log.Printf("DB Error creating webhook: %v", err)
+			http.Error(w, "Failed to create webhook", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(wh.withToken(token))
+	}
+}
+
+// regenerateWebhookTokenHandler replaces a webhook's token, invalidating the
+// old URL.
+func regenerateWebhookTokenHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isAdmin(userFromContext(r.Context())) {
+			http.Error(w, "Admin access required", http.StatusForbidden)
+			return
+		}
+		id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid webhook ID", http.StatusBadRequest)
+			return
+		}
+		token, err := generateToken()
+		if err != nil {
+			http.Error(w, "Failed to regenerate token", http.StatusInternalServerError)
+			return
+		}
+		wh, err := scanWebhook(db.QueryRow(`
+			UPDATE webhooks SET token_hash = $1 WHERE id = $2
+			RETURNING id, channel_id, name, COALESCE(avatar_url, ''), created_by, created_at`, hashToken(token), id))
+		if err == sql.ErrNoRows {
+			http.Error(w, "Webhook not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(wh.withToken(token))
+	}
+}
+
+func deleteWebhookHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !isAdmin(userFromContext(r.Context())) {
+			http.Error(w, "Admin access required", http.StatusForbidden)
+			return
+		}
+		id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid webhook ID", http.StatusBadRequest)
+			return
+		}
+		res, err := db.Exec(`DELETE FROM webhooks WHERE id = $1`, id)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, "Webhook not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
@@ -19,12 +19,22 @@ type WebSocketMessage struct {
 type Hub struct {
 	clients         map[*Client]bool
 	broadcast       chan []byte
+	direct          chan directMessage
 	register        chan *Client
 	unregister      chan *Client
+	online          chan chan []int64
 	onlineUsers     map[int64]User
 	connectionCount map[int64]int
 }
 
+// directMessage is an event for every connection of one user. The hub
+// reports on delivered whether any connection took it.
+type directMessage struct {
+	userID    int64
+	data      []byte
+	delivered chan<- bool
+}
+
 type Client struct {
 	hub  *Hub
 	conn *websocket.Conn
@@ -39,8 +49,10 @@ var upgrader = websocket.Upgrader{
 func newHub() *Hub {
 	return &Hub{
 		broadcast:       make(chan []byte),
+		direct:          make(chan directMessage),
 		register:        make(chan *Client),
 		unregister:      make(chan *Client),
+		online:          make(chan chan []int64),
 		clients:         make(map[*Client]bool),
 		onlineUsers:     make(map[int64]User),
 		connectionCount: make(map[int64]int),
@@ -71,6 +83,13 @@ func (h *Hub) broadcastPresence() {
 	h.broadcast <- message
 }
 
+// onlineUserIDs returns the users with at least one connection.
+func (h *Hub) onlineUserIDs() []int64 {
+	reply := make(chan []int64, 1)
+	h.online <- reply
+	return <-reply
+}
+
 func (h *Hub) run() {
 	for {
 		select {
@@ -136,6 +155,25 @@ func (h *Hub) run() {
 					delete(h.clients, client)
 				}
 			}
+		case dm := <-h.direct:
+			// Slow clients are left to the broadcast path to drop.
+			sent := false
+			for client := range h.clients {
+				if client.user.ID == dm.userID {
+					select {
+					case client.send <- dm.data:
+						sent = true
+					default:
+					}
+				}
+			}
+			dm.delivered <- sent
+		case reply := <-h.online:
+			ids := make([]int64, 0, len(h.onlineUsers))
+			for id := range h.onlineUsers {
+				ids = append(ids, id)
+			}
+			reply <- ids
 		}
 	}
 }
@@ -165,17 +203,38 @@ func (c *Client) readPump() {
 
 // FIX: Authenticate WebSocket connection using the token from query parameter
 func serveWs(hub *Hub, db *sql.DB, w http.ResponseWriter, r *http.Request) {
-	// FIX: Authenticate WebSocket connection using the token from query parameter
-	token := r.URL.Query().Get("token")
-	if token == "" {
-		http.Error(w, "Missing authentication token", http.StatusBadRequest)
-		return
-	}
+	// Browsers cannot set headers on a WebSocket handshake, so they pass their
+	// session token as a query parameter. Bots send the usual Authorization
+	// header instead.
+	var user *User
+	if r.Header.Get("Authorization") != "" {
+		cred, err := authenticateRequest(db, r)
+		if err == nil && !cred.allows(scopeMessagesRead) {
+			err = errScopeRequired
+		}
+		if err != nil {
+			writeError(w, err, "")
+			return
+		}
+		user = cred.user
+	} else {
+		// FIX: Authenticate WebSocket connection using the token from query parameter
+		token := r.URL.Query().Get("token")
+		if token == "" {
+			http.Error(w, "Missing authentication token", http.StatusBadRequest)
+			return
+		}
 
-	// FIX: Get the user via the token, not an insecure user_id
-	user, ok := getUserByToken(db, token)
-	if !ok {
-		http.Error(w, "Invalid authentication token", http.StatusUnauthorized)
+		// FIX: Get the user via the token, not an insecure user_id
+		var ok bool
+		user, ok = getUserByToken(db, token)
+		if !ok {
+			http.Error(w, "Invalid authentication token", http.StatusUnauthorized)
+			return
+		}
+	}
+	if err := checkMFAEnforced(db, user); err != nil {
+		writeError(w, err, "Database error")
 		return
 	}
 